@@ -0,0 +1,505 @@
+package dash
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Representation ids, also used in segment URLs.
+const (
+	videoRep = "video"
+	audioRep = "audio"
+)
+
+// segmentsKept is how many segments older than the time shift buffer
+// are kept for clients that loaded the manifest just before.
+const segmentsKept = 2
+
+type segment struct {
+	number   uint64
+	start    uint32 // timestamp in milliseconds
+	duration uint32
+	data     []byte
+}
+
+// end returns the timestamp the segment ends at.
+func (s *segment) end() uint32 {
+	return s.start + s.duration
+}
+
+type representation struct {
+	id         string
+	codecs     string
+	width      int
+	height     int
+	frameRate  float64
+	sampleRate int
+	channels   int
+	init       []byte
+	segments   []*segment
+	nextNumber uint64
+}
+
+/*
+period is the part of a presentation made by one publishing session,
+or by the packets following a codec change. Its media timeline starts
+at offset, the timestamp of its first keyframe, which is presented
+start after the availability start time of the manifest.
+*/
+type period struct {
+	id     int
+	start  time.Duration
+	offset uint32
+	reps   []*representation
+}
+
+func (p *period) rep(id string) *representation {
+	for _, r := range p.reps {
+		if r.id == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// at returns the time of timestamp ts since the availability start.
+func (p *period) at(ts uint32) time.Duration {
+	return p.start + time.Duration(ts-p.offset)*time.Millisecond
+}
+
+// end returns the time the last segment of the period ends at.
+func (p *period) end() time.Duration {
+	end := p.start
+	for _, r := range p.reps {
+		if n := len(r.segments); n > 0 {
+			if e := p.at(r.segments[n-1].end()); e > end {
+				end = e
+			}
+		}
+	}
+	return end
+}
+
+/*
+manifest holds the periods of a stream within the time shift buffer.
+Like HLS playlists, it outlives its publisher for a while and continues
+with a new period when the stream is published again, keeping its
+availability start time.
+*/
+type manifest struct {
+	mu       sync.RWMutex
+	depth    time.Duration
+	start    time.Time
+	periods  []*period
+	nextID   int
+	ended    bool
+	endedAt  time.Duration
+	removal  *time.Timer
+	modified time.Time
+}
+
+func newManifest(depth time.Duration) *manifest {
+	return &manifest{depth: depth}
+}
+
+// addPeriod starts a period at timestamp offset with one
+// representation per init segment.
+func (m *manifest) addPeriod(offset uint32, reps ...*representation) *period {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if m.start.IsZero() {
+		m.start = now
+	}
+
+	p := &period{
+		id:     m.nextID,
+		start:  now.Sub(m.start).Truncate(time.Millisecond),
+		offset: offset,
+		reps:   reps,
+	}
+	if n := len(m.periods); n > 0 {
+		// Periods must not overlap, whatever the publisher's clock.
+		if end := m.periods[n-1].end(); p.start < end {
+			p.start = end
+		}
+	}
+	for _, r := range reps {
+		r.nextNumber = 1
+	}
+	m.nextID++
+	m.periods = append(m.periods, p)
+	m.modified = now
+	return p
+}
+
+// add appends a segment to representation r.
+func (m *manifest) add(r *representation, start, end uint32, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if end < start {
+		end = start
+	}
+	r.segments = append(r.segments, &segment{
+		number:   r.nextNumber,
+		start:    start,
+		duration: end - start,
+		data:     data,
+	})
+	r.nextNumber++
+	m.modified = time.Now()
+	m.trim()
+}
+
+/*
+trim drops the segments that left the time shift buffer some
+segments ago, and the periods left without segments. m.mu must be
+held.
+*/
+func (m *manifest) trim() {
+	if len(m.periods) == 0 {
+		return
+	}
+	edge := m.periods[len(m.periods)-1].end()
+
+	periods := m.periods[:0]
+	for i, p := range m.periods {
+		empty := true
+		for _, r := range p.reps {
+			n := 0
+			for n < len(r.segments)-segmentsKept && p.at(r.segments[n+segmentsKept].end()) < edge-m.depth {
+				n++
+			}
+			r.segments = r.segments[n:]
+			empty = empty && len(r.segments) == 0
+		}
+		if !empty || i == len(m.periods)-1 {
+			periods = append(periods, p)
+		}
+	}
+	for i := len(periods); i < len(m.periods); i++ {
+		m.periods[i] = nil
+	}
+	m.periods = periods
+}
+
+// restart prepares the manifest for a new publisher.
+func (m *manifest) restart() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.removal != nil {
+		m.removal.Stop()
+		m.removal = nil
+	}
+	m.ended = false
+}
+
+// end marks the presentation as over and calls remove after linger
+// unless the stream is published again meanwhile.
+func (m *manifest) end(linger time.Duration, remove func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ended = true
+	if n := len(m.periods); n > 0 {
+		m.endedAt = m.periods[n-1].end()
+	}
+	m.modified = time.Now()
+	m.removal = time.AfterFunc(linger, remove)
+}
+
+func (m *manifest) isEnded() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.ended
+}
+
+// init returns the init segment of representation rep of period id.
+func (m *manifest) init(id int, rep string) []byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if r := m.rep(id, rep); r != nil {
+		return r.init
+	}
+	return nil
+}
+
+func (m *manifest) segment(id int, rep string, number uint64) (*segment, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	r := m.rep(id, rep)
+	if r == nil {
+		return nil, false
+	}
+	for _, s := range r.segments {
+		if s.number == number {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// rep returns representation rep of period id. m.mu must be held.
+func (m *manifest) rep(id int, rep string) *representation {
+	for _, p := range m.periods {
+		if p.id == id {
+			return p.rep(rep)
+		}
+	}
+	return nil
+}
+
+/*
+mpd renders the manifest with segment URIs relative to it, or returns
+nil when there is no segment yet. Each period has an adaptation set
+per track and describes its segments with a SegmentTimeline in
+milliseconds:
+
+	<Period id="0" start="PT0S">
+	  <AdaptationSet contentType="video" ...>
+	    <SegmentTemplate timescale="1000" presentationTimeOffset="0"
+	      initialization="s/0/$RepresentationID$/init.mp4"
+	      media="s/0/$RepresentationID$/$Number$.m4s" startNumber="1">
+	      <SegmentTimeline>
+	        <S t="0" d="2000" r="3"/>
+	      </SegmentTimeline>
+	    </SegmentTemplate>
+	    <Representation id="video" codecs="avc1.64001f" .../>
+	  </AdaptationSet>
+	  ...
+	</Period>
+
+The manifest stays dynamic once the stream is unpublished, and gets a
+mediaPresentationDuration instead of a minimumUpdatePeriod.
+*/
+func (m *manifest) mpd(name string, segmentDuration time.Duration) []byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	edge := now.Sub(m.start)
+	if m.ended {
+		edge = m.endedAt
+	}
+
+	doc := mpdXML{
+		XMLNS:                      "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:                   "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:                       "dynamic",
+		AvailabilityStartTime:      formatTime(m.start),
+		PublishTime:                formatTime(m.modified),
+		MinBufferTime:              formatDuration(segmentDuration),
+		TimeShiftBufferDepth:       formatDuration(m.depth),
+		SuggestedPresentationDelay: formatDuration(3 * segmentDuration),
+		UTCTiming: utcTimingXML{
+			SchemeIDURI: "urn:mpeg:dash:utc:direct:2014",
+			Value:       formatTime(now),
+		},
+	}
+	if m.ended {
+		doc.MediaPresentationDuration = formatDuration(m.endedAt)
+	} else {
+		doc.MinimumUpdatePeriod = formatDuration(segmentDuration)
+	}
+
+	base := templateEscape(url.PathEscape(name))
+	for _, p := range m.periods {
+		px := periodXML{
+			ID:    strconv.Itoa(p.id),
+			Start: formatDuration(p.start),
+		}
+		for i, r := range p.reps {
+			var segs []*segment
+			for _, s := range r.segments {
+				if p.at(s.end()) >= edge-m.depth {
+					segs = append(segs, s)
+				}
+			}
+			if len(segs) == 0 {
+				continue
+			}
+			px.AdaptationSets = append(px.AdaptationSets, adaptationSet(i, base, p, r, segs))
+		}
+		if len(px.AdaptationSets) > 0 {
+			doc.Periods = append(doc.Periods, px)
+		}
+	}
+	if len(doc.Periods) == 0 {
+		return nil
+	}
+
+	b, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil
+	}
+	return append([]byte(xml.Header), append(b, '\n')...)
+}
+
+func adaptationSet(i int, base string, p *period, r *representation, segs []*segment) adaptationSetXML {
+	prefix := fmt.Sprintf("%s/%d/$RepresentationID$/", base, p.id)
+	tmpl := segmentTemplateXML{
+		Timescale:              1000,
+		PresentationTimeOffset: p.offset,
+		Initialization:         prefix + "init.mp4",
+		Media:                  prefix + "$Number$.m4s",
+		StartNumber:            segs[0].number,
+	}
+
+	// Runs of segments of equal duration are collapsed.
+	var bytes, duration uint64
+	for _, s := range segs {
+		bytes += uint64(len(s.data))
+		duration += uint64(s.duration)
+
+		n := len(tmpl.Timeline)
+		if n > 0 {
+			last := &tmpl.Timeline[n-1]
+			if last.D == s.duration && last.T+(last.R+1)*s.duration == s.start {
+				last.R++
+				continue
+			}
+		}
+		tmpl.Timeline = append(tmpl.Timeline, sXML{T: s.start, D: s.duration})
+	}
+
+	rep := representationXML{
+		ID:        r.id,
+		Codecs:    r.codecs,
+		Bandwidth: 1,
+	}
+	if duration > 0 {
+		rep.Bandwidth = bytes * 8 * 1000 / duration
+	}
+
+	as := adaptationSetXML{
+		ID:               i,
+		ContentType:      "video",
+		MimeType:         "video/mp4",
+		SegmentAlignment: true,
+		StartWithSAP:     1,
+		SegmentTemplate:  tmpl,
+	}
+	if r.id == videoRep {
+		rep.Width = r.width
+		rep.Height = r.height
+		rep.FrameRate = formatFrameRate(r.frameRate)
+	}
+	if r.id == audioRep {
+		as.ContentType = "audio"
+		as.MimeType = "audio/mp4"
+		rep.AudioSamplingRate = r.sampleRate
+		rep.AudioChannels = &descriptorXML{
+			SchemeIDURI: "urn:mpeg:dash:23003:3:audio_channel_configuration:2011",
+			Value:       strconv.Itoa(r.channels),
+		}
+	}
+	as.Representations = []representationXML{rep}
+	return as
+}
+
+// templateEscape escapes the dollar signs of s for use in a
+// SegmentTemplate.
+func templateEscape(s string) string {
+	return strings.ReplaceAll(s, "$", "$$")
+}
+
+// formatFrameRate formats a frame rate as a FrameRateType, or returns
+// "" when it is unknown.
+func formatFrameRate(fps float64) string {
+	if fps <= 0 {
+		return ""
+	}
+	if fps == math.Trunc(fps) {
+		return strconv.Itoa(int(fps))
+	}
+	return fmt.Sprintf("%d/1000", int(math.Round(fps*1000)))
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+// formatDuration formats d as an xs:duration in seconds.
+func formatDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
+
+type mpdXML struct {
+	XMLName                    xml.Name     `xml:"MPD"`
+	XMLNS                      string       `xml:"xmlns,attr"`
+	Profiles                   string       `xml:"profiles,attr"`
+	Type                       string       `xml:"type,attr"`
+	AvailabilityStartTime      string       `xml:"availabilityStartTime,attr"`
+	PublishTime                string       `xml:"publishTime,attr"`
+	MinimumUpdatePeriod        string       `xml:"minimumUpdatePeriod,attr,omitempty"`
+	MediaPresentationDuration  string       `xml:"mediaPresentationDuration,attr,omitempty"`
+	MinBufferTime              string       `xml:"minBufferTime,attr"`
+	TimeShiftBufferDepth       string       `xml:"timeShiftBufferDepth,attr"`
+	SuggestedPresentationDelay string       `xml:"suggestedPresentationDelay,attr"`
+	Periods                    []periodXML  `xml:"Period"`
+	UTCTiming                  utcTimingXML `xml:"UTCTiming"`
+}
+
+type periodXML struct {
+	ID             string             `xml:"id,attr"`
+	Start          string             `xml:"start,attr"`
+	AdaptationSets []adaptationSetXML `xml:"AdaptationSet"`
+}
+
+type adaptationSetXML struct {
+	ID               int                 `xml:"id,attr"`
+	ContentType      string              `xml:"contentType,attr"`
+	MimeType         string              `xml:"mimeType,attr"`
+	SegmentAlignment bool                `xml:"segmentAlignment,attr"`
+	StartWithSAP     int                 `xml:"startWithSAP,attr"`
+	SegmentTemplate  segmentTemplateXML  `xml:"SegmentTemplate"`
+	Representations  []representationXML `xml:"Representation"`
+}
+
+type segmentTemplateXML struct {
+	Timescale              int    `xml:"timescale,attr"`
+	PresentationTimeOffset uint32 `xml:"presentationTimeOffset,attr"`
+	Initialization         string `xml:"initialization,attr"`
+	Media                  string `xml:"media,attr"`
+	StartNumber            uint64 `xml:"startNumber,attr"`
+	Timeline               []sXML `xml:"SegmentTimeline>S"`
+}
+
+type sXML struct {
+	T uint32 `xml:"t,attr"`
+	D uint32 `xml:"d,attr"`
+	R uint32 `xml:"r,attr,omitempty"`
+}
+
+type representationXML struct {
+	ID                string         `xml:"id,attr"`
+	Codecs            string         `xml:"codecs,attr"`
+	Bandwidth         uint64         `xml:"bandwidth,attr"`
+	Width             int            `xml:"width,attr,omitempty"`
+	Height            int            `xml:"height,attr,omitempty"`
+	FrameRate         string         `xml:"frameRate,attr,omitempty"`
+	AudioSamplingRate int            `xml:"audioSamplingRate,attr,omitempty"`
+	AudioChannels     *descriptorXML `xml:"AudioChannelConfiguration"`
+}
+
+type descriptorXML struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+type utcTimingXML struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
@@ -0,0 +1,129 @@
+package dash
+
+import (
+	"encoding/xml"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// parseMPD parses a manifest rendered by mpd.
+func parseMPD(t *testing.T, b []byte) mpdXML {
+	t.Helper()
+	var doc mpdXML
+	if err := xml.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("parse manifest: %v\n%s", err, b)
+	}
+	return doc
+}
+
+func TestMPD(t *testing.T) {
+	m := newManifest(10 * time.Second)
+	if b := m.mpd("test", 2*time.Second); b != nil {
+		t.Errorf("manifest without segments =\n%s", b)
+	}
+
+	video := &representation{id: videoRep, codecs: "avc1.64001f", width: 1280, height: 720, frameRate: 30}
+	audio := &representation{id: audioRep, codecs: "mp4a.40.2", sampleRate: 48000, channels: 2}
+	m.addPeriod(1000, video, audio)
+	for ts := uint32(1000); ts < 9000; ts += 2000 {
+		m.add(video, ts, ts+2000, make([]byte, 250))
+	}
+	m.add(video, 9000, 10000, make([]byte, 125))
+	m.add(audio, 1000, 3000, make([]byte, 100))
+	m.add(audio, 3000, 5000, make([]byte, 100))
+
+	doc := parseMPD(t, m.mpd("test$1", 2*time.Second))
+	if doc.Type != "dynamic" || doc.MinimumUpdatePeriod != "PT2.000S" || doc.MediaPresentationDuration != "" {
+		t.Errorf("live manifest type, minimumUpdatePeriod, mediaPresentationDuration = %q, %q, %q",
+			doc.Type, doc.MinimumUpdatePeriod, doc.MediaPresentationDuration)
+	}
+	if doc.TimeShiftBufferDepth != "PT10.000S" || doc.SuggestedPresentationDelay != "PT6.000S" {
+		t.Errorf("timeShiftBufferDepth, suggestedPresentationDelay = %q, %q",
+			doc.TimeShiftBufferDepth, doc.SuggestedPresentationDelay)
+	}
+	if len(doc.Periods) != 1 || doc.Periods[0].ID != "0" || doc.Periods[0].Start != "PT0.000S" {
+		t.Fatalf("periods = %+v, want period 0 at PT0.000S", doc.Periods)
+	}
+
+	sets := doc.Periods[0].AdaptationSets
+	if len(sets) != 2 {
+		t.Fatalf("%d adaptation sets, want 2", len(sets))
+	}
+	wantTmpl := segmentTemplateXML{
+		Timescale:              1000,
+		PresentationTimeOffset: 1000,
+		Initialization:         "test$$1/0/$RepresentationID$/init.mp4",
+		Media:                  "test$$1/0/$RepresentationID$/$Number$.m4s",
+		StartNumber:            1,
+		// equal durations are collapsed into one S with a repeat count
+		Timeline: []sXML{{T: 1000, D: 2000, R: 3}, {T: 9000, D: 1000}},
+	}
+	if v := sets[0]; v.ContentType != "video" || !reflect.DeepEqual(v.SegmentTemplate, wantTmpl) {
+		t.Errorf("video adaptation set %+v, want template %+v", v, wantTmpl)
+	}
+	wantVideo := representationXML{ID: "video", Codecs: "avc1.64001f", Bandwidth: 1000, Width: 1280, Height: 720, FrameRate: "30"}
+	if got := sets[0].Representations; len(got) != 1 || !reflect.DeepEqual(got[0], wantVideo) {
+		t.Errorf("video representations %+v, want %+v", got, wantVideo)
+	}
+
+	wantTmpl.Timeline = []sXML{{T: 1000, D: 2000, R: 1}}
+	if a := sets[1]; a.ContentType != "audio" || a.MimeType != "audio/mp4" || !reflect.DeepEqual(a.SegmentTemplate, wantTmpl) {
+		t.Errorf("audio adaptation set %+v, want template %+v", a, wantTmpl)
+	}
+	wantAudio := representationXML{
+		ID:                "audio",
+		Codecs:            "mp4a.40.2",
+		Bandwidth:         400,
+		AudioSamplingRate: 48000,
+		AudioChannels: &descriptorXML{
+			SchemeIDURI: "urn:mpeg:dash:23003:3:audio_channel_configuration:2011",
+			Value:       "2",
+		},
+	}
+	if got := sets[1].Representations; len(got) != 1 || !reflect.DeepEqual(got[0], wantAudio) {
+		t.Errorf("audio representations %+v, want %+v", got, wantAudio)
+	}
+
+	m.end(time.Hour, func() {})
+	doc = parseMPD(t, m.mpd("test", 2*time.Second))
+	if doc.MinimumUpdatePeriod != "" || doc.MediaPresentationDuration != "PT9.000S" {
+		t.Errorf("ended manifest minimumUpdatePeriod, mediaPresentationDuration = %q, %q",
+			doc.MinimumUpdatePeriod, doc.MediaPresentationDuration)
+	}
+}
+
+func TestManifestTimeShift(t *testing.T) {
+	m := newManifest(4 * time.Second)
+	video := &representation{id: videoRep}
+	m.addPeriod(0, video)
+	for ts := uint32(0); ts < 12000; ts += 2000 {
+		m.add(video, ts, ts+2000, []byte{byte(ts / 2000)})
+	}
+	m.end(time.Hour, func() {})
+
+	// segments are kept a little after leaving the time shift buffer
+	for n := uint64(1); n <= 6; n++ {
+		if _, ok := m.segment(0, videoRep, n); ok != (n >= 2) {
+			t.Errorf("segment %d available = %v", n, ok)
+		}
+	}
+
+	doc := parseMPD(t, m.mpd("test", 2*time.Second))
+	tmpl := doc.Periods[0].AdaptationSets[0].SegmentTemplate
+	if tmpl.StartNumber != 4 || !reflect.DeepEqual(tmpl.Timeline, []sXML{{T: 6000, D: 2000, R: 2}}) {
+		t.Errorf("startNumber %d, timeline %+v, want the segments from 4 at 6000", tmpl.StartNumber, tmpl.Timeline)
+	}
+
+	// a new period starts after the previous one, even when published
+	// again right away
+	m.restart()
+	next := &representation{id: videoRep}
+	p := m.addPeriod(500, next)
+	if p.id != 1 || p.start != 12*time.Second {
+		t.Errorf("new period %d at %v, want 1 at 12s", p.id, p.start)
+	}
+	if next.nextNumber != 1 || m.isEnded() {
+		t.Errorf("new period numbers from %d, ended %v", next.nextNumber, m.isEnded())
+	}
+}
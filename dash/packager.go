@@ -0,0 +1,292 @@
+package dash
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"rtmp-example/internal/aac"
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/fmp4"
+	"rtmp-example/internal/h264"
+	"rtmp-example/internal/mediaseg"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+packager feeds the packets of one publishing session to the manifest
+of a stream. Video and audio are muxed into separate fMP4
+representations, as DASH players expect, whose segments are cut at the
+same timestamps.
+
+Segments start at a keyframe and are cut at the first keyframe once
+the segment duration is reached; streams without video are cut on any
+audio frame. The other track follows the cut with its first frame at
+or after the keyframe. Packets before the first keyframe are dropped.
+
+A sequence header changing the codec parameters or the picture size
+ends the period in progress, and the next keyframe starts a new one
+with new init segments and representations.
+*/
+type packager struct {
+	info     av.Info
+	m        *manifest
+	duration time.Duration
+	done     func()
+
+	video  *track
+	audio  *track
+	period *period
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// track is the packaging state of one representation.
+type track struct {
+	key     string
+	m       *manifest
+	muxer   *fmp4.Muxer
+	version int
+	rep     *representation
+	desc    representation
+
+	buf     *bytes.Buffer
+	start   uint32
+	cut     uint32
+	cutting bool
+	last    uint32
+	prev    uint32
+	delta   uint32
+	seen    bool
+	skipped bool
+}
+
+func newPackager(info av.Info, m *manifest, duration time.Duration, done func()) *packager {
+	return &packager{
+		info: av.Info{
+			Key: info.Key,
+			URL: info.URL,
+			UID: av.NewUID(),
+		},
+		m:        m,
+		duration: duration,
+		done:     done,
+		video:    newTrack(info.Key, m, videoRep),
+		audio:    newTrack(info.Key, m, audioRep),
+	}
+}
+
+func newTrack(key string, m *manifest, id string) *track {
+	return &track{
+		key:   key,
+		m:     m,
+		muxer: fmp4.NewMuxer(),
+		desc:  representation{id: id},
+	}
+}
+
+func (pk *packager) Write(p *av.Packet) error {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	if pk.closed {
+		return os.ErrClosed
+	}
+
+	var t *track
+	switch {
+	case p.IsVideo:
+		t = pk.video
+	case p.IsAudio:
+		t = pk.audio
+	default:
+		return nil
+	}
+
+	if mediaseg.IsSeqHeader(p) {
+		width, height := t.desc.width, t.desc.height
+		if t.mux(p) {
+			t.describe(p)
+		}
+		resized := width != 0 && (t.desc.width != width || t.desc.height != height)
+		if (resized || t.muxer.Version() != t.version) && pk.period != nil {
+			pk.endPeriod()
+		}
+		return nil
+	}
+
+	hasVideo := pk.video.muxer.HasVideo()
+	switch {
+	case pk.period == nil:
+		if mediaseg.StartsSegment(p, hasVideo) {
+			pk.beginPeriod(p.TimeStamp)
+		}
+	case mediaseg.StartsSegment(p, hasVideo) && mediaseg.Span(t.start, p.TimeStamp) >= pk.duration:
+		pk.video.cutAt(p.TimeStamp)
+		pk.audio.cutAt(p.TimeStamp)
+	}
+
+	t.write(p)
+	return nil
+}
+
+func (pk *packager) Info() av.Info {
+	return pk.info
+}
+
+func (pk *packager) Alive() bool {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	return !pk.closed
+}
+
+func (pk *packager) CalcBaseTimestamp() {}
+
+// Close ends the last segments and the manifest.
+func (pk *packager) Close(err error) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	if pk.closed {
+		return
+	}
+	pk.closed = true
+
+	if pk.period != nil {
+		pk.endPeriod()
+	}
+	pk.done()
+}
+
+// beginPeriod starts a period at timestamp ts with the tracks whose
+// sequence header has been seen.
+func (pk *packager) beginPeriod(ts uint32) {
+	var reps []*representation
+	for _, t := range []*track{pk.video, pk.audio} {
+		if t.muxer.Version() == 0 {
+			continue
+		}
+
+		var b bytes.Buffer
+		if err := t.muxer.WriteInit(&b); err != nil {
+			log.Warnf("dash %s: mux: %v", t.key, err)
+			continue
+		}
+		rep := t.desc
+		rep.init = b.Bytes()
+		t.rep = &rep
+		t.version = t.muxer.Version()
+		t.cutAt(ts)
+		reps = append(reps, t.rep)
+	}
+	pk.period = pk.m.addPeriod(ts, reps...)
+}
+
+// endPeriod completes the segments in progress.
+func (pk *packager) endPeriod() {
+	pk.video.close()
+	pk.audio.close()
+	pk.period = nil
+}
+
+// cutAt makes the first frame at or after ts start a new segment.
+func (t *track) cutAt(ts uint32) {
+	if t.rep == nil {
+		return
+	}
+	t.cut = ts
+	t.cutting = true
+}
+
+/*
+write muxes p. The muxer writes a sample when the next one of its track
+arrives, so the segment in progress receives the frame before p, and p
+goes to the segment it starts, if any.
+*/
+func (t *track) write(p *av.Packet) {
+	if t.seen && p.TimeStamp > t.prev {
+		t.delta = p.TimeStamp - t.prev
+	}
+	t.prev = p.TimeStamp
+	t.seen = true
+
+	t.mux(p)
+	if t.cutting && p.TimeStamp >= t.cut {
+		if t.buf != nil {
+			t.m.add(t.rep, t.start, p.TimeStamp, t.buf.Bytes())
+		}
+		t.buf = &bytes.Buffer{}
+		t.start = p.TimeStamp
+		t.cutting = false
+	}
+	t.last = p.TimeStamp
+}
+
+// close flushes the muxer and completes the segment in progress.
+func (t *track) close() {
+	if t.buf != nil {
+		if err := t.muxer.Flush(t.buf); err != nil {
+			log.Warnf("dash %s: mux: %v", t.key, err)
+		}
+		t.m.add(t.rep, t.start, t.last+t.delta, t.buf.Bytes())
+	}
+	t.buf = nil
+	t.rep = nil
+	t.cutting = false
+}
+
+// mux writes the sample p completes to the segment in progress, if
+// any, and reports whether p was accepted.
+func (t *track) mux(p *av.Packet) bool {
+	var w io.Writer = io.Discard
+	if t.buf != nil {
+		w = t.buf
+	}
+
+	err := t.muxer.Mux(p, w)
+	if err == fmp4.ErrUnsupportedCodec {
+		if !t.skipped {
+			t.skipped = true
+			log.Warnf("dash %s: skipping packets of unsupported codec", t.key)
+		}
+		return false
+	}
+	if err != nil {
+		log.Warnf("dash %s: mux: %v", t.key, err)
+		return false
+	}
+	return true
+}
+
+// describe records the codec parameters of sequence header p.
+func (t *track) describe(p *av.Packet) {
+	if p.IsVideo {
+		c, err := h264.ParseDecoderConfig(p.Data[5:])
+		if err != nil {
+			return
+		}
+		t.desc.codecs = c.Codec()
+		if sps, err := c.SPSInfo(); err == nil {
+			t.desc.width = sps.Width
+			t.desc.height = sps.Height
+			t.desc.frameRate = sps.FrameRate
+		}
+		return
+	}
+
+	c, err := aac.ParseConfig(p.Data[2:])
+	if err != nil {
+		return
+	}
+	t.desc.codecs = c.Codec()
+	t.desc.sampleRate, _ = c.SampleRate()
+	t.desc.channels = c.Channels()
+	if t.desc.channels == 0 {
+		t.desc.channels = 2
+	}
+}
@@ -0,0 +1,245 @@
+package dash
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/httpd"
+	"rtmp-example/rtmp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSegmentDuration      = 2 * time.Second
+	defaultTimeShiftBufferDepth = 30 * time.Second
+	defaultShutdownTimeout      = 10 * time.Second
+)
+
+var errNoHub = errors.New("dash: server has no stream hub")
+
+/*
+Server packages every stream published to a StreamHub into fragmented
+MP4 segments and serves them as live MPEG-DASH:
+
+	GET /{app}/{stream}.mpd                          dynamic manifest
+	GET /{app}/{stream}/{period}/{rep}/init.mp4      init segment
+	GET /{app}/{stream}/{period}/{rep}/{number}.m4s  media segment
+
+where rep is video or audio. The availability start time of a
+manifest is the time its stream was first published; each publishing
+session adds a period. The manifest sends the server time with a
+UTCTiming element so that players need not trust their own clock.
+
+Segments are kept in memory for the time shift buffer depth. Once a
+stream is unpublished its manifest gets a duration and is dropped
+after the buffer has played out, unless the stream is published again
+in the meantime.
+
+Serve registers the server on the hub, so only streams published
+afterwards are packaged. Server is also an http.Handler.
+*/
+type Server struct {
+	Host string
+	Port int
+
+	// Hub is the hub the RTMP server publishes to. It is required.
+	Hub *rtmp.StreamHub
+
+	// SegmentDuration is the duration segments are cut at, on the next
+	// keyframe. Zero means 2 seconds.
+	SegmentDuration time.Duration
+
+	// TimeShiftBufferDepth is how far behind the live edge segments
+	// remain available. Zero means 30 seconds.
+	TimeShiftBufferDepth time.Duration
+
+	// AllowOrigin is sent as Access-Control-Allow-Origin. Empty means "*".
+	AllowOrigin string
+
+	// ShutdownTimeout bounds the draining done by ListenAndServe when
+	// its context is cancelled. Zero means 10 seconds.
+	ShutdownTimeout time.Duration
+
+	mu        sync.Mutex
+	closing   bool
+	httpd     httpd.Server
+	manifests map[string]*manifest
+}
+
+// ListenAndServe listens on Host:Port and serves requests until ctx is
+// cancelled or Shutdown is called. It always returns a non-nil error,
+// http.ErrServerClosed after a shutdown.
+func (srv *Server) ListenAndServe(ctx context.Context) error {
+	listen, err := httpd.Listen(srv.Host, srv.Port)
+	if err != nil {
+		return err
+	}
+
+	return srv.Serve(ctx, listen)
+}
+
+// Serve serves requests on listen, see ListenAndServe.
+func (srv *Server) Serve(ctx context.Context, listen net.Listener) error {
+	if srv.Hub == nil {
+		listen.Close()
+		return errNoHub
+	}
+
+	hs, err := srv.httpd.Start(srv)
+	if err != nil {
+		listen.Close()
+		return err
+	}
+
+	srv.Hub.AddGetWriter(srv)
+	log.Infof("DASH listening on %s", listen.Addr())
+	return httpd.Run(ctx, hs, listen, srv.Shutdown, srv.ShutdownTimeout)
+}
+
+// Shutdown stops packaging new streams and shuts the HTTP server
+// down, see http.Server.Shutdown.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.closing = true
+	srv.mu.Unlock()
+
+	return srv.httpd.Shutdown(ctx)
+}
+
+// GetWriter implements av.GetWriter and returns the packager of a
+// newly published stream.
+func (srv *Server) GetWriter(info av.Info) av.WriteCloser {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.closing {
+		return nil
+	}
+	if srv.manifests == nil {
+		srv.manifests = make(map[string]*manifest)
+	}
+
+	m, ok := srv.manifests[info.Key]
+	if ok {
+		m.restart()
+	} else {
+		m = newManifest(srv.timeShiftBufferDepth())
+		srv.manifests[info.Key] = m
+	}
+
+	done := func() {
+		m.end(srv.timeShiftBufferDepth(), func() {
+			srv.remove(info.Key, m)
+		})
+	}
+	return newPackager(info, m, srv.segmentDuration(), done)
+}
+
+func (srv *Server) remove(key string, m *manifest) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if cur, ok := srv.manifests[key]; ok && cur == m && m.isEnded() {
+		delete(srv.manifests, key)
+	}
+}
+
+func (srv *Server) manifest(key string) (*manifest, bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	m, ok := srv.manifests[key]
+	return m, ok
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !httpd.Accept(w, r, srv.AllowOrigin) {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if key, ok := strings.CutSuffix(path, ".mpd"); ok && httpd.ValidKey(key) {
+		srv.serveManifest(w, r, key)
+		return
+	}
+
+	// {app}/{stream}/{period}/{rep}/{file}
+	parts := strings.Split(path, "/")
+	if len(parts) != 5 {
+		http.NotFound(w, r)
+		return
+	}
+	m, ok := srv.manifest(parts[0] + "/" + parts[1])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.Atoi(parts[2])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	rep, file := parts[3], parts[4]
+	contentType := "video/mp4"
+	if rep == audioRep {
+		contentType = "audio/mp4"
+	}
+
+	if file == "init.mp4" {
+		httpd.ServeData(w, r, contentType, m.init(id, rep))
+		return
+	}
+	number, err := strconv.ParseUint(strings.TrimSuffix(file, ".m4s"), 10, 64)
+	if err != nil || !strings.HasSuffix(file, ".m4s") {
+		http.NotFound(w, r)
+		return
+	}
+	seg, ok := m.segment(id, rep, number)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "max-age=60")
+	httpd.ServeData(w, r, "video/iso.segment", seg.data)
+}
+
+func (srv *Server) serveManifest(w http.ResponseWriter, r *http.Request, key string) {
+	m, ok := srv.manifest(key)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	_, name, _ := strings.Cut(key, "/")
+	body := m.mpd(name, srv.segmentDuration())
+	if body == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	httpd.ServeData(w, r, "application/dash+xml", body)
+}
+
+func (srv *Server) segmentDuration() time.Duration {
+	if srv.SegmentDuration <= 0 {
+		return defaultSegmentDuration
+	}
+	return srv.SegmentDuration
+}
+
+func (srv *Server) timeShiftBufferDepth() time.Duration {
+	if srv.TimeShiftBufferDepth <= 0 {
+		return defaultTimeShiftBufferDepth
+	}
+	return srv.TimeShiftBufferDepth
+}
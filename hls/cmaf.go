@@ -0,0 +1,194 @@
+package hls
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/fmp4"
+	"rtmp-example/internal/mediaseg"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+cmafOutput muxes a stream into fMP4 parts for low-latency HLS.
+
+Segments are cut like TS ones. Within a segment a part is closed as
+soon as the next frame would take it past the part target, so parts
+never run longer than the target with a steady frame rate. A part
+starting with a keyframe is independent.
+
+The muxer writes a sample when the next one of its track arrives, so
+the pending samples of every track are flushed into a part before it
+is closed, and the part boundary falls on the packet that cut it.
+
+New codec parameters end the segment in progress, and a new picture
+size also makes the next one discontinuous.
+*/
+type cmafOutput struct {
+	key        string
+	pl         *playlist
+	target     time.Duration
+	partTarget time.Duration
+
+	muxer   *fmp4.Muxer
+	version int
+	buf     *bytes.Buffer
+	start   uint32
+	partAt  uint32
+	indep   bool
+	last    uint32
+	deltas  map[bool]uint32
+	prev    map[bool]uint32
+	pic     picture
+	skipped bool
+}
+
+func newCMAFOutput(key string, pl *playlist, target, partTarget time.Duration) *cmafOutput {
+	return &cmafOutput{
+		key:        key,
+		pl:         pl,
+		target:     target,
+		partTarget: partTarget,
+		muxer:      fmp4.NewMuxer(),
+		deltas:     make(map[bool]uint32),
+		prev:       make(map[bool]uint32),
+	}
+}
+
+func (out *cmafOutput) write(p *av.Packet) {
+	if mediaseg.IsSeqHeader(p) {
+		resized := out.pic.resized(p)
+		out.mux(p)
+		if (resized || out.muxer.Version() != out.version) && out.buf != nil {
+			// New codec parameters start a new segment.
+			out.flush()
+			out.closePart(out.last)
+			out.closeSegment(out.last)
+			out.buf = nil
+			if resized {
+				// Players reset their decoder on a discontinuity.
+				out.pl.discontinue()
+			}
+		}
+		return
+	}
+
+	hasVideo := out.muxer.HasVideo()
+	if out.buf == nil {
+		if !mediaseg.StartsSegment(p, hasVideo) {
+			return
+		}
+		out.setInit()
+		out.buf = &bytes.Buffer{}
+		out.start = p.TimeStamp
+		out.partAt = p.TimeStamp
+		out.indep = true
+		out.track(p)
+		out.mux(p)
+		return
+	}
+
+	out.track(p)
+
+	// Parts are cut on the track driving segments.
+	if hasVideo != p.IsVideo {
+		out.mux(p)
+		return
+	}
+
+	newSegment := mediaseg.StartsSegment(p, hasVideo) && mediaseg.Span(out.start, p.TimeStamp) >= out.target
+	if newSegment || mediaseg.Span(out.partAt, p.TimeStamp+out.deltas[p.IsVideo]) > out.partTarget {
+		// Nothing pending may leak into the next part, which may be
+		// independent.
+		out.flush()
+		out.closePart(p.TimeStamp)
+		if newSegment {
+			out.closeSegment(p.TimeStamp)
+		}
+		out.indep = mediaseg.StartsSegment(p, hasVideo)
+	}
+	out.mux(p)
+}
+
+// track records the frame interval of p's track.
+func (out *cmafOutput) track(p *av.Packet) {
+	if prev, ok := out.prev[p.IsVideo]; ok && p.TimeStamp > prev {
+		out.deltas[p.IsVideo] = p.TimeStamp - prev
+	}
+	out.prev[p.IsVideo] = p.TimeStamp
+	out.last = p.TimeStamp
+}
+
+func (out *cmafOutput) mux(p *av.Packet) {
+	var w io.Writer = io.Discard
+	if out.buf != nil {
+		w = out.buf
+	}
+
+	err := out.muxer.Mux(p, w)
+	if err == fmp4.ErrUnsupportedCodec {
+		if !out.skipped {
+			out.skipped = true
+			log.Warnf("hls %s: skipping packets of unsupported codec", out.key)
+		}
+		return
+	}
+	if err != nil {
+		log.Warnf("hls %s: mux: %v", out.key, err)
+	}
+}
+
+// flush writes the pending samples to the part in progress.
+func (out *cmafOutput) flush() {
+	if err := out.muxer.Flush(out.buf); err != nil {
+		log.Warnf("hls %s: mux: %v", out.key, err)
+	}
+}
+
+func (out *cmafOutput) setInit() {
+	if out.version == out.muxer.Version() && out.pl.initSegment() != nil {
+		return
+	}
+
+	var b bytes.Buffer
+	if err := out.muxer.WriteInit(&b); err != nil {
+		log.Warnf("hls %s: mux: %v", out.key, err)
+		return
+	}
+	out.version = out.muxer.Version()
+	out.pl.setInit(b.Bytes())
+}
+
+func (out *cmafOutput) closePart(end uint32) {
+	if out.buf.Len() == 0 {
+		return
+	}
+
+	out.pl.addPart(&part{
+		duration:    mediaseg.Span(out.partAt, end),
+		independent: out.indep,
+		data:        out.buf.Bytes(),
+	})
+	out.buf = &bytes.Buffer{}
+	out.partAt = end
+}
+
+func (out *cmafOutput) closeSegment(end uint32) {
+	out.pl.add(mediaseg.Span(out.start, end), nil)
+	out.start = end
+}
+
+func (out *cmafOutput) close() {
+	if out.buf == nil {
+		return
+	}
+
+	out.flush()
+	end := out.last + out.deltas[out.muxer.HasVideo()]
+	out.closePart(end)
+	out.closeSegment(end)
+	out.buf = nil
+}
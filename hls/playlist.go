@@ -0,0 +1,411 @@
+package hls
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// segmentsKept is how many segments older than the window are kept for
+// clients that loaded the playlist just before it slid.
+const segmentsKept = 2
+
+// partSegments is how many of the last segments list their parts in
+// low-latency playlists.
+const partSegments = 3
+
+type segment struct {
+	seq           uint64
+	duration      time.Duration
+	discontinuity bool
+	init          int
+	data          []byte
+	parts         []*part
+}
+
+type part struct {
+	duration    time.Duration
+	independent bool
+	data        []byte
+}
+
+/*
+playlist is the sliding window of the most recent segments of a
+stream. It outlives its publisher for a while so that viewers can play
+out the last segments, and continues with a discontinuity when the
+stream is published again.
+
+For low-latency output, segments are made of parts which are listed as
+soon as they are complete, and readers may wait for a given part with
+wait. Every init segment gets a new version, and the init segments of
+the segments still kept remain available.
+*/
+type playlist struct {
+	mu            sync.RWMutex
+	window        int
+	segments      []*segment
+	nextSeq       uint64
+	partial       []*part
+	inits         map[int][]byte
+	initVersion   int
+	discontinuity bool
+	ended         bool
+	removal       *time.Timer
+	updated       chan struct{}
+}
+
+func newPlaylist(window int) *playlist {
+	return &playlist{
+		window:  window,
+		inits:   make(map[int][]byte),
+		updated: make(chan struct{}),
+	}
+}
+
+// notify wakes up waiters. pl.mu must be held.
+func (pl *playlist) notify() {
+	close(pl.updated)
+	pl.updated = make(chan struct{})
+}
+
+// add completes the segment in progress. For low-latency output, the
+// segment is made of the parts added since the previous one and data
+// is nil.
+func (pl *playlist) add(duration time.Duration, data []byte) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	parts := pl.partial
+	if data == nil {
+		if len(parts) == 0 {
+			return
+		}
+		var b bytes.Buffer
+		for _, p := range parts {
+			b.Write(p.data)
+		}
+		data = b.Bytes()
+	}
+
+	pl.segments = append(pl.segments, &segment{
+		seq:           pl.nextSeq,
+		duration:      duration,
+		discontinuity: pl.discontinuity,
+		init:          pl.initVersion,
+		data:          data,
+		parts:         parts,
+	})
+	pl.nextSeq++
+	pl.partial = nil
+	pl.discontinuity = false
+
+	if n := len(pl.segments) - pl.window - segmentsKept; n > 0 {
+		for i := 0; i < n; i++ {
+			pl.segments[i] = nil
+		}
+		pl.segments = pl.segments[n:]
+	}
+	for v := range pl.inits {
+		if v < pl.segments[0].init {
+			delete(pl.inits, v)
+		}
+	}
+	pl.notify()
+}
+
+// addPart adds a part to the segment in progress.
+func (pl *playlist) addPart(p *part) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	pl.partial = append(pl.partial, p)
+	pl.notify()
+}
+
+// setInit sets the init segment of the segment in progress and those
+// following it. Segments following a change are discontinuous.
+func (pl *playlist) setInit(b []byte) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	cur, ok := pl.inits[pl.initVersion]
+	if ok && bytes.Equal(cur, b) {
+		return
+	}
+	if ok {
+		pl.discontinuity = true
+	}
+	pl.initVersion++
+	pl.inits[pl.initVersion] = b
+}
+
+// initSegment returns the current init segment.
+func (pl *playlist) initSegment() []byte {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+
+	return pl.inits[pl.initVersion]
+}
+
+// initSegmentVersion returns version v of the init segment, or nil
+// when no kept segment uses it.
+func (pl *playlist) initSegmentVersion(v int) []byte {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+
+	return pl.inits[v]
+}
+
+// discontinue marks the next segment as discontinuous, such as after
+// a resolution change.
+func (pl *playlist) discontinue() {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	pl.discontinuity = true
+}
+
+// restart prepares the playlist for a new publisher.
+func (pl *playlist) restart() {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	if pl.removal != nil {
+		pl.removal.Stop()
+		pl.removal = nil
+	}
+	pl.ended = false
+	pl.discontinuity = len(pl.segments) > 0
+}
+
+// end marks the stream as over and calls remove after linger unless
+// the stream is published again meanwhile.
+func (pl *playlist) end(linger time.Duration, remove func()) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	pl.ended = true
+	pl.partial = nil
+	pl.removal = time.AfterFunc(linger, remove)
+	pl.notify()
+}
+
+func (pl *playlist) isEnded() bool {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+
+	return pl.ended
+}
+
+func (pl *playlist) segment(seq uint64) (*segment, bool) {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+
+	for _, s := range pl.segments {
+		if s.seq == seq {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// part returns part i of segment seq, which may still be in progress.
+func (pl *playlist) part(seq uint64, i int) (*part, bool) {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+
+	parts := pl.partial
+	if seq != pl.nextSeq {
+		parts = nil
+		for _, s := range pl.segments {
+			if s.seq == seq {
+				parts = s.parts
+			}
+		}
+	}
+
+	if i < 0 || i >= len(parts) {
+		return nil, false
+	}
+	return parts[i], true
+}
+
+// lastSeq returns the sequence number of the segment in progress.
+func (pl *playlist) lastSeq() uint64 {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+
+	return pl.nextSeq
+}
+
+// wait blocks until part i of segment seq is available; i < 0 waits
+// for the whole segment. It returns false when ctx is done or the
+// stream ended first.
+func (pl *playlist) wait(ctx context.Context, seq uint64, i int) bool {
+	for {
+		pl.mu.RLock()
+		ok := seq < pl.nextSeq || (seq == pl.nextSeq && i >= 0 && i < len(pl.partial))
+		ended := pl.ended
+		updated := pl.updated
+		pl.mu.RUnlock()
+
+		if ok {
+			return true
+		}
+		if ended {
+			return false
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// m3u8 renders the playlist with segment URIs relative to it, or
+// returns nil when there is no segment yet.
+func (pl *playlist) m3u8(name string) []byte {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+
+	segs := pl.visible()
+	if len(segs) == 0 {
+		return nil
+	}
+
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", targetDuration(segs))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segs[0].seq)
+	for _, s := range segs {
+		if s.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n", s.duration.Seconds())
+		fmt.Fprintf(&b, "%s/%d.ts\n", name, s.seq)
+	}
+	if pl.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.Bytes()
+}
+
+/*
+llm3u8 renders the low-latency playlist, or returns nil when there is
+no segment yet. The parts of the last segments and of the segment in
+progress are listed, followed by a hint for the next part. EXT-X-MAP
+is repeated wherever the init segment changes:
+
+	#EXT-X-MAP:URI="init-1.mp4"
+	...
+	#EXT-X-PART:DURATION=0.500,URI="12.0.m4s",INDEPENDENT=YES
+	...
+	#EXTINF:4.000,
+	12.m4s
+	#EXT-X-PART:DURATION=0.500,URI="13.0.m4s",INDEPENDENT=YES
+	#EXT-X-PRELOAD-HINT:TYPE=PART,URI="13.1.m4s"
+*/
+func (pl *playlist) llm3u8(partTarget time.Duration) []byte {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+
+	segs := pl.visible()
+	if len(segs) == 0 || len(pl.inits) == 0 {
+		return nil
+	}
+
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", targetDuration(segs))
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget.Seconds())
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget.Seconds())
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segs[0].seq)
+
+	mapped := 0
+	for i, s := range segs {
+		if s.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if s.init != mapped {
+			mapped = s.init
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init-%d.mp4\"\n", mapped)
+		}
+		if i >= len(segs)-partSegments {
+			writeParts(&b, s.seq, s.parts)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n", s.duration.Seconds())
+		fmt.Fprintf(&b, "%d.m4s\n", s.seq)
+	}
+
+	if pl.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+		return b.Bytes()
+	}
+
+	if len(pl.partial) > 0 {
+		if pl.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if pl.initVersion != mapped {
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init-%d.mp4\"\n", pl.initVersion)
+		}
+	}
+	writeParts(&b, pl.nextSeq, pl.partial)
+	fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%d.%d.m4s\"\n", pl.nextSeq, len(pl.partial))
+	return b.Bytes()
+}
+
+func writeParts(b *bytes.Buffer, seq uint64, parts []*part) {
+	for i, p := range parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.3f,URI=\"%d.%d.m4s\"", p.duration.Seconds(), seq, i)
+		if p.independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
+		b.WriteString("\n")
+	}
+}
+
+// visible returns the segments listed in the playlist. pl.mu must be
+// held.
+func (pl *playlist) visible() []*segment {
+	segs := pl.segments
+	if len(segs) > pl.window {
+		segs = segs[len(segs)-pl.window:]
+	}
+	return segs
+}
+
+// bandwidth returns the peak bit rate of the listed segments, or 0
+// when there is none.
+func (pl *playlist) bandwidth() int {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+
+	var peak int
+	for _, s := range pl.visible() {
+		if s.duration <= 0 {
+			continue
+		}
+		if bps := int(float64(len(s.data)*8) / s.duration.Seconds()); bps > peak {
+			peak = bps
+		}
+	}
+	return peak
+}
+
+func targetDuration(segs []*segment) int {
+	var target time.Duration
+	for _, s := range segs {
+		if s.duration > target {
+			target = s.duration
+		}
+	}
+	return int(math.Ceil(target.Seconds()))
+}
@@ -0,0 +1,158 @@
+package hls
+
+import (
+	"testing"
+	"time"
+)
+
+// testPlaylist returns a low-latency playlist of five 2s segments made
+// of two 1s parts, showing the last four.
+func testPlaylist() *playlist {
+	pl := newPlaylist(4)
+	pl.setInit([]byte("init 1"))
+	for i := 0; i < 5; i++ {
+		pl.addPart(&part{duration: time.Second, independent: true, data: []byte{byte(i), 0}})
+		pl.addPart(&part{duration: time.Second, data: []byte{byte(i), 1}})
+		pl.add(2*time.Second, nil)
+	}
+	return pl
+}
+
+func TestLLM3U8(t *testing.T) {
+	const head = `#EXTM3U
+#EXT-X-VERSION:9
+#EXT-X-TARGETDURATION:2
+#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=3.000
+#EXT-X-PART-INF:PART-TARGET=1.000
+#EXT-X-MEDIA-SEQUENCE:1
+#EXT-X-MAP:URI="init-1.mp4"
+#EXTINF:2.000,
+1.m4s
+#EXT-X-PART:DURATION=1.000,URI="2.0.m4s",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="2.1.m4s"
+#EXTINF:2.000,
+2.m4s
+#EXT-X-PART:DURATION=1.000,URI="3.0.m4s",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="3.1.m4s"
+#EXTINF:2.000,
+3.m4s
+#EXT-X-PART:DURATION=1.000,URI="4.0.m4s",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="4.1.m4s"
+#EXTINF:2.000,
+4.m4s
+`
+
+	tests := []struct {
+		name   string
+		update func(pl *playlist)
+		want   string
+	}{
+		{
+			name: "between segments",
+			want: head + `#EXT-X-PRELOAD-HINT:TYPE=PART,URI="5.0.m4s"
+`,
+		},
+		{
+			name: "part in progress",
+			update: func(pl *playlist) {
+				pl.addPart(&part{duration: 500 * time.Millisecond, independent: true})
+			},
+			want: head + `#EXT-X-PART:DURATION=0.500,URI="5.0.m4s",INDEPENDENT=YES
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="5.1.m4s"
+`,
+		},
+		{
+			name: "new init segment",
+			update: func(pl *playlist) {
+				pl.setInit([]byte("init 2"))
+				pl.addPart(&part{duration: 500 * time.Millisecond, independent: true})
+			},
+			want: head + `#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="init-2.mp4"
+#EXT-X-PART:DURATION=0.500,URI="5.0.m4s",INDEPENDENT=YES
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="5.1.m4s"
+`,
+		},
+		{
+			name: "same init segment again",
+			update: func(pl *playlist) {
+				pl.setInit([]byte("init 1"))
+				pl.addPart(&part{duration: 500 * time.Millisecond, independent: true})
+			},
+			want: head + `#EXT-X-PART:DURATION=0.500,URI="5.0.m4s",INDEPENDENT=YES
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="5.1.m4s"
+`,
+		},
+		{
+			name: "ended",
+			update: func(pl *playlist) {
+				pl.addPart(&part{duration: 500 * time.Millisecond, independent: true})
+				pl.end(time.Hour, func() {})
+			},
+			want: head + `#EXT-X-ENDLIST
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		pl := testPlaylist()
+		if tt.update != nil {
+			tt.update(pl)
+		}
+		if got := string(pl.llm3u8(time.Second)); got != tt.want {
+			t.Errorf("%s: llm3u8 =\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLLM3U8Discontinuity(t *testing.T) {
+	pl := testPlaylist()
+	pl.setInit([]byte("init 2"))
+	pl.addPart(&part{duration: time.Second, independent: true})
+	pl.add(time.Second, nil)
+
+	want := `#EXTM3U
+#EXT-X-VERSION:9
+#EXT-X-TARGETDURATION:2
+#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=3.000
+#EXT-X-PART-INF:PART-TARGET=1.000
+#EXT-X-MEDIA-SEQUENCE:2
+#EXT-X-MAP:URI="init-1.mp4"
+#EXTINF:2.000,
+2.m4s
+#EXT-X-PART:DURATION=1.000,URI="3.0.m4s",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="3.1.m4s"
+#EXTINF:2.000,
+3.m4s
+#EXT-X-PART:DURATION=1.000,URI="4.0.m4s",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="4.1.m4s"
+#EXTINF:2.000,
+4.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="init-2.mp4"
+#EXT-X-PART:DURATION=1.000,URI="5.0.m4s",INDEPENDENT=YES
+#EXTINF:1.000,
+5.m4s
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="6.0.m4s"
+`
+	if got := string(pl.llm3u8(time.Second)); got != want {
+		t.Errorf("llm3u8 =\n%s\nwant\n%s", got, want)
+	}
+
+	// init segments stay available while a kept segment uses them
+	if pl.initSegmentVersion(1) == nil || string(pl.initSegmentVersion(2)) != "init 2" {
+		t.Error("init segments of kept segments are gone")
+	}
+}
+
+func TestLLM3U8Empty(t *testing.T) {
+	pl := newPlaylist(4)
+	if b := pl.llm3u8(time.Second); b != nil {
+		t.Errorf("llm3u8 without init segment =\n%s", b)
+	}
+	pl.setInit([]byte("init 1"))
+	pl.addPart(&part{duration: time.Second, independent: true})
+	if b := pl.llm3u8(time.Second); b != nil {
+		t.Errorf("llm3u8 without segment =\n%s", b)
+	}
+}
@@ -0,0 +1,208 @@
+package hls
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"time"
+
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/mediaseg"
+	"rtmp-example/internal/ts"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+segmenter feeds the packets of one publishing session to the outputs
+of a stream: MPEG-TS segments and CMAF parts and segments.
+
+Segments start at a keyframe and are cut at the first keyframe once
+the target duration is reached, so a segment may run longer than the
+target when keyframes are sparse. Streams without video are cut on
+any audio frame. Packets before the first keyframe are dropped.
+*/
+type segmenter struct {
+	info    av.Info
+	outputs []output
+	done    func()
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// output is one format a stream is segmented into. Calls are
+// serialized by the segmenter.
+type output interface {
+	write(p *av.Packet)
+	close()
+}
+
+func newSegmenter(info av.Info, done func(), outputs ...output) *segmenter {
+	return &segmenter{
+		info: av.Info{
+			Key: info.Key,
+			URL: info.URL,
+			UID: av.NewUID(),
+		},
+		outputs: outputs,
+		done:    done,
+	}
+}
+
+func (seg *segmenter) Write(p *av.Packet) error {
+	seg.mu.Lock()
+	defer seg.mu.Unlock()
+
+	if seg.closed {
+		return os.ErrClosed
+	}
+	if p.IsMetadata {
+		return nil
+	}
+
+	for _, o := range seg.outputs {
+		o.write(p)
+	}
+	return nil
+}
+
+func (seg *segmenter) Info() av.Info {
+	return seg.info
+}
+
+func (seg *segmenter) Alive() bool {
+	seg.mu.Lock()
+	defer seg.mu.Unlock()
+
+	return !seg.closed
+}
+
+func (seg *segmenter) CalcBaseTimestamp() {}
+
+// Close ends the last segments and the playlists.
+func (seg *segmenter) Close(err error) {
+	seg.mu.Lock()
+	defer seg.mu.Unlock()
+
+	if seg.closed {
+		return
+	}
+	seg.closed = true
+
+	for _, o := range seg.outputs {
+		o.close()
+	}
+	seg.done()
+}
+
+// tsOutput muxes a stream into MPEG-TS segments.
+type tsOutput struct {
+	key    string
+	pl     *playlist
+	target time.Duration
+
+	muxer   *ts.Muxer
+	buf     *bytes.Buffer
+	start   uint32
+	last    uint32
+	pic     picture
+	skipped bool
+}
+
+func newTSOutput(key string, pl *playlist, target time.Duration) *tsOutput {
+	return &tsOutput{
+		key:    key,
+		pl:     pl,
+		target: target,
+		muxer:  ts.NewMuxer(),
+	}
+}
+
+func (out *tsOutput) write(p *av.Packet) {
+	if mediaseg.IsSeqHeader(p) {
+		if out.pic.resized(p) && out.buf != nil {
+			// Players reset their decoder on a discontinuity.
+			out.flush(out.last)
+			out.pl.discontinue()
+		}
+		out.mux(p)
+		return
+	}
+
+	if out.cutsAt(p) {
+		if out.buf != nil {
+			out.flush(p.TimeStamp)
+		}
+		out.buf = &bytes.Buffer{}
+		out.start = p.TimeStamp
+		if err := out.muxer.WriteTables(out.buf); err != nil {
+			log.Warnf("hls %s: mux: %v", out.key, err)
+		}
+	}
+	if out.buf == nil {
+		return
+	}
+
+	out.last = p.TimeStamp
+	out.mux(p)
+}
+
+func (out *tsOutput) mux(p *av.Packet) {
+	err := out.muxer.Mux(p, out.buf)
+	if err == ts.ErrUnsupportedCodec {
+		if !out.skipped {
+			out.skipped = true
+			log.Warnf("hls %s: skipping packets of unsupported codec", out.key)
+		}
+		return
+	}
+	if err != nil {
+		log.Warnf("hls %s: mux: %v", out.key, err)
+	}
+}
+
+// cutsAt reports whether a new segment starts with p.
+func (out *tsOutput) cutsAt(p *av.Packet) bool {
+	if !mediaseg.StartsSegment(p, out.muxer.HasVideo()) {
+		return false
+	}
+	if out.buf == nil {
+		return true
+	}
+	return p.TimeStamp >= out.start && time.Duration(p.TimeStamp-out.start)*time.Millisecond >= out.target
+}
+
+// picture follows the picture size given by video sequence headers.
+type picture struct {
+	width  int
+	height int
+}
+
+// resized reports whether the video sequence header p changes the
+// picture size.
+func (pic *picture) resized(p *av.Packet) bool {
+	if !p.IsVideo {
+		return false
+	}
+	_, sps, ok := parseVideoConfig(p)
+	if !ok {
+		return false
+	}
+
+	changed := pic.width != 0 && (sps.Width != pic.width || sps.Height != pic.height)
+	pic.width, pic.height = sps.Width, sps.Height
+	return changed
+}
+
+// flush hands the current segment, ending at end, to the playlist.
+func (out *tsOutput) flush(end uint32) {
+	out.pl.add(mediaseg.Span(out.start, end), out.buf.Bytes())
+	out.buf = nil
+}
+
+func (out *tsOutput) close() {
+	if out.buf != nil {
+		out.flush(out.last)
+	}
+}
@@ -0,0 +1,389 @@
+package hls
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/httpd"
+	"rtmp-example/rtmp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTargetDuration = 4 * time.Second
+	defaultPartTarget     = 500 * time.Millisecond
+	defaultWindowSize     = 6
+)
+
+var errNoHub = errors.New("hls: server has no stream hub")
+
+/*
+Server segments every stream published to a StreamHub into MPEG-TS
+and CMAF fragmented MP4, and serves them as HLS and low-latency HLS:
+
+	GET /{app}/{stream}.m3u8               sliding window playlist
+	GET /{app}/{stream}/{seq}.ts           segment
+	GET /{app}/{stream}/master.m3u8        master playlist of the above
+	GET /{app}/{stream}/ll.m3u8            low-latency playlist
+	GET /{app}/{stream}/ll-master.m3u8     master playlist of the above
+	GET /{app}/{stream}/init-{n}.mp4       fMP4 init segment version n
+	GET /{app}/{stream}/{seq}.m4s          fMP4 segment
+	GET /{app}/{stream}/{seq}.{part}.m4s   fMP4 part
+
+Master playlists give the codecs, resolution and frame rate of the
+stream, and its peak bit rate over the window. The low-latency
+playlist supports blocking reloads through _HLS_msn
+and _HLS_part, and requests for the hinted part are held until it is
+complete.
+
+Segments are kept in memory. Once a stream is unpublished its playlist
+is ended with EXT-X-ENDLIST and dropped after the window has played
+out, unless the stream is published again in the meantime.
+
+Serve registers the server on the hub, so only streams published
+afterwards are segmented. Server is also an http.Handler.
+*/
+type Server struct {
+	Host string
+	Port int
+
+	// Hub is the hub the RTMP server publishes to. It is required.
+	Hub *rtmp.StreamHub
+
+	// TargetDuration is the duration segments are cut at, on the next
+	// keyframe. Zero means 4 seconds.
+	TargetDuration time.Duration
+
+	// PartTarget is the maximum duration of low-latency parts. Zero
+	// means 500 milliseconds.
+	PartTarget time.Duration
+
+	// WindowSize is the number of segments listed in playlists. Zero
+	// means 6.
+	WindowSize int
+
+	// AllowOrigin is sent as Access-Control-Allow-Origin. Empty means "*".
+	AllowOrigin string
+
+	// ShutdownTimeout bounds the draining done by ListenAndServe when
+	// its context is cancelled. Zero means 10 seconds.
+	ShutdownTimeout time.Duration
+
+	mu      sync.Mutex
+	closing bool
+	httpd   httpd.Server
+	streams map[string]*stream
+}
+
+// stream holds the playlists a published stream is segmented into.
+type stream struct {
+	ts      *playlist
+	ll      *playlist
+	variant *variant
+}
+
+// ListenAndServe listens on Host:Port and serves requests until ctx is
+// cancelled or Shutdown is called. It always returns a non-nil error,
+// http.ErrServerClosed after a shutdown.
+func (srv *Server) ListenAndServe(ctx context.Context) error {
+	listen, err := httpd.Listen(srv.Host, srv.Port)
+	if err != nil {
+		return err
+	}
+
+	return srv.Serve(ctx, listen)
+}
+
+// Serve serves requests on listen, see ListenAndServe.
+func (srv *Server) Serve(ctx context.Context, listen net.Listener) error {
+	if srv.Hub == nil {
+		listen.Close()
+		return errNoHub
+	}
+
+	hs, err := srv.httpd.Start(srv)
+	if err != nil {
+		listen.Close()
+		return err
+	}
+
+	srv.Hub.AddGetWriter(srv)
+	log.Infof("HLS listening on %s", listen.Addr())
+	return httpd.Run(ctx, hs, listen, srv.Shutdown, srv.ShutdownTimeout)
+}
+
+// Shutdown stops segmenting new streams and shuts the HTTP server
+// down, see http.Server.Shutdown.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.closing = true
+	srv.mu.Unlock()
+
+	return srv.httpd.Shutdown(ctx)
+}
+
+// GetWriter implements av.GetWriter and returns the segmenter of a
+// newly published stream.
+func (srv *Server) GetWriter(info av.Info) av.WriteCloser {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.closing {
+		return nil
+	}
+	if srv.streams == nil {
+		srv.streams = make(map[string]*stream)
+	}
+
+	st, ok := srv.streams[info.Key]
+	if ok {
+		st.ts.restart()
+		st.ll.restart()
+		st.variant.reset()
+	} else {
+		st = &stream{
+			ts:      newPlaylist(srv.windowSize()),
+			ll:      newPlaylist(srv.windowSize()),
+			variant: &variant{},
+		}
+		srv.streams[info.Key] = st
+	}
+
+	target := srv.targetDuration()
+	linger := target * time.Duration(srv.windowSize()+segmentsKept)
+	done := func() {
+		remove := func() {
+			srv.remove(info.Key, st)
+		}
+		st.ts.end(linger, remove)
+		st.ll.end(linger, remove)
+	}
+	return newSegmenter(info, done,
+		newTSOutput(info.Key, st.ts, target),
+		newCMAFOutput(info.Key, st.ll, target, srv.partTarget()),
+		st.variant,
+	)
+}
+
+func (srv *Server) remove(key string, st *stream) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if cur, ok := srv.streams[key]; ok && cur == st && st.ts.isEnded() {
+		delete(srv.streams, key)
+	}
+}
+
+func (srv *Server) stream(key string) (*stream, bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	st, ok := srv.streams[key]
+	return st, ok
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !httpd.Accept(w, r, srv.AllowOrigin) {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if key, ok := strings.CutSuffix(path, ".m3u8"); ok && httpd.ValidKey(key) {
+		srv.servePlaylist(w, r, key)
+		return
+	}
+
+	i := strings.LastIndexByte(path, '/')
+	if i < 0 || !httpd.ValidKey(path[:i]) {
+		http.NotFound(w, r)
+		return
+	}
+	st, ok := srv.stream(path[:i])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	file := path[i+1:]
+	switch {
+	case file == "master.m3u8":
+		_, name, _ := strings.Cut(path[:i], "/")
+		serveMaster(w, r, st, st.ts, "../"+name+".m3u8")
+	case file == "ll-master.m3u8":
+		serveMaster(w, r, st, st.ll, "ll.m3u8")
+	case file == "ll.m3u8":
+		srv.serveLLPlaylist(w, r, st)
+	case strings.HasPrefix(file, "init-") && strings.HasSuffix(file, ".mp4"):
+		srv.serveInit(w, r, st.ll, strings.TrimSuffix(strings.TrimPrefix(file, "init-"), ".mp4"))
+	case strings.HasSuffix(file, ".ts"):
+		srv.serveSegment(w, r, st.ts, strings.TrimSuffix(file, ".ts"), "video/mp2t")
+	case strings.HasSuffix(file, ".m4s"):
+		srv.serveSegment(w, r, st.ll, strings.TrimSuffix(file, ".m4s"), "video/iso.segment")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (srv *Server) servePlaylist(w http.ResponseWriter, r *http.Request, key string) {
+	st, ok := srv.stream(key)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	_, name, _ := strings.Cut(key, "/")
+	body := st.ts.m3u8(name)
+	if body == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	httpd.ServeData(w, r, "application/vnd.apple.mpegurl", body)
+}
+
+// serveMaster serves the master playlist of media playlist pl, found
+// at uri. It is not found until pl has segments to measure.
+func serveMaster(w http.ResponseWriter, r *http.Request, st *stream, pl *playlist, uri string) {
+	bandwidth := pl.bandwidth()
+	if bandwidth == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	httpd.ServeData(w, r, "application/vnd.apple.mpegurl", st.variant.m3u8(uri, bandwidth))
+}
+
+/*
+serveLLPlaylist serves the low-latency playlist. A request with
+_HLS_msn, and optionally _HLS_part, is held until that segment or part
+is listed, for up to three target durations.
+*/
+func (srv *Server) serveLLPlaylist(w http.ResponseWriter, r *http.Request, st *stream) {
+	q := r.URL.Query()
+	if v := q.Get("_HLS_msn"); v != "" {
+		msn, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid _HLS_msn", http.StatusBadRequest)
+			return
+		}
+		part := -1
+		if v := q.Get("_HLS_part"); v != "" {
+			if part, err = strconv.Atoi(v); err != nil || part < 0 {
+				http.Error(w, "invalid _HLS_part", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Requests too far in the future are refused.
+		if msn > st.ll.lastSeq()+2 {
+			http.Error(w, "_HLS_msn too far ahead", http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 3*srv.targetDuration())
+		defer cancel()
+		if !st.ll.wait(ctx, msn, part) && !st.ll.isEnded() {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	body := st.ll.llm3u8(srv.partTarget())
+	if body == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	httpd.ServeData(w, r, "application/vnd.apple.mpegurl", body)
+}
+
+// serveInit serves version {version} of the CMAF initialization
+// segment.
+func (srv *Server) serveInit(w http.ResponseWriter, r *http.Request, pl *playlist, version string) {
+	v, err := strconv.Atoi(version)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// A version never changes once listed.
+	w.Header().Set("Cache-Control", "max-age=60")
+	httpd.ServeData(w, r, "video/mp4", pl.initSegmentVersion(v))
+}
+
+// serveSegment serves segment {seq} or part {seq}.{part}. A part that
+// is not complete yet, such as the preload hint, is waited for.
+func (srv *Server) serveSegment(w http.ResponseWriter, r *http.Request, pl *playlist, name string, contentType string) {
+	seqStr, partStr, isPart := strings.Cut(name, ".")
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !isPart {
+		seg, ok := pl.segment(seq)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		httpd.ServeData(w, r, contentType, seg.data)
+		return
+	}
+
+	i, err := strconv.Atoi(partStr)
+	if err != nil || i < 0 || seq > pl.lastSeq()+1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 3*srv.partTarget())
+	defer cancel()
+	if !pl.wait(ctx, seq, i) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// A hint for part 0 of the next segment may be answered by the
+	// segment in progress turning into that segment.
+	p, ok := pl.part(seq, i)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "max-age=60")
+	httpd.ServeData(w, r, contentType, p.data)
+}
+
+func (srv *Server) targetDuration() time.Duration {
+	if srv.TargetDuration <= 0 {
+		return defaultTargetDuration
+	}
+	return srv.TargetDuration
+}
+
+func (srv *Server) partTarget() time.Duration {
+	if srv.PartTarget <= 0 {
+		return defaultPartTarget
+	}
+	return srv.PartTarget
+}
+
+func (srv *Server) windowSize() int {
+	if srv.WindowSize <= 0 {
+		return defaultWindowSize
+	}
+	return srv.WindowSize
+}
@@ -0,0 +1,120 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+
+	"rtmp-example/internal/aac"
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/h264"
+	"rtmp-example/internal/mediaseg"
+)
+
+/*
+variant describes a stream in master playlists:
+
+	#EXT-X-STREAM-INF:BANDWIDTH=2200000,CODECS="avc1.64001f,mp4a.40.2",RESOLUTION=1280x720,FRAME-RATE=30.000
+	../stream.m3u8
+
+It is an output of the segmenter so as to follow the sequence headers
+of the stream.
+*/
+type variant struct {
+	mu         sync.RWMutex
+	videoCodec string
+	audioCodec string
+	width      int
+	height     int
+	frameRate  float64
+}
+
+func (v *variant) write(p *av.Packet) {
+	if !mediaseg.IsSeqHeader(p) {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if p.IsVideo {
+		c, sps, ok := parseVideoConfig(p)
+		if !ok {
+			return
+		}
+		v.videoCodec = c.Codec()
+		v.width = sps.Width
+		v.height = sps.Height
+		v.frameRate = sps.FrameRate
+		return
+	}
+
+	c, err := aac.ParseConfig(p.Data[2:])
+	if err != nil {
+		return
+	}
+	v.audioCodec = c.Codec()
+}
+
+func (v *variant) close() {}
+
+// reset forgets the codecs of the previous publisher.
+func (v *variant) reset() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.videoCodec = ""
+	v.audioCodec = ""
+	v.width = 0
+	v.height = 0
+	v.frameRate = 0
+}
+
+// m3u8 renders a master playlist listing uri, the media playlist of
+// the variant, which peaks at bandwidth bits per second.
+func (v *variant) m3u8(uri string, bandwidth int) []byte {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", bandwidth)
+
+	var codecs []string
+	for _, c := range []string{v.videoCodec, v.audioCodec} {
+		if c != "" {
+			codecs = append(codecs, c)
+		}
+	}
+	if len(codecs) > 0 {
+		fmt.Fprintf(&b, ",CODECS=\"%s\"", strings.Join(codecs, ","))
+	}
+	if v.videoCodec != "" {
+		fmt.Fprintf(&b, ",RESOLUTION=%dx%d", v.width, v.height)
+		if v.frameRate > 0 {
+			fmt.Fprintf(&b, ",FRAME-RATE=%.3f", v.frameRate)
+		}
+	}
+	fmt.Fprintf(&b, "\n%s\n", uri)
+	return b.Bytes()
+}
+
+// parseVideoConfig decodes the AVC sequence header p.
+func parseVideoConfig(p *av.Packet) (*h264.DecoderConfig, *h264.SPS, bool) {
+	vh, ok := p.Header.(av.VideoPacketHeader)
+	if !ok || vh.CodecID() != av.VIDEO_H264 || len(p.Data) < 5 {
+		return nil, nil, false
+	}
+
+	c, err := h264.ParseDecoderConfig(p.Data[5:])
+	if err != nil {
+		return nil, nil, false
+	}
+	sps, err := c.SPSInfo()
+	if err != nil {
+		return nil, nil, false
+	}
+	return c, sps, true
+}
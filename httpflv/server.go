@@ -0,0 +1,251 @@
+package httpflv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/flv"
+	"rtmp-example/internal/httpd"
+	"rtmp-example/rtmp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWaitTimeout  = 5 * time.Second
+	defaultWriteTimeout = 10 * time.Second
+)
+
+var errNoHub = errors.New("httpflv: server has no stream hub")
+
+/*
+Server serves live streams of a StreamHub as HTTP-FLV:
+
+	GET /{app}/{stream}.flv
+
+The response is a chunked FLV file that never ends while the stream is
+published. It starts with the stream's metadata and sequence headers
+followed by its cached GOP, so players such as flv.js can start
+decoding at once. A stream nobody publishes is answered with 404 once
+WaitTimeout passes without a packet, which leaves time to a Puller.
+
+Server is an http.Handler and can be mounted on another mux, or run on
+its own with ListenAndServe.
+*/
+type Server struct {
+	Host string
+	Port int
+
+	// Hub is the hub the RTMP server publishes to. It is required.
+	Hub *rtmp.StreamHub
+
+	// AllowOrigin is sent as Access-Control-Allow-Origin. Empty means "*".
+	AllowOrigin string
+
+	// WaitTimeout bounds the wait for the first packet of a stream.
+	// Zero means 5 seconds.
+	WaitTimeout time.Duration
+
+	// WriteTimeout drops viewers whose connection accepts no data for
+	// that long. Zero means 10 seconds.
+	WriteTimeout time.Duration
+
+	// ShutdownTimeout bounds the draining done by ListenAndServe when
+	// its context is cancelled. Zero means 10 seconds.
+	ShutdownTimeout time.Duration
+
+	mu      sync.Mutex
+	closing bool
+	httpd   httpd.Server
+	viewers map[*writer]struct{}
+}
+
+// ListenAndServe listens on Host:Port and serves requests until ctx is
+// cancelled or Shutdown is called. It always returns a non-nil error,
+// http.ErrServerClosed after a shutdown.
+func (srv *Server) ListenAndServe(ctx context.Context) error {
+	listen, err := httpd.Listen(srv.Host, srv.Port)
+	if err != nil {
+		return err
+	}
+
+	return srv.Serve(ctx, listen)
+}
+
+// Serve serves requests on listen, see ListenAndServe.
+func (srv *Server) Serve(ctx context.Context, listen net.Listener) error {
+	if srv.Hub == nil {
+		listen.Close()
+		return errNoHub
+	}
+
+	hs, err := srv.httpd.Start(srv)
+	if err != nil {
+		listen.Close()
+		return err
+	}
+
+	log.Infof("HTTP-FLV listening on %s", listen.Addr())
+	return httpd.Run(ctx, hs, listen, srv.Shutdown, srv.ShutdownTimeout)
+}
+
+// Shutdown ends every viewer's response and shuts the HTTP server down,
+// see http.Server.Shutdown.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.closing = true
+	viewers := make([]*writer, 0, len(srv.viewers))
+	for w := range srv.viewers {
+		viewers = append(viewers, w)
+	}
+	srv.mu.Unlock()
+
+	log.Infof("HTTP-FLV shutting down, closing %d viewers", len(viewers))
+	for _, w := range viewers {
+		w.Close(rtmp.ErrServerClosed)
+	}
+
+	return srv.httpd.Shutdown(ctx)
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !httpd.Accept(w, r, srv.AllowOrigin) {
+		return
+	}
+
+	key, ok := streamKey(r.URL.Path)
+	if !ok || srv.Hub == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	fw := newWriter(key, r.URL.String())
+	if !srv.track(fw) {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer srv.untrack(fw)
+
+	srv.Hub.HandleWriter(fw)
+	defer srv.Hub.RemoveWriter(fw)
+	defer fw.Close(nil)
+
+	// Nothing is written before the first packet so that a stream
+	// which never shows up can still be answered with 404.
+	var first av.Packet
+	timer := time.NewTimer(srv.waitTimeout())
+	select {
+	case first = <-fw.packets:
+		timer.Stop()
+	case <-timer.C:
+		http.Error(w, "stream not found", http.StatusNotFound)
+		return
+	case <-fw.done:
+		timer.Stop()
+		http.Error(w, "stream not found", http.StatusNotFound)
+		return
+	case <-r.Context().Done():
+		timer.Stop()
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "video/x-flv")
+	h.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	log.Infof("httpflv %s: viewer %s from %s", key, fw.info.UID, r.RemoteAddr)
+	if err := srv.serve(w, fw, r, &first); err != nil {
+		log.Infof("httpflv %s: viewer %s left: %v", key, fw.info.UID, err)
+	}
+}
+
+// serve writes the FLV header, first and then every queued packet to
+// the viewer until it leaves or the stream ends.
+func (srv *Server) serve(w http.ResponseWriter, fw *writer, r *http.Request, first *av.Packet) error {
+	rc := http.NewResponseController(w)
+	timeout := srv.WriteTimeout
+	if timeout <= 0 {
+		timeout = defaultWriteTimeout
+	}
+
+	// Deadlines are optional; writers that lack them just block.
+	muxer := flv.NewMuxer()
+	mux := func(p *av.Packet) error {
+		q := *p
+		q.TimeStamp = fw.timestamp(p)
+		return muxer.Mux(&q, w)
+	}
+
+	rc.SetWriteDeadline(time.Now().Add(timeout))
+	if err := mux(first); err != nil {
+		return err
+	}
+
+	for {
+		if len(fw.packets) == 0 {
+			if err := rc.Flush(); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case p := <-fw.packets:
+			rc.SetWriteDeadline(time.Now().Add(timeout))
+			if err := mux(&p); err != nil {
+				return err
+			}
+		case <-fw.done:
+			return fw.err
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+}
+
+func (srv *Server) waitTimeout() time.Duration {
+	if srv.WaitTimeout <= 0 {
+		return defaultWaitTimeout
+	}
+	return srv.WaitTimeout
+}
+
+// track registers a viewer, unless the server is shutting down.
+func (srv *Server) track(w *writer) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.closing {
+		return false
+	}
+	if srv.viewers == nil {
+		srv.viewers = make(map[*writer]struct{})
+	}
+	srv.viewers[w] = struct{}{}
+	return true
+}
+
+func (srv *Server) untrack(w *writer) {
+	srv.mu.Lock()
+	delete(srv.viewers, w)
+	srv.mu.Unlock()
+}
+
+// streamKey maps /{app}/{stream}.flv to the hub key app/stream.
+func streamKey(path string) (string, bool) {
+	if !strings.HasSuffix(path, ".flv") {
+		return "", false
+	}
+
+	key := strings.TrimSuffix(strings.TrimPrefix(path, "/"), ".flv")
+	return key, httpd.ValidKey(key)
+}
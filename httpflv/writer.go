@@ -0,0 +1,111 @@
+package httpflv
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"rtmp-example/internal/av"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const writerQueueSize = 1024
+
+var ErrWriterClosed = errors.New("httpflv: writer closed")
+
+/*
+writer receives the packets of a stream for one HTTP viewer.
+
+Write only queues the packet so a slow viewer never stalls the
+publisher. When the queue is full the packet is dropped, and video is
+then skipped until the next keyframe so the viewer's decoder does not
+see frames referencing dropped ones. Metadata and sequence headers are
+never skipped once there is room again.
+*/
+type writer struct {
+	info    av.Info
+	packets chan av.Packet
+	done    chan struct{}
+	once    sync.Once
+	err     error
+
+	waitKey       int32
+	baseTimestamp uint32
+	lastTimestamp uint32
+	dropped       uint64
+}
+
+func newWriter(key, url string) *writer {
+	return &writer{
+		info: av.Info{
+			Key: key,
+			URL: url,
+			UID: av.NewUID(),
+		},
+		packets: make(chan av.Packet, writerQueueSize),
+		done:    make(chan struct{}),
+	}
+}
+
+func (w *writer) Write(p *av.Packet) error {
+	select {
+	case <-w.done:
+		return ErrWriterClosed
+	default:
+	}
+
+	if atomic.LoadInt32(&w.waitKey) == 1 && p.IsVideo {
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		switch {
+		case ok && vh.IsSeq():
+		case ok && vh.IsKeyFrame():
+			atomic.StoreInt32(&w.waitKey, 0)
+		default:
+			return nil
+		}
+	}
+
+	select {
+	case w.packets <- *p:
+	default:
+		atomic.StoreInt32(&w.waitKey, 1)
+		if atomic.AddUint64(&w.dropped, 1)%100 == 1 {
+			log.Warnf("httpflv %s: queue full, dropping packets", w.info.UID)
+		}
+	}
+	return nil
+}
+
+// timestamp maps a packet timestamp to the viewer's timeline.
+func (w *writer) timestamp(p *av.Packet) uint32 {
+	ts := p.TimeStamp + atomic.LoadUint32(&w.baseTimestamp)
+	atomic.StoreUint32(&w.lastTimestamp, ts)
+	return ts
+}
+
+func (w *writer) Info() av.Info {
+	return w.info
+}
+
+func (w *writer) Alive() bool {
+	select {
+	case <-w.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// CalcBaseTimestamp continues the timeline of the previous publisher
+// so the viewer sees monotonic timestamps across a republish.
+func (w *writer) CalcBaseTimestamp() {
+	atomic.StoreUint32(&w.baseTimestamp, atomic.LoadUint32(&w.lastTimestamp))
+}
+
+func (w *writer) Close(err error) {
+	w.once.Do(func() {
+		w.err = err
+		close(w.done)
+	})
+}
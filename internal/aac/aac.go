@@ -0,0 +1,283 @@
+package aac
+
+import (
+	"fmt"
+
+	"rtmp-example/internal/av"
+)
+
+// ADTSHeaderLen is the size of an ADTS header without CRC.
+const ADTSHeaderLen = 7
+
+// Audio object types.
+const (
+	AOT_AAC_MAIN = 1
+	AOT_AAC_LC   = 2
+	AOT_AAC_SSR  = 3
+	AOT_AAC_LTP  = 4
+	AOT_SBR      = 5
+	AOT_PS       = 29
+	AOT_ESCAPE   = 31
+)
+
+// SampleRates maps sampling frequency indexes to rates in Hz.
+var SampleRates = [13]int{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// explicitFrequency is the sampling frequency index announcing a
+// 24-bit frequency.
+const explicitFrequency = 15
+
+var _ av.SampleRater = (*Config)(nil)
+
+/*
+Config is the AudioSpecificConfig carried by AAC sequence headers:
+
+	+--------------------+-----------------------+----------------------+
+	| AudioObjectType    | SamplingFrequencyIdx  | ChannelConfiguration |
+	| (5 bits, 31 adds   | (4 bits, 15 adds a    | (4 bits)             |
+	|  6 bits)           |  24-bit frequency)    |                      |
+	+--------------------+-----------------------+----------------------+
+	| HE-AAC with explicit signalling: extension frequency and the     |
+	| underlying object type follow.                                   |
+	+------------------------------------------------------------------+
+	| GASpecificConfig, then for backward compatible signalling the    |
+	| 0x2b7 sync extension announcing SBR, and 0x548 announcing PS.    |
+	+------------------------------------------------------------------+
+
+ObjectType is the core object type, AAC LC for HE-AAC. Frequency is the
+core sampling frequency and ExtensionFrequency the output frequency of
+SBR.
+*/
+type Config struct {
+	ObjectType         uint8
+	SampleRateIndex    uint8
+	Frequency          int
+	ChannelConfig      uint8
+	SBR                bool
+	PS                 bool
+	ExtensionFrequency int
+}
+
+// ParseConfig decodes an AudioSpecificConfig.
+func ParseConfig(b []byte) (*Config, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("aac: audio specific config too short: %d bytes", len(b))
+	}
+
+	r := &bitReader{b: b}
+	c := &Config{}
+	c.ObjectType = r.objectType()
+	c.SampleRateIndex, c.Frequency = r.frequency()
+	c.ChannelConfig = uint8(r.bits(4))
+
+	explicit := c.ObjectType == AOT_SBR || c.ObjectType == AOT_PS
+	if explicit {
+		c.SBR = true
+		c.PS = c.ObjectType == AOT_PS
+		_, c.ExtensionFrequency = r.frequency()
+		c.ObjectType = r.objectType()
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("aac: truncated audio specific config")
+	}
+	if c.Frequency <= 0 {
+		return nil, fmt.Errorf("aac: invalid sampling frequency index %d", c.SampleRateIndex)
+	}
+
+	// Backward compatible extensions follow the GASpecificConfig, which
+	// is skipped for the usual object types. A program config element
+	// is not parsed, so it hides them.
+	if !explicit && c.ChannelConfig != 0 && r.gaSpecificConfig(c.ObjectType) {
+		r.syncExtension(c)
+	}
+
+	return c, nil
+}
+
+// Codec returns the RFC 6381 codecs parameter of the stream, such as
+// mp4a.40.2, or mp4a.40.5 for HE-AAC.
+func (c *Config) Codec() string {
+	aot := c.ObjectType
+	switch {
+	case c.PS:
+		aot = AOT_PS
+	case c.SBR:
+		aot = AOT_SBR
+	}
+	return fmt.Sprintf("mp4a.40.%d", aot)
+}
+
+// SampleRate implements av.SampleRater and returns the output sampling
+// frequency in Hz, doubled by SBR.
+func (c *Config) SampleRate() (int, error) {
+	if c.SBR && c.ExtensionFrequency > 0 {
+		return c.ExtensionFrequency, nil
+	}
+	if c.Frequency <= 0 {
+		return 0, fmt.Errorf("aac: unknown sampling frequency")
+	}
+	return c.Frequency, nil
+}
+
+// Channels returns the number of output channels, or 0 when they are
+// described by a program config element.
+func (c *Config) Channels() int {
+	if c.PS {
+		return 2
+	}
+	switch {
+	case c.ChannelConfig <= 6:
+		return int(c.ChannelConfig)
+	case c.ChannelConfig == 7:
+		return 8
+	}
+	return 0
+}
+
+/*
+ADTSHeader returns the ADTS header for a raw frame of payloadLen bytes:
+
+	+----------+----+-------+------------+---------+------------+-----------+
+	| Syncword | ID | Layer | Protection | Profile | SampleRate | ...       |
+	| (12)     | (1)| (2)   | absent (1) | (2)     | Index (4)  |           |
+	+----------+----+-------+------------+---------+------------+-----------+
+	| Private (1) | Channels (3) | 4 bits | FrameLength (13) | Fullness (11) |
+	+-------------+--------------+--------+------------------+---------------+
+	| RawDataBlocks - 1 (2) |
+	+-----------------------+
+
+HE-AAC is announced as AAC LC at the core frequency, decoders find SBR
+and PS in the frames. ADTS cannot carry other object types than the
+first four, nor explicit frequencies.
+*/
+func (c *Config) ADTSHeader(payloadLen int) ([]byte, error) {
+	if c.ObjectType < AOT_AAC_MAIN || c.ObjectType > AOT_AAC_LTP {
+		return nil, fmt.Errorf("aac: object type %d not supported by adts", c.ObjectType)
+	}
+	if c.SampleRateIndex >= explicitFrequency {
+		return nil, fmt.Errorf("aac: explicit sampling frequency not supported by adts")
+	}
+	frameLen := ADTSHeaderLen + payloadLen
+	if frameLen > 0x1fff {
+		return nil, fmt.Errorf("aac: frame too large for adts: %d bytes", payloadLen)
+	}
+
+	profile := c.ObjectType - 1
+	return []byte{
+		0xff,
+		0xf1,
+		profile<<6 | c.SampleRateIndex<<2 | (c.ChannelConfig>>2)&0x01,
+		(c.ChannelConfig&0x03)<<6 | byte(frameLen>>11)&0x03,
+		byte(frameLen >> 3),
+		byte(frameLen&0x07)<<5 | 0x1f,
+		0xfc,
+	}, nil
+}
+
+// ADTS returns the raw frame as an ADTS frame.
+func (c *Config) ADTS(frame []byte) ([]byte, error) {
+	h, err := c.ADTSHeader(len(frame))
+	if err != nil {
+		return nil, err
+	}
+	return append(h, frame...), nil
+}
+
+type bitReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *bitReader) left() int {
+	return len(r.b)*8 - r.pos
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	if n > r.left() {
+		r.err = fmt.Errorf("aac: read past end")
+		r.pos = len(r.b) * 8
+		return 0
+	}
+
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | uint32(r.b[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) objectType() uint8 {
+	aot := uint8(r.bits(5))
+	if aot == AOT_ESCAPE {
+		aot = 32 + uint8(r.bits(6))
+	}
+	return aot
+}
+
+// frequency reads a sampling frequency index and the frequency it
+// stands for.
+func (r *bitReader) frequency() (uint8, int) {
+	i := uint8(r.bits(4))
+	if i == explicitFrequency {
+		return i, int(r.bits(24))
+	}
+	if int(i) >= len(SampleRates) {
+		return i, 0
+	}
+	return i, SampleRates[i]
+}
+
+// gaSpecificConfig skips the GASpecificConfig of the AAC object types
+// and reports whether it could.
+func (r *bitReader) gaSpecificConfig(aot uint8) bool {
+	switch aot {
+	case 1, 2, 3, 4, 6, 7, 17, 19, 20, 21, 22, 23:
+	default:
+		return false
+	}
+
+	r.bits(1) // frameLengthFlag
+	if r.bits(1) == 1 {
+		r.bits(14) // coreCoderDelay
+	}
+	extension := r.bits(1) == 1
+	if aot == 6 || aot == 20 {
+		r.bits(3) // layerNr
+	}
+	if extension {
+		switch aot {
+		case 22:
+			r.bits(16) // numOfSubFrame, layer_length
+		case 17, 19, 20, 23:
+			r.bits(3) // resilience flags
+		}
+		r.bits(1) // extensionFlag3
+	}
+	return r.err == nil
+}
+
+// syncExtension reads the backward compatible signalling of SBR and
+// PS, if present.
+func (r *bitReader) syncExtension(c *Config) {
+	if r.left() < 16 || r.bits(11) != 0x2b7 {
+		return
+	}
+	if r.objectType() != AOT_SBR || r.bits(1) == 0 {
+		return
+	}
+
+	_, freq := r.frequency()
+	if r.err != nil || freq == 0 {
+		return
+	}
+	c.SBR = true
+	c.ExtensionFrequency = freq
+
+	if r.left() >= 12 && r.bits(11) == 0x548 && r.bits(1) == 1 {
+		c.PS = true
+	}
+}
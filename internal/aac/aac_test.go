@@ -0,0 +1,196 @@
+package aac
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		b          []byte
+		want       Config
+		codec      string
+		sampleRate int
+		channels   int
+	}{
+		{
+			name:       "aac lc",
+			b:          []byte{0x12, 0x10},
+			want:       Config{ObjectType: AOT_AAC_LC, SampleRateIndex: 4, Frequency: 44100, ChannelConfig: 2},
+			codec:      "mp4a.40.2",
+			sampleRate: 44100,
+			channels:   2,
+		},
+		{
+			name:       "aac main 5.1",
+			b:          []byte{0x09, 0xb0},
+			want:       Config{ObjectType: AOT_AAC_MAIN, SampleRateIndex: 3, Frequency: 48000, ChannelConfig: 6},
+			codec:      "mp4a.40.1",
+			sampleRate: 48000,
+			channels:   6,
+		},
+		{
+			name:       "explicit frequency",
+			b:          []byte{0x17, 0x80, 0x18, 0x1c, 0x88},
+			want:       Config{ObjectType: AOT_AAC_LC, SampleRateIndex: 15, Frequency: 12345, ChannelConfig: 1},
+			codec:      "mp4a.40.2",
+			sampleRate: 12345,
+			channels:   1,
+		},
+		{
+			name: "he-aac explicit",
+			b:    []byte{0x2b, 0x11, 0x88, 0x00},
+			want: Config{
+				ObjectType: AOT_AAC_LC, SampleRateIndex: 6, Frequency: 24000, ChannelConfig: 2,
+				SBR: true, ExtensionFrequency: 48000,
+			},
+			codec:      "mp4a.40.5",
+			sampleRate: 48000,
+			channels:   2,
+		},
+		{
+			name: "he-aac v2 explicit",
+			b:    []byte{0xeb, 0x09, 0x88, 0x00},
+			want: Config{
+				ObjectType: AOT_AAC_LC, SampleRateIndex: 6, Frequency: 24000, ChannelConfig: 1,
+				SBR: true, PS: true, ExtensionFrequency: 48000,
+			},
+			codec:      "mp4a.40.29",
+			sampleRate: 48000,
+			channels:   2,
+		},
+		{
+			name: "he-aac backward compatible",
+			b:    []byte{0x13, 0x10, 0x56, 0xe5, 0x98},
+			want: Config{
+				ObjectType: AOT_AAC_LC, SampleRateIndex: 6, Frequency: 24000, ChannelConfig: 2,
+				SBR: true, ExtensionFrequency: 48000,
+			},
+			codec:      "mp4a.40.5",
+			sampleRate: 48000,
+			channels:   2,
+		},
+		{
+			name: "he-aac v2 backward compatible",
+			b:    []byte{0x13, 0x08, 0x56, 0xe5, 0x9d, 0x48, 0x80},
+			want: Config{
+				ObjectType: AOT_AAC_LC, SampleRateIndex: 6, Frequency: 24000, ChannelConfig: 1,
+				SBR: true, PS: true, ExtensionFrequency: 48000,
+			},
+			codec:      "mp4a.40.29",
+			sampleRate: 48000,
+			channels:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseConfig(tt.b)
+			if err != nil {
+				t.Fatalf("ParseConfig: %v", err)
+			}
+			if *c != tt.want {
+				t.Errorf("ParseConfig = %+v, want %+v", *c, tt.want)
+			}
+			if codec := c.Codec(); codec != tt.codec {
+				t.Errorf("Codec = %s, want %s", codec, tt.codec)
+			}
+			if rate, err := c.SampleRate(); err != nil || rate != tt.sampleRate {
+				t.Errorf("SampleRate = %d, %v, want %d", rate, err, tt.sampleRate)
+			}
+			if ch := c.Channels(); ch != tt.channels {
+				t.Errorf("Channels = %d, want %d", ch, tt.channels)
+			}
+		})
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"too short", []byte{0x12}},
+		{"invalid frequency index", []byte{0x16, 0x90}},
+		{"truncated explicit frequency", []byte{0x17, 0x80, 0x18}},
+		{"truncated he-aac", []byte{0x2b, 0x11}},
+	}
+	for _, tt := range tests {
+		if _, err := ParseConfig(tt.b); err == nil {
+			t.Errorf("%s: ParseConfig succeeded", tt.name)
+		}
+	}
+}
+
+func TestADTSHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		c          Config
+		payloadLen int
+		want       []byte
+	}{
+		{
+			name:       "aac lc",
+			c:          Config{ObjectType: AOT_AAC_LC, SampleRateIndex: 4, ChannelConfig: 2},
+			payloadLen: 100,
+			want:       []byte{0xff, 0xf1, 0x50, 0x80, 0x0d, 0x7f, 0xfc},
+		},
+		{
+			name: "he-aac as aac lc at the core frequency",
+			c: Config{
+				ObjectType: AOT_AAC_LC, SampleRateIndex: 6, ChannelConfig: 2,
+				SBR: true, ExtensionFrequency: 48000,
+			},
+			payloadLen: 10,
+			want:       []byte{0xff, 0xf1, 0x58, 0x80, 0x02, 0x3f, 0xfc},
+		},
+		{
+			name:       "7.1 and largest frame",
+			c:          Config{ObjectType: AOT_AAC_MAIN, SampleRateIndex: 3, ChannelConfig: 7},
+			payloadLen: 0x1fff - ADTSHeaderLen,
+			want:       []byte{0xff, 0xf1, 0x0d, 0xc3, 0xff, 0xff, 0xfc},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := tt.c.ADTSHeader(tt.payloadLen)
+			if err != nil {
+				t.Fatalf("ADTSHeader: %v", err)
+			}
+			if !bytes.Equal(h, tt.want) {
+				t.Errorf("ADTSHeader = % x, want % x", h, tt.want)
+			}
+		})
+	}
+}
+
+func TestADTSHeaderErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		c          Config
+		payloadLen int
+	}{
+		{"object type", Config{ObjectType: 23, SampleRateIndex: 4, ChannelConfig: 2}, 10},
+		{"explicit frequency", Config{ObjectType: AOT_AAC_LC, SampleRateIndex: 15, Frequency: 12345}, 10},
+		{"frame too large", Config{ObjectType: AOT_AAC_LC, SampleRateIndex: 4, ChannelConfig: 2}, 0x1fff},
+	}
+	for _, tt := range tests {
+		if _, err := tt.c.ADTSHeader(tt.payloadLen); err == nil {
+			t.Errorf("%s: ADTSHeader succeeded", tt.name)
+		}
+	}
+}
+
+func TestADTS(t *testing.T) {
+	c := Config{ObjectType: AOT_AAC_LC, SampleRateIndex: 4, ChannelConfig: 2}
+	frame := []byte{1, 2, 3}
+	b, err := c.ADTS(frame)
+	if err != nil {
+		t.Fatalf("ADTS: %v", err)
+	}
+	if len(b) != ADTSHeaderLen+len(frame) || !bytes.Equal(b[ADTSHeaderLen:], frame) {
+		t.Errorf("ADTS = % x", b)
+	}
+}
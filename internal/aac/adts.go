@@ -0,0 +1,51 @@
+package aac
+
+import (
+	"fmt"
+	"io"
+
+	"rtmp-example/internal/av"
+)
+
+var _ av.Muxer = (*ADTSMuxer)(nil)
+
+// ADTSMuxer implements av.Muxer and writes the AAC frames of FLV audio
+// packets as an ADTS stream, the format of .aac files. Sequence headers
+// configure the muxer and write nothing; other packets are ignored.
+type ADTSMuxer struct {
+	config *Config
+}
+
+func NewADTSMuxer() *ADTSMuxer {
+	return &ADTSMuxer{}
+}
+
+func (m *ADTSMuxer) Mux(p *av.Packet, w io.Writer) error {
+	ah, ok := p.Header.(av.AudioPacketHeader)
+	if !p.IsAudio || !ok || ah.SoundFormat() != av.SOUND_AAC {
+		return nil
+	}
+
+	data := p.Data[2:]
+	if ah.AACPacketType() == av.AAC_SEQHDR {
+		c, err := ParseConfig(data)
+		if err != nil {
+			return err
+		}
+		if _, err := c.ADTSHeader(0); err != nil {
+			return err
+		}
+		m.config = c
+		return nil
+	}
+	if m.config == nil {
+		return fmt.Errorf("aac: frame before sequence header")
+	}
+
+	frame, err := m.config.ADTS(data)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame)
+	return err
+}
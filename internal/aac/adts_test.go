@@ -0,0 +1,80 @@
+package aac
+
+import (
+	"bytes"
+	"testing"
+
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/flv"
+)
+
+func TestADTSMuxer(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets [][]byte
+		want    []byte
+		err     bool
+	}{
+		{
+			name: "frames after the sequence header",
+			packets: [][]byte{
+				{0xaf, 0x00, 0x12, 0x10},
+				{0xaf, 0x01, 0xaa, 0xbb},
+				{0xaf, 0x01, 0xcc},
+			},
+			want: []byte{
+				0xff, 0xf1, 0x50, 0x80, 0x01, 0x3f, 0xfc, 0xaa, 0xbb,
+				0xff, 0xf1, 0x50, 0x80, 0x01, 0x1f, 0xfc, 0xcc,
+			},
+		},
+		{
+			name: "he-aac as aac lc",
+			packets: [][]byte{
+				{0xaf, 0x00, 0x2b, 0x11, 0x88, 0x00},
+				{0xaf, 0x01, 0xaa},
+			},
+			want: []byte{0xff, 0xf1, 0x58, 0x80, 0x01, 0x1f, 0xfc, 0xaa},
+		},
+		{
+			name: "other formats are ignored",
+			packets: [][]byte{
+				{0x2f, 0xff, 0xfb},
+				{0xaf, 0x00, 0x12, 0x10},
+				{0x90, 'O', 'p', 'u', 's', 0x01},
+			},
+		},
+		{
+			name:    "frame before the sequence header",
+			packets: [][]byte{{0xaf, 0x01, 0xaa}},
+			err:     true,
+		},
+		{
+			name:    "object type without adts profile",
+			packets: [][]byte{{0xaf, 0x00, 0xb9, 0x10}},
+			err:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			m := NewADTSMuxer()
+			var err error
+			for _, data := range tt.packets {
+				p := &av.Packet{IsAudio: true, Data: data}
+				if err = flv.ParseHeader(p); err != nil {
+					t.Fatalf("ParseHeader: %v", err)
+				}
+				if err = m.Mux(p, &b); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.err {
+				t.Fatalf("Mux error = %v, want error %v", err, tt.err)
+			}
+			if !bytes.Equal(b.Bytes(), tt.want) {
+				t.Errorf("Mux wrote % x, want % x", b.Bytes(), tt.want)
+			}
+		})
+	}
+}
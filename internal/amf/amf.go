@@ -5,7 +5,11 @@ import (
 	"io"
 )
 
+// DecodeBatch decodes the values of a message, until the end of r.
 func (d *Decoder) DecodeBatch(r io.Reader, ver Version) (ret []interface{}, err error) {
+	// AMF0 references do not reach beyond a message
+	d.refCache = nil
+
 	var v interface{}
 	for {
 		v, err = d.Decode(r, ver)
@@ -28,7 +32,10 @@ func (d *Decoder) Decode(r io.Reader, ver Version) (interface{}, error) {
 	return nil, fmt.Errorf("decode amf: unsupported version %d", ver)
 }
 
+// EncodeBatch encodes the values of a message, with reference tables of
+// its own.
 func (e *Encoder) EncodeBatch(w io.Writer, ver Version, val ...interface{}) (int, error) {
+	e.Reset()
 	for _, v := range val {
 		if _, err := e.Encode(w, v, ver); err != nil {
 			return 0, err
@@ -41,6 +48,8 @@ func (e *Encoder) Encode(w io.Writer, val interface{}, ver Version) (int, error)
 	switch ver {
 	case AMF0:
 		return e.EncodeAmf0(w, val)
+	case AMF3:
+		return e.EncodeAmf3(w, val)
 	}
 
 	return 0, fmt.Errorf("encode amf: unsupported version %d", ver)
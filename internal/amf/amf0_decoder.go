@@ -28,7 +28,7 @@ func (d *Decoder) DecodeAmf0(r io.Reader) (interface{}, error) {
 	case AMF0_UNDEFINED_MARKER:
 		return d.DecodeAmf0Undefined(r, false)
 	case AMF0_REFERENCE_MARKER:
-		return nil, fmt.Errorf("decode amf0: unsupported type reference")
+		return d.DecodeAmf0Reference(r, false)
 	case AMF0_ECMA_ARRAY_MARKER:
 		return d.DecodeAmf0EcmaArray(r, false)
 	case AMF0_STRICT_ARRAY_MARKER:
@@ -42,10 +42,26 @@ func (d *Decoder) DecodeAmf0(r io.Reader) (interface{}, error) {
 	case AMF0_RECORDSET_MARKER:
 		return nil, fmt.Errorf("decode amf0: unsupported type recordset")
 	case AMF0_XML_DOCUMENT_MARKER:
-		return d.DecodeAmf0XmlDocument(r, false)
+		xml, err := d.DecodeAmf0XmlDocument(r, false)
+		return XML(xml), err
 	case AMF0_TYPED_OBJECT_MARKER:
-		return d.DecodeAmf0TypedObject(r, false)
+		ref := len(d.refCache)
+		obj, err := d.DecodeAmf0TypedObject(r, false)
+		if err != nil {
+			return nil, err
+		}
+		if v, ok, err := registeredValue(obj.Type, obj.Object); ok {
+			if err == nil {
+				d.refCache[ref] = v
+			}
+			return v, err
+		}
+		return obj, nil
 	case AMF0_ACMPLUS_OBJECT_MARKER:
+		// every switched value has reference tables of its own
+		d.stringRefs = nil
+		d.objectRefs = nil
+		d.traitRefs = nil
 		return d.DecodeAmf3(r)
 	}
 
@@ -165,7 +181,6 @@ func (d *Decoder) DecodeAmf0Undefined(r io.Reader, decodeMarker bool) (result in
 
 // marker: 1 byte 0x07
 // format: 2 byte big endian uint16
-/*
 func (d *Decoder) DecodeAmf0Reference(r io.Reader, decodeMarker bool) (interface{}, error) {
 	if err := AssertMarker(r, decodeMarker, AMF0_REFERENCE_MARKER); err != nil {
 		return nil, err
@@ -179,7 +194,7 @@ func (d *Decoder) DecodeAmf0Reference(r io.Reader, decodeMarker bool) (interface
 		return nil, fmt.Errorf("decode amf0: unable to decode reference id: %s", err)
 	}
 
-	if int(ref) > len(d.refCache) {
+	if int(ref) >= len(d.refCache) {
 		return nil, fmt.Errorf("decode amf0: bad reference %d (current length %d)", ref, len(d.refCache))
 	}
 
@@ -187,7 +202,6 @@ func (d *Decoder) DecodeAmf0Reference(r io.Reader, decodeMarker bool) (interface
 
 	return result, nil
 }
-*/
 
 // marker: 1 byte 0x08
 // format:
@@ -226,7 +240,9 @@ func (d *Decoder) DecodeAmf0StrictArray(r io.Reader, decodeMarker bool) (result
 		return nil, fmt.Errorf("decode amf0: unable to decode strict array length: %s", err)
 	}
 
-	d.refCache = append(d.refCache, result)
+	// the array takes its place in the references before its elements
+	ref := len(d.refCache)
+	d.refCache = append(d.refCache, nil)
 
 	for i := uint32(0); i < length; i++ {
 		tmp, err := d.DecodeAmf0(r)
@@ -235,6 +251,7 @@ func (d *Decoder) DecodeAmf0StrictArray(r io.Reader, decodeMarker bool) (result
 		}
 		result = append(result, tmp)
 	}
+	d.refCache[ref] = result
 
 	return result, nil
 }
@@ -319,17 +336,18 @@ func (d *Decoder) DecodeAmf0TypedObject(r io.Reader, decodeMarker bool) (TypedOb
 		return result, err
 	}
 
-	d.refCache = append(d.refCache, result)
-
 	result.Type, err = d.DecodeAmf0String(r, false)
 	if err != nil {
 		return result, fmt.Errorf("decode amf0: typed object unable to determine type: %s", err)
 	}
 
+	// the object takes the place its properties take in the references
+	ref := len(d.refCache)
 	result.Object, err = d.DecodeAmf0Object(r, false)
 	if err != nil {
 		return result, fmt.Errorf("decode amf0: typed object unable to determine object: %s", err)
 	}
+	d.refCache[ref] = result
 
 	return result, nil
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"time"
 )
 
 // amf0 polymorphic router
@@ -13,11 +14,26 @@ func (e *Encoder) EncodeAmf0(w io.Writer, val interface{}) (int, error) {
 		return e.EncodeAmf0Null(w, true)
 	}
 
+	switch v := val.(type) {
+	case time.Time:
+		return e.EncodeAmf0Date(w, v, true)
+	case XML:
+		return e.EncodeAmf0XmlDocument(w, string(v), true)
+	case TypedObject:
+		return e.EncodeAmf0TypedObject(w, v, true)
+	case *TypedObject:
+		return e.EncodeAmf0TypedObject(w, *v, true)
+	}
+
 	v := reflect.ValueOf(val)
 	if !v.IsValid() {
 		return e.EncodeAmf0Null(w, true)
 	}
 
+	if n, ok, err := e.encodeAmf0Reference(w, v); ok {
+		return n, err
+	}
+
 	switch v.Kind() {
 	case reflect.String:
 		str := v.String()
@@ -42,15 +58,41 @@ func (e *Encoder) EncodeAmf0(w io.Writer, val interface{}) (int, error) {
 		}
 		return e.EncodeAmf0StrictArray(w, arr, true)
 	case reflect.Map:
+		if arr, ok := val.(EcmaArray); ok {
+			return e.EncodeAmf0EcmaArray(w, Object(arr), true)
+		}
 		obj, ok := val.(Object)
 		if ok != true {
-			return 0, fmt.Errorf("encode amf0: unable to create object from map")
+			if v.Type().Key().Kind() != reflect.String {
+				return 0, fmt.Errorf("encode amf0: unable to create object from map: unsupported key type %s", v.Type().Key())
+			}
+			if v.IsNil() {
+				return e.EncodeAmf0Null(w, true)
+			}
+			obj = make(Object, v.Len())
+			iter := v.MapRange()
+			for iter.Next() {
+				obj[iter.Key().String()] = iter.Value().Interface()
+			}
 		}
 		return e.EncodeAmf0Object(w, obj, true)
-	}
-
-	if _, ok := val.(TypedObject); ok {
-		return 0, fmt.Errorf("encode amf0: unsupported type typed object")
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return e.EncodeAmf0Null(w, true)
+		}
+		return e.EncodeAmf0(w, v.Elem().Interface())
+	case reflect.Struct:
+		// the fields are left to EncodeAmf0, which keeps the identity
+		// of the pointers among them
+		mv, err := structValue(v, func(fv reflect.Value) (interface{}, error) {
+			return fv.Interface(), nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("encode amf0: %s", err)
+		}
+		if mv != nil {
+			return e.EncodeAmf0(w, mv)
+		}
 	}
 
 	return 0, fmt.Errorf("encode amf0: unsupported type %s", v.Type())
@@ -141,6 +183,7 @@ func (e *Encoder) EncodeAmf0Object(w io.Writer, val Object, encodeMarker bool) (
 			return
 		}
 		n += 1
+		e.amf0Count++
 	}
 
 	var m int
@@ -173,6 +216,96 @@ func (e *Encoder) EncodeAmf0Object(w io.Writer, val Object, encodeMarker bool) (
 	return
 }
 
+// marker: 1 byte 0x10
+// format:
+// - class name in normal string format, without marker
+// - normal object format:
+//   - loop encoded string followed by encoded value
+//   - terminated with empty string followed by 1 byte 0x09
+func (e *Encoder) EncodeAmf0TypedObject(w io.Writer, val TypedObject, encodeMarker bool) (n int, err error) {
+	if encodeMarker {
+		if err = WriteMarker(w, AMF0_TYPED_OBJECT_MARKER); err != nil {
+			return
+		}
+		n += 1
+		e.amf0Count++
+	}
+
+	var m int
+	m, err = e.EncodeAmf0String(w, val.Type, false)
+	if err != nil {
+		return n, fmt.Errorf("encode amf0: unable to encode typed object type: %s", err)
+	}
+	n += m
+
+	m, err = e.EncodeAmf0Object(w, val.Object, false)
+	if err != nil {
+		return n, fmt.Errorf("encode amf0: unable to encode typed object object: %s", err)
+	}
+	n += m
+
+	return
+}
+
+// marker: 1 byte 0x07
+// format: 2 byte big endian uint16 index in the reference table
+func (e *Encoder) EncodeAmf0Reference(w io.Writer, val uint16, encodeMarker bool) (n int, err error) {
+	if encodeMarker {
+		if err = WriteMarker(w, AMF0_REFERENCE_MARKER); err != nil {
+			return
+		}
+		n += 1
+	}
+
+	err = binary.Write(w, binary.BigEndian, val)
+	if err != nil {
+		return n, fmt.Errorf("encode amf0: unable to encode reference: %s", err)
+	}
+	n += 2
+
+	return
+}
+
+/*
+encodeAmf0Reference writes a reference to v if it was encoded before
+and Amf0References is set. Otherwise v is added to the reference table
+when it is encoded as an object or array, which takes the next index:
+
+	objects, typed objects, ECMA arrays and strict arrays are counted,
+	in the order they start
+*/
+func (e *Encoder) encodeAmf0Reference(w io.Writer, v reflect.Value) (int, bool, error) {
+	if !e.Amf0References {
+		return 0, false, nil
+	}
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice:
+	case reflect.Ptr:
+		// pointers to dates, numbers and strings are not objects
+		if elem := v.Type().Elem(); elem.Kind() != reflect.Struct || elem == timeType {
+			return 0, false, nil
+		}
+	default:
+		return 0, false, nil
+	}
+
+	ref := e.refOf(v)
+	if ref == nil {
+		return 0, false, nil
+	}
+	if entry, ok := e.amf0Refs[ref.objectKey]; ok {
+		n, err := e.EncodeAmf0Reference(w, uint16(entry.index), true)
+		return n, true, err
+	}
+	if e.amf0Count <= AMF0_REFERENCE_MAX {
+		if e.amf0Refs == nil {
+			e.amf0Refs = make(map[objectKey]objectEntry)
+		}
+		e.amf0Refs[ref.objectKey] = objectEntry{e.amf0Count, ref.v}
+	}
+	return 0, false, nil
+}
+
 // marker: 1 byte 0x05
 // no additional data
 func (e *Encoder) EncodeAmf0Null(w io.Writer, encodeMarker bool) (n int, err error) {
@@ -211,6 +344,7 @@ func (e *Encoder) EncodeAmf0EcmaArray(w io.Writer, val Object, encodeMarker bool
 			return
 		}
 		n += 1
+		e.amf0Count++
 	}
 
 	var m int
@@ -240,6 +374,7 @@ func (e *Encoder) EncodeAmf0StrictArray(w io.Writer, val Array, encodeMarker boo
 			return
 		}
 		n += 1
+		e.amf0Count++
 	}
 
 	var m int
@@ -261,6 +396,29 @@ func (e *Encoder) EncodeAmf0StrictArray(w io.Writer, val Array, encodeMarker boo
 	return
 }
 
+// marker: 1 byte 0x0f
+// format:
+// - normal long string format
+//   - 4 byte big endian uint32 header to determine size
+//   - n (size) byte utf8 string
+func (e *Encoder) EncodeAmf0XmlDocument(w io.Writer, val string, encodeMarker bool) (n int, err error) {
+	if encodeMarker {
+		if err = WriteMarker(w, AMF0_XML_DOCUMENT_MARKER); err != nil {
+			return
+		}
+		n += 1
+	}
+
+	var m int
+	m, err = e.EncodeAmf0LongString(w, val, false)
+	if err != nil {
+		return n, fmt.Errorf("encode amf0: unable to encode xml document: %s", err)
+	}
+	n += m
+
+	return
+}
+
 // marker: 1 byte 0x0c
 // format:
 // - 4 byte big endian uint32 header to determine size
@@ -290,6 +448,34 @@ func (e *Encoder) EncodeAmf0LongString(w io.Writer, val string, encodeMarker boo
 	return
 }
 
+// marker: 1 byte 0x0b
+// format:
+// - 8 byte big endian float64, milliseconds since the epoch
+// - 2 byte big endian int16 time zone, reserved and sent as 0
+func (e *Encoder) EncodeAmf0Date(w io.Writer, val time.Time, encodeMarker bool) (n int, err error) {
+	if encodeMarker {
+		if err = WriteMarker(w, AMF0_DATE_MARKER); err != nil {
+			return
+		}
+		n += 1
+	}
+
+	ms := float64(val.UnixMilli())
+	err = binary.Write(w, binary.BigEndian, &ms)
+	if err != nil {
+		return n, fmt.Errorf("encode amf0: unable to encode date: %s", err)
+	}
+	n += 8
+
+	err = binary.Write(w, binary.BigEndian, int16(0))
+	if err != nil {
+		return n, fmt.Errorf("encode amf0: unable to encode date time zone: %s", err)
+	}
+	n += 2
+
+	return
+}
+
 // marker: 1 byte 0x0d
 // no additional data
 func (e *Encoder) EncodeAmf0Unsupported(w io.Writer, encodeMarker bool) (n int, err error) {
@@ -307,3 +493,20 @@ func (e *Encoder) EncodeAmf0Unsupported(w io.Writer, encodeMarker bool) (n int,
 func (e *Encoder) EncodeAmf0Amf3Marker(w io.Writer) error {
 	return WriteMarker(w, AMF0_ACMPLUS_OBJECT_MARKER)
 }
+
+// marker: 1 byte 0x11
+// format: amf3 encoded value, with reference tables of its own
+func (e *Encoder) EncodeAmf0Amf3(w io.Writer, val interface{}) (n int, err error) {
+	if err = e.EncodeAmf0Amf3Marker(w); err != nil {
+		return
+	}
+	n += 1
+
+	e.resetAmf3()
+
+	var m int
+	m, err = e.EncodeAmf3(w, val)
+	n += m
+
+	return
+}
@@ -0,0 +1,143 @@
+package amf
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEncodeAmf0(t *testing.T) {
+	date := time.Date(2024, 5, 6, 7, 8, 9, 123e6, time.UTC)
+
+	tests := []struct {
+		name string
+		val  interface{}
+		b    []byte
+		want interface{}
+	}{
+		{
+			name: "number",
+			val:  42,
+			b:    []byte{0x00, 0x40, 0x45, 0, 0, 0, 0, 0, 0},
+			want: 42.0,
+		},
+		{
+			name: "string",
+			val:  "abc",
+			b:    []byte{0x02, 0x00, 0x03, 'a', 'b', 'c'},
+			want: "abc",
+		},
+		{
+			name: "ecma array",
+			val:  EcmaArray{"a": true},
+			b:    []byte{0x08, 0, 0, 0, 1, 0x00, 0x01, 'a', 0x01, 0x01, 0x00, 0x00, 0x09},
+			want: Object{"a": true},
+		},
+		{
+			name: "xml document",
+			val:  XML("<a/>"),
+			b:    []byte{0x0f, 0, 0, 0, 4, '<', 'a', '/', '>'},
+			want: XML("<a/>"),
+		},
+		{
+			name: "date",
+			val:  date,
+			b:    []byte{0x0b, 0x42, 0x78, 0xf4, 0xcb, 0xb3, 0x82, 0x30, 0x00, 0x00, 0x00},
+			want: float64(date.UnixMilli()),
+		},
+		{
+			name: "null pointer",
+			val:  (*struct{})(nil),
+			b:    []byte{0x05},
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			var e Encoder
+			if _, err := e.EncodeAmf0(&b, tt.val); err != nil {
+				t.Fatalf("EncodeAmf0: %v", err)
+			}
+			if !bytes.Equal(b.Bytes(), tt.b) {
+				t.Errorf("EncodeAmf0 = % x, want % x", b.Bytes(), tt.b)
+			}
+
+			got, err := NewDecoder().DecodeAmf0(&b)
+			if err != nil {
+				t.Fatalf("DecodeAmf0: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecodeAmf0 = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeAmf0References(t *testing.T) {
+	type node struct {
+		Name string `amf:"name"`
+	}
+	shared := Object{"a": 1.0}
+	n := &node{Name: "n"}
+
+	tests := []struct {
+		name string
+		refs bool
+		val  Array
+		// reference markers expected in the encoding
+		markers int
+	}{
+		{"disabled", false, Array{shared, shared}, 0},
+		{"repeated object", true, Array{shared, shared}, 1},
+		{"repeated struct pointer", true, Array{n, shared, n}, 1},
+		{"nested array", true, Array{[]int{1}, Array{shared, shared}}, 1},
+		{"distinct objects", true, Array{Object{"a": 1.0}, Object{"a": 1.0}}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			e := Encoder{Amf0References: tt.refs}
+			if _, err := e.EncodeBatch(&b, AMF0, tt.val); err != nil {
+				t.Fatalf("EncodeBatch: %v", err)
+			}
+			if n := bytes.Count(b.Bytes(), []byte{AMF0_REFERENCE_MARKER, 0x00}); n != tt.markers {
+				t.Errorf("%d references in % x, want %d", n, b.Bytes(), tt.markers)
+			}
+
+			got, err := NewDecoder().Decode(&b, AMF0)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if arr, ok := got.(Array); !ok || len(arr) != len(tt.val) {
+				t.Errorf("Decode = %#v", got)
+			}
+		})
+	}
+}
+
+func TestEncodeAmf0ReferenceIndexes(t *testing.T) {
+	// the outer array is 0, the objects 1 and 2, the inner array 3
+	a := Object{"a": 1.0}
+	b := Object{"b": 2.0}
+	inner := []interface{}{b}
+	val := Array{a, b, inner, a, inner}
+
+	var buf bytes.Buffer
+	e := Encoder{Amf0References: true}
+	if _, err := e.EncodeAmf0(&buf, val); err != nil {
+		t.Fatalf("EncodeAmf0: %v", err)
+	}
+
+	got, err := NewDecoder().DecodeAmf0(&buf)
+	if err != nil {
+		t.Fatalf("DecodeAmf0: %v", err)
+	}
+	want := Array{a, b, Array{b}, a, Array{b}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DecodeAmf0 = %#v, want %#v", got, want)
+	}
+}
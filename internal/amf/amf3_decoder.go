@@ -30,7 +30,8 @@ func (d *Decoder) DecodeAmf3(r io.Reader) (interface{}, error) {
 	case AMF3_STRING_MARKER:
 		return d.DecodeAmf3String(r, false)
 	case AMF3_XMLDOC_MARKER:
-		return d.DecodeAmf3Xml(r, false)
+		xml, err := d.DecodeAmf3Xml(r, false)
+		return XML(xml), err
 	case AMF3_DATE_MARKER:
 		return d.DecodeAmf3Date(r, false)
 	case AMF3_ARRAY_MARKER:
@@ -38,7 +39,8 @@ func (d *Decoder) DecodeAmf3(r io.Reader) (interface{}, error) {
 	case AMF3_OBJECT_MARKER:
 		return d.DecodeAmf3Object(r, false)
 	case AMF3_XMLSTRING_MARKER:
-		return d.DecodeAmf3Xml(r, false)
+		xml, err := d.DecodeAmf3Xml(r, false)
+		return XML(xml), err
 	case AMF3_BYTEARRAY_MARKER:
 		return d.DecodeAmf3ByteArray(r, false)
 	}
@@ -132,7 +134,7 @@ func (d *Decoder) DecodeAmf3String(r io.Reader, decodeMarker bool) (result strin
 	}
 
 	buf := make([]byte, refVal)
-	_, err = r.Read(buf)
+	_, err = io.ReadFull(r, buf)
 	if err != nil {
 		return "", fmt.Errorf("amf3 decode: unable to read string: %s", err)
 	}
@@ -176,7 +178,7 @@ func (d *Decoder) DecodeAmf3Date(r io.Reader, decodeMarker bool) (result time.Ti
 		return result, fmt.Errorf("amf3 decode: unable to read double: %s", err)
 	}
 
-	result = time.Unix(int64(u64/1000), 0).UTC()
+	result = time.UnixMilli(int64(u64)).UTC()
 
 	d.objectRefs = append(d.objectRefs, result)
 
@@ -186,9 +188,12 @@ func (d *Decoder) DecodeAmf3Date(r io.Reader, decodeMarker bool) (result time.Ti
 // marker: 1 byte 0x09
 // format:
 // - u29 reference int. if reference, no more data.
-// - string representing associative array if present
+// - key value pairs of the associative part, terminated by an empty key
 // - n values (length of u29)
-func (d *Decoder) DecodeAmf3Array(r io.Reader, decodeMarker bool) (result Array, err error) {
+//
+// result is an Array, or a MixedArray when the associative part is not
+// empty.
+func (d *Decoder) DecodeAmf3Array(r io.Reader, decodeMarker bool) (result interface{}, err error) {
 	if err = AssertMarker(r, decodeMarker, AMF3_ARRAY_MARKER); err != nil {
 		return
 	}
@@ -201,35 +206,55 @@ func (d *Decoder) DecodeAmf3Array(r io.Reader, decodeMarker bool) (result Array,
 	}
 
 	if isRef {
-		objRefId := refVal >> 1
-
-		res, ok := d.objectRefs[objRefId].(Array)
-		if ok != true {
-			return result, fmt.Errorf("amf3 decode: unable to extract array from object references")
+		if int(refVal) >= len(d.objectRefs) {
+			return result, fmt.Errorf("amf3 decode: invalid array reference %d", refVal)
 		}
-
-		return res, err
+		switch res := d.objectRefs[refVal].(type) {
+		case Array, MixedArray:
+			return res, nil
+		}
+		return result, fmt.Errorf("amf3 decode: unable to extract array from object references")
 	}
 
-	var key string
-	key, err = d.DecodeAmf3String(r, false)
-	if err != nil {
-		return result, fmt.Errorf("amf3 decode: unable to read key for array: %s", err)
-	}
+	// the array takes its place in the references before its elements
+	ref := len(d.objectRefs)
+	d.objectRefs = append(d.objectRefs, nil)
 
-	if key != "" {
-		return result, fmt.Errorf("amf3 decode: array key is not empty, can't handle associative array")
+	var assoc Object
+	for {
+		var key string
+		key, err = d.DecodeAmf3String(r, false)
+		if err != nil {
+			return result, fmt.Errorf("amf3 decode: unable to read key for array: %s", err)
+		}
+		if key == "" {
+			break
+		}
+
+		val, err := d.DecodeAmf3(r)
+		if err != nil {
+			return result, fmt.Errorf("amf3 decode: unable to decode array value: %s", err)
+		}
+		if assoc == nil {
+			assoc = make(Object)
+		}
+		assoc[key] = val
 	}
 
+	dense := make(Array, 0, refVal)
 	for i := uint32(0); i < refVal; i++ {
 		tmp, err := d.DecodeAmf3(r)
 		if err != nil {
 			return result, fmt.Errorf("amf3 decode: array element could not be decoded: %s", err)
 		}
-		result = append(result, tmp)
+		dense = append(dense, tmp)
 	}
 
-	d.objectRefs = append(d.objectRefs, result)
+	result = dense
+	if assoc != nil {
+		result = MixedArray{Dense: dense, Associative: assoc}
+	}
+	d.objectRefs[ref] = result
 
 	return
 }
@@ -249,9 +274,10 @@ func (d *Decoder) DecodeAmf3Object(r io.Reader, decodeMarker bool) (result inter
 
 	// if this is a object reference only, grab it and return it
 	if isRef {
-		objRefId := refVal >> 1
-
-		return d.objectRefs[objRefId], nil
+		if int(refVal) >= len(d.objectRefs) {
+			return nil, fmt.Errorf("amf3 decode: invalid object reference %d", refVal)
+		}
+		return d.objectRefs[refVal], nil
 	}
 
 	// each type has traits that are cached, if the peer sent a reference
@@ -262,6 +288,9 @@ func (d *Decoder) DecodeAmf3Object(r io.Reader, decodeMarker bool) (result inter
 
 	if traitIsRef {
 		traitRef := refVal >> 1
+		if int(traitRef) >= len(d.traitRefs) {
+			return nil, fmt.Errorf("amf3 decode: invalid trait reference %d", traitRef)
+		}
 		trait = d.traitRefs[traitRef]
 
 	} else {
@@ -290,7 +319,9 @@ func (d *Decoder) DecodeAmf3Object(r io.Reader, decodeMarker bool) (result inter
 		d.traitRefs = append(d.traitRefs, trait)
 	}
 
-	d.objectRefs = append(d.objectRefs, result)
+	// the object takes its place in the references before its properties
+	ref := len(d.objectRefs)
+	d.objectRefs = append(d.objectRefs, nil)
 
 	// objects can be externalizable, meaning that the system has no concrete understanding of
 	// their properties or how they are encoded. in that case, we need to find and delegate behavior
@@ -328,6 +359,7 @@ func (d *Decoder) DecodeAmf3Object(r io.Reader, decodeMarker bool) (result inter
 			}
 		}
 
+		d.objectRefs[ref] = result
 		return result, err
 	}
 
@@ -336,6 +368,7 @@ func (d *Decoder) DecodeAmf3Object(r io.Reader, decodeMarker bool) (result inter
 	var obj Object
 
 	obj = make(Object)
+	d.objectRefs[ref] = obj
 
 	// non-externalizable objects have property keys in traits, iterate through them
 	// and add the read values to the object
@@ -368,6 +401,15 @@ func (d *Decoder) DecodeAmf3Object(r io.Reader, decodeMarker bool) (result inter
 		}
 	}
 
+	// instances of registered classes become their Go type
+	if v, ok, err := registeredValue(trait.Type, obj); ok {
+		if err != nil {
+			return nil, fmt.Errorf("amf3 decode: %s", err)
+		}
+		d.objectRefs[ref] = v
+		return v, nil
+	}
+
 	result = obj
 
 	return
@@ -409,16 +451,14 @@ func (d *Decoder) DecodeAmf3Xml(r io.Reader, decodeMarker bool) (result string,
 	}
 
 	buf := make([]byte, refVal)
-	_, err = r.Read(buf)
+	_, err = io.ReadFull(r, buf)
 	if err != nil {
 		return "", fmt.Errorf("amf3 decode: unable to read xml string: %s", err)
 	}
 
 	result = string(buf)
 
-	if result != "" {
-		d.objectRefs = append(d.objectRefs, result)
-	}
+	d.objectRefs = append(d.objectRefs, result)
 
 	return
 }
@@ -450,7 +490,7 @@ func (d *Decoder) DecodeAmf3ByteArray(r io.Reader, decodeMarker bool) (result []
 	}
 
 	result = make([]byte, refVal)
-	_, err = r.Read(result)
+	_, err = io.ReadFull(r, result)
 	if err != nil {
 		return result, fmt.Errorf("amf3 decode: unable to read bytearray: %s", err)
 	}
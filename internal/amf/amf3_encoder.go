@@ -0,0 +1,602 @@
+package amf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// objectKey identifies a map, slice or struct pointer in the reference
+// tables.
+type objectKey struct {
+	ptr uintptr
+	len int
+	typ reflect.Type
+}
+
+// objectRef is a map, slice or struct pointer with its key.
+type objectRef struct {
+	objectKey
+	v reflect.Value
+}
+
+// objectEntry is an entry of a reference table. It holds the object,
+// so that its address is not reused by another one, such as a later
+// temporary of MarshalValue, while the table lives.
+type objectEntry struct {
+	index int
+	v     reflect.Value
+}
+
+const (
+	amf3IntMin    = -1 << 28
+	amf3IntMax    = 1<<28 - 1
+	amf3LengthMax = 1<<28 - 1
+)
+
+// amf3 polymorphic router
+//
+// Go values map to AMF3 types as follows: integers within 29 bits to
+// integer and other numbers to double, XML to xml, time.Time to date,
+// []byte to byte array, slices and MixedArray to array, Object and
+// other maps with string keys to anonymous dynamic objects, and
+// TypedObject to a sealed object of its properties. Structs are
+// converted by MarshalValue.
+//
+// Strings, objects and traits seen before on this encoder are sent as
+// references, as the decoder expects when it reads them back.
+func (e *Encoder) EncodeAmf3(w io.Writer, val interface{}) (int, error) {
+	switch v := val.(type) {
+	case nil:
+		return e.EncodeAmf3Null(w, true)
+	case XML:
+		return e.EncodeAmf3Xml(w, string(v), true)
+	case time.Time:
+		return e.EncodeAmf3Date(w, v, true)
+	case []byte:
+		return e.EncodeAmf3ByteArray(w, v, true)
+	case MixedArray:
+		return e.EncodeAmf3MixedArray(w, v, true)
+	case *MixedArray:
+		return e.EncodeAmf3MixedArray(w, *v, true)
+	case TypedObject:
+		return e.EncodeAmf3TypedObject(w, v, true)
+	case *TypedObject:
+		return e.EncodeAmf3TypedObject(w, *v, true)
+	case Object:
+		return e.EncodeAmf3Object(w, v, true)
+	case Array:
+		return e.EncodeAmf3Array(w, v, true)
+	}
+
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.String:
+		return e.EncodeAmf3String(w, v.String(), true)
+	case reflect.Bool:
+		if v.Bool() {
+			return e.EncodeAmf3True(w, true)
+		}
+		return e.EncodeAmf3False(w, true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i := v.Int(); i >= amf3IntMin && i <= amf3IntMax {
+			return e.EncodeAmf3Integer(w, int32(i), true)
+		}
+		return e.EncodeAmf3Double(w, float64(v.Int()), true)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if u := v.Uint(); u <= amf3IntMax {
+			return e.EncodeAmf3Integer(w, int32(u), true)
+		}
+		return e.EncodeAmf3Double(w, float64(v.Uint()), true)
+	case reflect.Float32, reflect.Float64:
+		return e.EncodeAmf3Double(w, v.Float(), true)
+	case reflect.Array, reflect.Slice:
+		arr := make(Array, v.Len())
+		for i := range arr {
+			arr[i] = v.Index(i).Interface()
+		}
+		if v.Kind() == reflect.Slice {
+			return e.encodeAmf3Array(w, arr, nil, e.refOf(v), true)
+		}
+		return e.EncodeAmf3Array(w, arr, true)
+	case reflect.Struct, reflect.Ptr, reflect.Interface:
+		mv, err := MarshalValue(val)
+		if err != nil {
+			return 0, fmt.Errorf("encode amf3: %s", err)
+		}
+		return e.EncodeAmf3(w, mv)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return 0, fmt.Errorf("encode amf3: unsupported map key type %s", v.Type().Key())
+		}
+		obj := make(Object, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			obj[iter.Key().String()] = iter.Value().Interface()
+		}
+		return e.encodeAmf3Object(w, "", nil, obj, e.refOf(v), true)
+	}
+
+	return 0, fmt.Errorf("encode amf3: unsupported type %s", v.Type())
+}
+
+// marker: 1 byte 0x00
+// no additional data
+func (e *Encoder) EncodeAmf3Undefined(w io.Writer, encodeMarker bool) (n int, err error) {
+	return e.encodeAmf3Marker(w, encodeMarker, AMF3_UNDEFINED_MARKER)
+}
+
+// marker: 1 byte 0x01
+// no additional data
+func (e *Encoder) EncodeAmf3Null(w io.Writer, encodeMarker bool) (n int, err error) {
+	return e.encodeAmf3Marker(w, encodeMarker, AMF3_NULL_MARKER)
+}
+
+// marker: 1 byte 0x02
+// no additional data
+func (e *Encoder) EncodeAmf3False(w io.Writer, encodeMarker bool) (n int, err error) {
+	return e.encodeAmf3Marker(w, encodeMarker, AMF3_FALSE_MARKER)
+}
+
+// marker: 1 byte 0x03
+// no additional data
+func (e *Encoder) EncodeAmf3True(w io.Writer, encodeMarker bool) (n int, err error) {
+	return e.encodeAmf3Marker(w, encodeMarker, AMF3_TRUE_MARKER)
+}
+
+// marker: 1 byte 0x04
+// format: u29, two's complement on 29 bits
+func (e *Encoder) EncodeAmf3Integer(w io.Writer, val int32, encodeMarker bool) (n int, err error) {
+	if val < amf3IntMin || val > amf3IntMax {
+		return 0, fmt.Errorf("encode amf3: integer %d out of range", val)
+	}
+
+	if n, err = e.encodeAmf3Marker(w, encodeMarker, AMF3_INTEGER_MARKER); err != nil {
+		return
+	}
+
+	var m int
+	m, err = e.encodeU29(w, uint32(val)&0x1fffffff)
+	n += m
+
+	return
+}
+
+// marker: 1 byte 0x05
+// format: 8 byte big endian float64
+func (e *Encoder) EncodeAmf3Double(w io.Writer, val float64, encodeMarker bool) (n int, err error) {
+	if n, err = e.encodeAmf3Marker(w, encodeMarker, AMF3_DOUBLE_MARKER); err != nil {
+		return
+	}
+
+	err = binary.Write(w, binary.BigEndian, &val)
+	if err != nil {
+		return n, fmt.Errorf("encode amf3: unable to write double: %s", err)
+	}
+	n += 8
+
+	return
+}
+
+// marker: 1 byte 0x06
+// format:
+//   - u29 reference int. if reference, no more data. if not reference,
+//     length value of bytes of the string that follows.
+//   - the empty string is never sent by reference
+func (e *Encoder) EncodeAmf3String(w io.Writer, val string, encodeMarker bool) (n int, err error) {
+	if n, err = e.encodeAmf3Marker(w, encodeMarker, AMF3_STRING_MARKER); err != nil {
+		return
+	}
+
+	var m int
+	if i, ok := e.stringRefs[val]; ok {
+		m, err = e.encodeU29(w, uint32(i)<<1)
+		n += m
+		return
+	}
+	if len(val) > amf3LengthMax {
+		return n, fmt.Errorf("encode amf3: string too long: %d bytes", len(val))
+	}
+
+	m, err = e.encodeU29(w, uint32(len(val))<<1|0x01)
+	n += m
+	if err != nil {
+		return
+	}
+
+	m, err = io.WriteString(w, val)
+	n += m
+	if err != nil {
+		return n, fmt.Errorf("encode amf3: unable to write string: %s", err)
+	}
+
+	if val != "" {
+		if e.stringRefs == nil {
+			e.stringRefs = make(map[string]int)
+		}
+		e.stringRefs[val] = len(e.stringRefs)
+	}
+
+	return
+}
+
+// marker: 1 byte 0x0b
+// format:
+// - u29 length of the xml string that follows, always sent inline
+func (e *Encoder) EncodeAmf3Xml(w io.Writer, val string, encodeMarker bool) (n int, err error) {
+	if n, err = e.encodeAmf3Marker(w, encodeMarker, AMF3_XMLSTRING_MARKER); err != nil {
+		return
+	}
+	if len(val) > amf3LengthMax {
+		return n, fmt.Errorf("encode amf3: xml too long: %d bytes", len(val))
+	}
+
+	var m int
+	m, err = e.encodeU29(w, uint32(len(val))<<1|0x01)
+	n += m
+	if err != nil {
+		return
+	}
+
+	m, err = io.WriteString(w, val)
+	n += m
+	if err != nil {
+		return n, fmt.Errorf("encode amf3: unable to write xml: %s", err)
+	}
+
+	e.addObject(nil)
+
+	return
+}
+
+// marker: 1 byte 0x08
+// format:
+// - u29 0x01, dates are always sent inline
+// - milliseconds since the epoch as a double
+func (e *Encoder) EncodeAmf3Date(w io.Writer, val time.Time, encodeMarker bool) (n int, err error) {
+	if n, err = e.encodeAmf3Marker(w, encodeMarker, AMF3_DATE_MARKER); err != nil {
+		return
+	}
+
+	var m int
+	m, err = e.encodeU29(w, 0x01)
+	n += m
+	if err != nil {
+		return
+	}
+
+	ms := float64(val.UnixMilli())
+	err = binary.Write(w, binary.BigEndian, &ms)
+	if err != nil {
+		return n, fmt.Errorf("encode amf3: unable to write date: %s", err)
+	}
+	n += 8
+
+	e.addObject(nil)
+
+	return
+}
+
+// marker: 1 byte 0x09
+// format:
+// - u29 reference int. if reference, no more data.
+// - dense length, empty associative part
+// - n values (length of u29)
+func (e *Encoder) EncodeAmf3Array(w io.Writer, val Array, encodeMarker bool) (n int, err error) {
+	return e.encodeAmf3Array(w, val, nil, e.refOf(reflect.ValueOf(val)), encodeMarker)
+}
+
+// marker: 1 byte 0x09
+// format:
+// - u29 reference int. if reference, no more data.
+// - dense length, then key value pairs terminated by an empty key
+// - n values (length of u29)
+func (e *Encoder) EncodeAmf3MixedArray(w io.Writer, val MixedArray, encodeMarker bool) (n int, err error) {
+	return e.encodeAmf3Array(w, val.Dense, val.Associative, e.refOf(reflect.ValueOf(val.Dense)), encodeMarker)
+}
+
+func (e *Encoder) encodeAmf3Array(w io.Writer, dense Array, assoc Object, ref *objectRef, encodeMarker bool) (n int, err error) {
+	if n, err = e.encodeAmf3Marker(w, encodeMarker, AMF3_ARRAY_MARKER); err != nil {
+		return
+	}
+
+	var m int
+	if assoc == nil {
+		if m, err = e.encodeObjectRef(w, ref); m > 0 || err != nil {
+			n += m
+			return
+		}
+	}
+	if len(dense) > amf3LengthMax {
+		return n, fmt.Errorf("encode amf3: array too long: %d elements", len(dense))
+	}
+
+	m, err = e.encodeU29(w, uint32(len(dense))<<1|0x01)
+	n += m
+	if err != nil {
+		return
+	}
+
+	// arrays with an associative part have no identity of their own
+	if assoc != nil {
+		ref = nil
+	}
+	e.addObject(ref)
+
+	for _, k := range sortedKeys(assoc) {
+		if k == "" {
+			return n, fmt.Errorf("encode amf3: empty array key")
+		}
+		m, err = e.EncodeAmf3String(w, k, false)
+		n += m
+		if err != nil {
+			return n, fmt.Errorf("encode amf3: unable to encode array key: %s", err)
+		}
+
+		m, err = e.EncodeAmf3(w, assoc[k])
+		n += m
+		if err != nil {
+			return n, fmt.Errorf("encode amf3: unable to encode array value: %s", err)
+		}
+	}
+
+	m, err = e.EncodeAmf3String(w, "", false)
+	n += m
+	if err != nil {
+		return
+	}
+
+	for _, v := range dense {
+		m, err = e.EncodeAmf3(w, v)
+		n += m
+		if err != nil {
+			return n, fmt.Errorf("encode amf3: unable to encode array element: %s", err)
+		}
+	}
+
+	return
+}
+
+// marker: 1 byte 0x0a
+// format:
+// - u29 reference int. if reference, no more data.
+// - trait of an anonymous dynamic object, or trait reference
+// - key value pairs terminated by an empty key
+func (e *Encoder) EncodeAmf3Object(w io.Writer, val Object, encodeMarker bool) (n int, err error) {
+	return e.encodeAmf3Object(w, "", nil, val, e.refOf(reflect.ValueOf(val)), encodeMarker)
+}
+
+// marker: 1 byte 0x0a
+// format:
+//   - u29 reference int. if reference, no more data.
+//   - trait of a sealed object of class val.Type with the properties of
+//     val.Object in key order, or trait reference
+//   - values of the properties in trait order
+func (e *Encoder) EncodeAmf3TypedObject(w io.Writer, val TypedObject, encodeMarker bool) (n int, err error) {
+	return e.encodeAmf3Object(w, val.Type, sortedKeys(val.Object), val.Object, e.refOf(reflect.ValueOf(val.Object)), encodeMarker)
+}
+
+/*
+encodeAmf3Object encodes an object of class, whose sealed properties
+are named by sealed, in order. Without sealed properties the object is
+dynamic and every value of props is sent as a key value pair.
+
+	u29 object header:
+	+-----------------------+-------------+---------+-----------+---------+
+	| sealed count (25 bits)| dynamic (1) | ext (1) | trait (1) | ref (1) |
+	+-----------------------+-------------+---------+-----------+---------+
+*/
+func (e *Encoder) encodeAmf3Object(w io.Writer, class string, sealed []string, props Object, ref *objectRef, encodeMarker bool) (n int, err error) {
+	if n, err = e.encodeAmf3Marker(w, encodeMarker, AMF3_OBJECT_MARKER); err != nil {
+		return
+	}
+
+	var m int
+	if m, err = e.encodeObjectRef(w, ref); m > 0 || err != nil {
+		n += m
+		return
+	}
+	dynamic := len(sealed) == 0
+
+	key := class + "\x00" + strings.Join(sealed, "\x00")
+	if i, ok := e.traitRefs[key]; ok {
+		m, err = e.encodeU29(w, uint32(i)<<2|0x01)
+		n += m
+		if err != nil {
+			return
+		}
+	} else {
+		if len(sealed) > 1<<25-1 {
+			return n, fmt.Errorf("encode amf3: too many sealed properties: %d", len(sealed))
+		}
+		header := uint32(len(sealed))<<4 | 0x03
+		if dynamic {
+			header |= 0x08
+		}
+		m, err = e.encodeU29(w, header)
+		n += m
+		if err != nil {
+			return
+		}
+
+		m, err = e.EncodeAmf3String(w, class, false)
+		n += m
+		if err != nil {
+			return n, fmt.Errorf("encode amf3: unable to encode trait type: %s", err)
+		}
+		for _, k := range sealed {
+			m, err = e.EncodeAmf3String(w, k, false)
+			n += m
+			if err != nil {
+				return n, fmt.Errorf("encode amf3: unable to encode trait property: %s", err)
+			}
+		}
+
+		if e.traitRefs == nil {
+			e.traitRefs = make(map[string]int)
+		}
+		e.traitRefs[key] = len(e.traitRefs)
+	}
+
+	e.addObject(ref)
+
+	for _, k := range sealed {
+		m, err = e.EncodeAmf3(w, props[k])
+		n += m
+		if err != nil {
+			return n, fmt.Errorf("encode amf3: unable to encode object property: %s", err)
+		}
+	}
+
+	if !dynamic {
+		return
+	}
+
+	for _, k := range sortedKeys(props) {
+		if k == "" {
+			return n, fmt.Errorf("encode amf3: empty object key")
+		}
+		m, err = e.EncodeAmf3String(w, k, false)
+		n += m
+		if err != nil {
+			return n, fmt.Errorf("encode amf3: unable to encode dynamic key: %s", err)
+		}
+
+		m, err = e.EncodeAmf3(w, props[k])
+		n += m
+		if err != nil {
+			return n, fmt.Errorf("encode amf3: unable to encode dynamic value: %s", err)
+		}
+	}
+
+	m, err = e.EncodeAmf3String(w, "", false)
+	n += m
+
+	return
+}
+
+// marker: 1 byte 0x0c
+// format:
+//   - u29 reference int. if reference, no more data. if not reference,
+//     length value of bytes that follow.
+func (e *Encoder) EncodeAmf3ByteArray(w io.Writer, val []byte, encodeMarker bool) (n int, err error) {
+	if n, err = e.encodeAmf3Marker(w, encodeMarker, AMF3_BYTEARRAY_MARKER); err != nil {
+		return
+	}
+
+	var m int
+	ref := e.refOf(reflect.ValueOf(val))
+	if m, err = e.encodeObjectRef(w, ref); m > 0 || err != nil {
+		n += m
+		return
+	}
+	if len(val) > amf3LengthMax {
+		return n, fmt.Errorf("encode amf3: byte array too long: %d bytes", len(val))
+	}
+
+	m, err = e.encodeU29(w, uint32(len(val))<<1|0x01)
+	n += m
+	if err != nil {
+		return
+	}
+
+	m, err = w.Write(val)
+	n += m
+	if err != nil {
+		return n, fmt.Errorf("encode amf3: unable to write byte array: %s", err)
+	}
+
+	e.addObject(ref)
+
+	return
+}
+
+func (e *Encoder) encodeAmf3Marker(w io.Writer, encodeMarker bool, marker byte) (n int, err error) {
+	if !encodeMarker {
+		return 0, nil
+	}
+	if err = WriteMarker(w, marker); err != nil {
+		return
+	}
+	return 1, nil
+}
+
+// encodeU29 writes a variable length 29 bit integer: 7 bits per byte
+// with a continuation bit, the fourth byte holding 8 bits.
+func (e *Encoder) encodeU29(w io.Writer, val uint32) (int, error) {
+	var b []byte
+	switch {
+	case val < 0x80:
+		b = []byte{byte(val)}
+	case val < 0x4000:
+		b = []byte{byte(val>>7) | 0x80, byte(val) & 0x7f}
+	case val < 0x200000:
+		b = []byte{byte(val>>14) | 0x80, byte(val>>7) | 0x80, byte(val) & 0x7f}
+	case val < 0x20000000:
+		b = []byte{byte(val>>22) | 0x80, byte(val>>15) | 0x80, byte(val>>8) | 0x80, byte(val)}
+	default:
+		return 0, fmt.Errorf("encode amf3: u29 out of range: %d", val)
+	}
+	return WriteBytes(w, b)
+}
+
+// refOf returns the identity of the map, slice or pointer v, or nil
+// when it has none, such as an empty slice.
+func (e *Encoder) refOf(v reflect.Value) *objectRef {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		// a struct and its first field share their address
+		return &objectRef{objectKey{ptr: v.Pointer(), typ: v.Type()}, v}
+	case reflect.Map, reflect.Slice:
+		if v.IsNil() || v.Pointer() == 0 {
+			return nil
+		}
+		ref := &objectRef{objectKey{ptr: v.Pointer()}, v}
+		if v.Kind() == reflect.Slice {
+			ref.len = v.Len()
+		}
+		return ref
+	}
+	return nil
+}
+
+// encodeObjectRef writes a reference to ref if it was encoded before,
+// and returns the number of bytes written.
+func (e *Encoder) encodeObjectRef(w io.Writer, ref *objectRef) (int, error) {
+	if ref == nil {
+		return 0, nil
+	}
+	entry, ok := e.objectRefs[ref.objectKey]
+	if !ok {
+		return 0, nil
+	}
+	return e.encodeU29(w, uint32(entry.index)<<1)
+}
+
+// addObject appends an entry to the object reference table, which ref
+// identifies if not nil.
+func (e *Encoder) addObject(ref *objectRef) {
+	if ref != nil {
+		if e.objectRefs == nil {
+			e.objectRefs = make(map[objectKey]objectEntry)
+		}
+		e.objectRefs[ref.objectKey] = objectEntry{e.objectCount, ref.v}
+	}
+	e.objectCount++
+}
+
+func sortedKeys(obj Object) []string {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,172 @@
+package amf
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEncodeAmf3RoundTrip(t *testing.T) {
+	date := time.Date(2024, 5, 6, 7, 8, 9, 123e6, time.UTC)
+	shared := Object{"k": "v"}
+	data := []byte{1, 2, 3}
+
+	tests := []struct {
+		name string
+		val  []interface{}
+		want []interface{}
+	}{
+		{
+			name: "scalars",
+			val:  []interface{}{nil, true, false, "", "abc"},
+			want: []interface{}{nil, true, false, "", "abc"},
+		},
+		{
+			name: "integers",
+			val:  []interface{}{0, 127, 128, 16383, 16384, amf3IntMax, amf3IntMin, -1, uint8(200)},
+			want: []interface{}{int32(0), int32(127), int32(128), int32(16383), int32(16384), int32(amf3IntMax), int32(amf3IntMin), int32(-1), int32(200)},
+		},
+		{
+			name: "doubles",
+			val:  []interface{}{1.5, amf3IntMax + 1, amf3IntMin - 1, uint64(math.MaxUint32), math.Inf(-1)},
+			want: []interface{}{1.5, float64(amf3IntMax + 1), float64(amf3IntMin - 1), float64(math.MaxUint32), math.Inf(-1)},
+		},
+		{
+			name: "string references",
+			val:  []interface{}{"abc", "def", "abc", Object{"abc": "def"}},
+			want: []interface{}{"abc", "def", "abc", Object{"abc": "def"}},
+		},
+		{
+			name: "dates, xml and byte arrays",
+			val:  []interface{}{date, XML("<a/>"), data, data, date},
+			want: []interface{}{date, XML("<a/>"), data, data, date},
+		},
+		{
+			name: "arrays",
+			val:  []interface{}{Array{int32(1), "a", Array{}}, []string{"x", "y"}, [2]bool{true, false}},
+			want: []interface{}{Array{int32(1), "a", Array{}}, Array{"x", "y"}, Array{true, false}},
+		},
+		{
+			name: "mixed array",
+			val:  []interface{}{MixedArray{Dense: Array{"a"}, Associative: Object{"k": int32(1)}}},
+			want: []interface{}{MixedArray{Dense: Array{"a"}, Associative: Object{"k": int32(1)}}},
+		},
+		{
+			name: "object references",
+			val:  []interface{}{Array{shared, shared}, shared},
+			want: []interface{}{Array{shared, shared}, shared},
+		},
+		{
+			name: "typed objects and trait references",
+			val: []interface{}{
+				TypedObject{Type: "a.B", Object: Object{"x": 1, "y": "z"}},
+				TypedObject{Type: "a.B", Object: Object{"x": 2, "y": "w"}},
+			},
+			want: []interface{}{Object{"x": int32(1), "y": "z"}, Object{"x": int32(2), "y": "w"}},
+		},
+		{
+			name: "maps",
+			val:  []interface{}{map[string]int{"a": 1}, map[string]string{}},
+			want: []interface{}{Object{"a": int32(1)}, Object{}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			var e Encoder
+			if _, err := e.EncodeBatch(&b, AMF3, tt.val...); err != nil {
+				t.Fatalf("EncodeBatch: %v", err)
+			}
+
+			d := NewDecoder()
+			for i, want := range tt.want {
+				got, err := d.DecodeAmf3(&b)
+				if err != nil {
+					t.Fatalf("value %d: DecodeAmf3: %v", i, err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("value %d: DecodeAmf3 = %#v, want %#v", i, got, want)
+				}
+			}
+			if b.Len() != 0 {
+				t.Errorf("%d bytes left", b.Len())
+			}
+		})
+	}
+}
+
+func TestEncodeAmf3References(t *testing.T) {
+	obj := Object{"a": "a"}
+
+	tests := []struct {
+		name string
+		val  []interface{}
+		b    []byte
+	}{
+		{
+			name: "string",
+			val:  []interface{}{"ab", "ab", ""},
+			b:    []byte{0x06, 0x05, 'a', 'b', 0x06, 0x00, 0x06, 0x01},
+		},
+		{
+			name: "object and its key",
+			val:  []interface{}{obj, obj},
+			b:    []byte{0x0a, 0x0b, 0x01, 0x03, 'a', 0x06, 0x00, 0x01, 0x0a, 0x00},
+		},
+		{
+			name: "trait",
+			val: []interface{}{
+				TypedObject{Type: "C", Object: Object{"p": true}},
+				TypedObject{Type: "C", Object: Object{"p": false}},
+			},
+			b: []byte{0x0a, 0x13, 0x03, 'C', 0x03, 'p', 0x03, 0x0a, 0x01, 0x02},
+		},
+		{
+			name: "date and byte array count as objects",
+			val:  []interface{}{time.UnixMilli(0), []byte{7}, obj, obj},
+			b: []byte{
+				0x08, 0x01, 0, 0, 0, 0, 0, 0, 0, 0,
+				0x0c, 0x03, 7,
+				0x0a, 0x0b, 0x01, 0x03, 'a', 0x06, 0x00, 0x01,
+				0x0a, 0x04,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			var e Encoder
+			if _, err := e.EncodeBatch(&b, AMF3, tt.val...); err != nil {
+				t.Fatalf("EncodeBatch: %v", err)
+			}
+			if !bytes.Equal(b.Bytes(), tt.b) {
+				t.Errorf("EncodeBatch = % x, want % x", b.Bytes(), tt.b)
+			}
+		})
+	}
+}
+
+func TestDecodeAmf3SharedObject(t *testing.T) {
+	shared := Object{"k": "v"}
+
+	var b bytes.Buffer
+	var e Encoder
+	if _, err := e.EncodeAmf3(&b, Array{shared, shared}); err != nil {
+		t.Fatalf("EncodeAmf3: %v", err)
+	}
+	got, err := NewDecoder().DecodeAmf3(&b)
+	if err != nil {
+		t.Fatalf("DecodeAmf3: %v", err)
+	}
+
+	arr := got.(Array)
+	first, second := arr[0].(Object), arr[1].(Object)
+	first["k"] = "changed"
+	if second["k"] != "changed" {
+		t.Errorf("the reference decoded to another object")
+	}
+}
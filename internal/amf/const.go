@@ -32,6 +32,7 @@ const (
 	AMF0_BOOLEAN_FALSE = 0x00
 	AMF0_BOOLEAN_TRUE  = 0x01
 	AMF0_STRING_MAX    = 65535
+	AMF0_REFERENCE_MAX = 65535
 	AMF3_INTEGER_MAX   = 536870911
 )
 
@@ -71,7 +72,33 @@ func (d *Decoder) RegisterExternalHandler(name string, f ExternalHandler) {
 	d.externalHandlers[name] = f
 }
 
+// Encoder keeps the reference tables of the values encoded so far, the
+// zero value is ready to use.
 type Encoder struct {
+	// Amf0References makes EncodeAmf0 send the maps, slices and struct
+	// pointers it encoded before as references, until Reset.
+	Amf0References bool
+
+	amf0Refs    map[objectKey]objectEntry
+	amf0Count   int
+	stringRefs  map[string]int
+	objectRefs  map[objectKey]objectEntry
+	objectCount int
+	traitRefs   map[string]int
+}
+
+// Reset clears the reference tables, as at the start of a message.
+func (e *Encoder) Reset() {
+	e.amf0Refs = nil
+	e.amf0Count = 0
+	e.resetAmf3()
+}
+
+func (e *Encoder) resetAmf3() {
+	e.stringRefs = nil
+	e.objectRefs = nil
+	e.objectCount = 0
+	e.traitRefs = nil
 }
 
 type Version uint8
@@ -79,6 +106,21 @@ type Version uint8
 type Array []interface{}
 type Object map[string]interface{}
 
+// MixedArray is an AMF3 array with an associative part, string keys
+// sent before the dense values.
+type MixedArray struct {
+	Dense       Array
+	Associative Object
+}
+
+// XML is an XML document, sent as AMF0 XML document or AMF3 XML rather
+// than a string.
+type XML string
+
+// EcmaArray is an Object sent as an AMF0 ECMA array, as stream metadata
+// is, rather than an anonymous object.
+type EcmaArray Object
+
 type TypedObject struct {
 	Type   string
 	Object Object
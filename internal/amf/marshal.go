@@ -0,0 +1,438 @@
+package amf
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Marshal returns the encoding of v.
+//
+// Structs are encoded as objects of their exported fields, named by
+// the amf struct tag or the field name:
+//
+//	Field int `amf:"field"`            // key "field"
+//	Field int `amf:"field,omitempty"`  // omitted when empty
+//	Field int `amf:"-"`                // never encoded
+//
+// The fields of embedded structs without a tag are promoted, the
+// shallowest one winning when names collide. Nested structs, maps with
+// string keys, slices, arrays and pointers are converted recursively,
+// time.Time is encoded as a date.
+func Marshal(v interface{}, ver Version) ([]byte, error) {
+	var b bytes.Buffer
+	var e Encoder
+	if _, err := e.Encode(&b, v, ver); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Unmarshal decodes the first value of data and stores it in the value
+// pointed to by v, as UnmarshalValue does.
+func Unmarshal(data []byte, v interface{}, ver Version) error {
+	val, err := NewDecoder().Decode(bytes.NewReader(data), ver)
+	if err != nil {
+		return err
+	}
+	return UnmarshalValue(val, v)
+}
+
+// MarshalValue converts v to the generic values the encoders take:
+// Object for structs and maps, TypedObject for structs of a type given
+// to RegisterType, Array for slices and arrays, and nil for nil
+// pointers, slices and maps.
+func MarshalValue(v interface{}) (interface{}, error) {
+	return marshalValue(reflect.ValueOf(v))
+}
+
+func marshalValue(v reflect.Value) (interface{}, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return marshalValue(v.Elem())
+	case reflect.Struct:
+		switch val := v.Interface().(type) {
+		case time.Time, TypedObject, MixedArray:
+			return val, nil
+		}
+		return structValue(v, marshalValue)
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Bytes(), nil
+		}
+		fallthrough
+	case reflect.Array:
+		arr := make(Array, v.Len())
+		for i := range arr {
+			val, err := marshalValue(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = val
+		}
+		return arr, nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("amf: unsupported map key type %s", v.Type().Key())
+		}
+		if v.IsNil() {
+			return nil, nil
+		}
+		obj := make(Object, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			val, err := marshalValue(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			obj[iter.Key().String()] = val
+		}
+		return obj, nil
+	case reflect.Func, reflect.Chan, reflect.Complex64, reflect.Complex128, reflect.UnsafePointer:
+		return nil, fmt.Errorf("amf: unsupported type %s", v.Type())
+	}
+
+	return v.Interface(), nil
+}
+
+// structValue returns the struct v as an Object, or a TypedObject if
+// its type is registered, its fields converted by conv. It returns nil
+// for the structs the encoders take as they are.
+func structValue(v reflect.Value, conv func(reflect.Value) (interface{}, error)) (interface{}, error) {
+	switch v.Interface().(type) {
+	case time.Time, TypedObject, MixedArray:
+		return nil, nil
+	}
+	obj, err := marshalStruct(v, conv)
+	if err != nil {
+		return nil, err
+	}
+	if name, ok := registeredName(v.Type()); ok {
+		return TypedObject{Type: name, Object: obj}, nil
+	}
+	return obj, nil
+}
+
+func marshalStruct(v reflect.Value, conv func(reflect.Value) (interface{}, error)) (Object, error) {
+	obj := make(Object)
+	for _, f := range structFields(v.Type()) {
+		fv, ok := fieldByIndex(v, f.index, false)
+		if !ok {
+			continue
+		}
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+
+		val, err := conv(fv)
+		if err != nil {
+			return nil, fmt.Errorf("amf: field %s: %v", f.name, err)
+		}
+		obj[f.name] = val
+	}
+	return obj, nil
+}
+
+// UnmarshalValue stores val, as returned by the decoders, in the value
+// pointed to by v. Numbers convert to any numeric type and, counted in
+// milliseconds, to time.Time. Objects fill structs by the keys of
+// Marshal, keys without a field being ignored, and maps. Null sets the
+// zero value.
+func UnmarshalValue(val interface{}, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("amf: unmarshal into non-pointer %T", v)
+	}
+	return unmarshalValue(val, rv.Elem())
+}
+
+func unmarshalValue(src interface{}, dst reflect.Value) error {
+	if src == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.Interface:
+		if dst.NumMethod() == 0 {
+			dst.Set(reflect.ValueOf(src))
+			return nil
+		}
+	case reflect.Ptr:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return unmarshalValue(src, dst.Elem())
+	}
+
+	// values of registered types are decoded as such already
+	if sv := reflect.Indirect(reflect.ValueOf(src)); sv.Kind() == reflect.Struct && sv.Type().AssignableTo(dst.Type()) {
+		dst.Set(sv)
+		return nil
+	}
+
+	if dst.Type() == timeType {
+		switch s := src.(type) {
+		case time.Time:
+			dst.Set(reflect.ValueOf(s))
+			return nil
+		case float64:
+			dst.Set(reflect.ValueOf(time.UnixMilli(int64(s)).UTC()))
+			return nil
+		}
+		return unmarshalTypeError(src, dst)
+	}
+
+	sv := reflect.ValueOf(src)
+	switch dst.Kind() {
+	case reflect.String:
+		if sv.Kind() == reflect.String {
+			dst.SetString(sv.String())
+			return nil
+		}
+	case reflect.Bool:
+		if sv.Kind() == reflect.Bool {
+			dst.SetBool(sv.Bool())
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if f, ok := toFloat(sv); ok && !dst.OverflowInt(int64(f)) {
+			dst.SetInt(int64(f))
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if f, ok := toFloat(sv); ok && f >= 0 && !dst.OverflowUint(uint64(f)) {
+			dst.SetUint(uint64(f))
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, ok := toFloat(sv); ok {
+			dst.SetFloat(f)
+			return nil
+		}
+	case reflect.Slice:
+		if b, ok := src.([]byte); ok && dst.Type().Elem().Kind() == reflect.Uint8 {
+			dst.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+		if arr, ok := toArray(src); ok {
+			s := reflect.MakeSlice(dst.Type(), len(arr), len(arr))
+			for i, val := range arr {
+				if err := unmarshalValue(val, s.Index(i)); err != nil {
+					return err
+				}
+			}
+			dst.Set(s)
+			return nil
+		}
+	case reflect.Array:
+		if arr, ok := toArray(src); ok {
+			for i := 0; i < dst.Len(); i++ {
+				var val interface{}
+				if i < len(arr) {
+					val = arr[i]
+				}
+				if err := unmarshalValue(val, dst.Index(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case reflect.Map:
+		if obj, ok := toObject(src); ok && dst.Type().Key().Kind() == reflect.String {
+			m := reflect.MakeMapWithSize(dst.Type(), len(obj))
+			for k, val := range obj {
+				elem := reflect.New(dst.Type().Elem()).Elem()
+				if err := unmarshalValue(val, elem); err != nil {
+					return err
+				}
+				m.SetMapIndex(reflect.ValueOf(k).Convert(dst.Type().Key()), elem)
+			}
+			dst.Set(m)
+			return nil
+		}
+	case reflect.Struct:
+		if obj, ok := toObject(src); ok {
+			for _, f := range structFields(dst.Type()) {
+				val, ok := obj[f.name]
+				if !ok {
+					continue
+				}
+				fv, ok := fieldByIndex(dst, f.index, true)
+				if !ok {
+					return fmt.Errorf("amf: field %s: cannot set embedded pointer to unexported struct", f.name)
+				}
+				if err := unmarshalValue(val, fv); err != nil {
+					return fmt.Errorf("amf: field %s: %v", f.name, err)
+				}
+			}
+			return nil
+		}
+	}
+
+	return unmarshalTypeError(src, dst)
+}
+
+func unmarshalTypeError(src interface{}, dst reflect.Value) error {
+	return fmt.Errorf("amf: cannot unmarshal %T into %s", src, dst.Type())
+}
+
+// toFloat returns the number v holds, float64 in AMF0 and int32 or
+// float64 in AMF3.
+func toFloat(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+func toArray(src interface{}) (Array, bool) {
+	switch s := src.(type) {
+	case Array:
+		return s, true
+	case MixedArray:
+		return s.Dense, true
+	}
+	return nil, false
+}
+
+func toObject(src interface{}) (Object, bool) {
+	switch s := src.(type) {
+	case Object:
+		return s, true
+	case TypedObject:
+		return s.Object, true
+	case *TypedObject:
+		return s.Object, true
+	case MixedArray:
+		return s.Associative, true
+	case EcmaArray:
+		return Object(s), true
+	}
+	// a value of a registered type going elsewhere
+	if v := reflect.Indirect(reflect.ValueOf(src)); v.Kind() == reflect.Struct && v.Type() != timeType {
+		if obj, err := marshalStruct(v, marshalValue); err == nil {
+			return obj, true
+		}
+	}
+	return nil, false
+}
+
+// field is an encoded struct field, index locating it as in
+// reflect.Value.FieldByIndex.
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// structFields lists the encoded fields of t, level by level so the
+// fields of embedded structs come after those of t and are shadowed by
+// them.
+func structFields(t reflect.Type) []field {
+	type level struct {
+		t     reflect.Type
+		index []int
+	}
+
+	var ret []field
+	seen := make(map[string]bool)
+	for cur := []level{{t: t}}; len(cur) > 0; {
+		var next []level
+		for _, l := range cur {
+			for i := 0; i < l.t.NumField(); i++ {
+				f := l.t.Field(i)
+				tag := f.Tag.Get("amf")
+				if tag == "-" {
+					continue
+				}
+				name, opts, _ := strings.Cut(tag, ",")
+				index := append(append([]int(nil), l.index...), i)
+
+				ft := f.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if f.Anonymous && name == "" && ft.Kind() == reflect.Struct && ft != timeType {
+					next = append(next, level{t: ft, index: index})
+					continue
+				}
+				if !f.IsExported() {
+					continue
+				}
+
+				if name == "" {
+					name = f.Name
+				}
+				if seen[name] {
+					continue
+				}
+				seen[name] = true
+				ret = append(ret, field{
+					name:      name,
+					index:     index,
+					omitEmpty: hasOption(opts, "omitempty"),
+				})
+			}
+		}
+		cur = next
+	}
+	return ret
+}
+
+func hasOption(opts, name string) bool {
+	for opts != "" {
+		var opt string
+		opt, opts, _ = strings.Cut(opts, ",")
+		if opt == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldByIndex returns the field of v at index. Nil embedded pointers
+// are allocated when alloc is set and they are exported, otherwise the
+// field is missing.
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc || !v.CanSet() {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
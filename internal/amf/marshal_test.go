@@ -0,0 +1,224 @@
+package amf
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type marshalBase struct {
+	ID   int    `amf:"id"`
+	Name string `amf:"name"`
+}
+
+type MarshalInner struct {
+	Level int
+}
+
+type marshalHidden struct {
+	Hidden int
+}
+
+type marshalTagged struct {
+	marshalBase
+	*MarshalInner
+
+	Name     string            `amf:"title"`
+	Count    int               `amf:"count,omitempty"`
+	Tags     []string          `amf:"tags,omitempty"`
+	Skipped  string            `amf:"-"`
+	Plain    bool              // no tag
+	Created  time.Time         `amf:"created"`
+	Extra    map[string]string `amf:"extra,omitempty"`
+	Pointer  *float64          `amf:"ptr"`
+	internal int
+}
+
+type marshalClass struct {
+	X int `amf:"x"`
+}
+
+func TestMarshalValue(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	f := 0.5
+
+	tests := []struct {
+		name string
+		val  interface{}
+		want interface{}
+	}{
+		{
+			name: "tags, omitempty and promoted fields",
+			val: marshalTagged{
+				marshalBase:  marshalBase{ID: 1, Name: "base"},
+				MarshalInner: &MarshalInner{Level: 2},
+				Name:         "outer",
+				Skipped:      "x",
+				Plain:        true,
+				Created:      created,
+				Pointer:      &f,
+				internal:     3,
+			},
+			want: Object{
+				"id": 1, "name": "base", "Level": 2,
+				"title": "outer", "Plain": true, "created": created, "ptr": 0.5,
+			},
+		},
+		{
+			name: "nil embedded pointer and non-empty omitempty fields",
+			val: marshalTagged{
+				Count: 4,
+				Tags:  []string{"a"},
+				Extra: map[string]string{"k": "v"},
+			},
+			want: Object{
+				"id": 0, "name": "",
+				"title": "", "count": 4, "tags": Array{"a"}, "Plain": false,
+				"created": time.Time{}, "extra": Object{"k": "v"}, "ptr": nil,
+			},
+		},
+		{
+			name: "struct pointer",
+			val:  &marshalClass{X: 1},
+			want: Object{"x": 1},
+		},
+		{
+			name: "nil slice and map",
+			val:  Array{[]int(nil), map[string]int(nil)},
+			want: Array{nil, nil},
+		},
+		{
+			name: "byte slice",
+			val:  []byte{1, 2},
+			want: []byte{1, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MarshalValue(tt.val)
+			if err != nil {
+				t.Fatalf("MarshalValue: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MarshalValue = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalValueErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		val  interface{}
+	}{
+		{"map key", map[int]string{1: "a"}},
+		{"func field", struct{ F func() }{F: func() {}}},
+		{"channel", make(chan int)},
+	}
+	for _, tt := range tests {
+		if _, err := MarshalValue(tt.val); err == nil {
+			t.Errorf("%s: MarshalValue succeeded", tt.name)
+		}
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	f := 0.5
+	val := marshalTagged{
+		marshalBase:  marshalBase{ID: 1, Name: "base"},
+		MarshalInner: &MarshalInner{Level: 2},
+		Name:         "outer",
+		Count:        3,
+		Tags:         []string{"a", "b"},
+		Skipped:      "x",
+		Plain:        true,
+		Created:      time.Date(2024, 1, 2, 3, 4, 5, 6e6, time.UTC),
+		Extra:        map[string]string{"k": "v"},
+		Pointer:      &f,
+	}
+	want := val
+	want.Skipped = ""
+
+	for _, ver := range []Version{AMF0, AMF3} {
+		b, err := Marshal(val, ver)
+		if err != nil {
+			t.Fatalf("AMF%d: Marshal: %v", ver, err)
+		}
+		var got marshalTagged
+		if err := Unmarshal(b, &got, ver); err != nil {
+			t.Fatalf("AMF%d: Unmarshal: %v", ver, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("AMF%d: Unmarshal = %+v, want %+v", ver, got, want)
+		}
+	}
+}
+
+func TestUnmarshalValue(t *testing.T) {
+	tests := []struct {
+		name string
+		val  interface{}
+		dst  interface{}
+		want interface{}
+	}{
+		{"amf0 number to int", 42.0, new(int), 42},
+		{"amf3 integer to uint", int32(7), new(uint16), uint16(7)},
+		{"integer to float", int32(7), new(float32), float32(7)},
+		{"milliseconds to time", 1000.0, new(time.Time), time.Unix(1, 0).UTC()},
+		{"null to zero", nil, &[]string{"a"}, []string(nil)},
+		{"array to fixed array", Array{"a"}, new([2]string), [2]string{"a", ""}},
+		{"ecma array to map", EcmaArray{"a": 1.0}, new(map[string]int), map[string]int{"a": 1}},
+		{"mixed array to slice", MixedArray{Dense: Array{true}}, new([]bool), []bool{true}},
+		{"object to interface", Object{"a": 1.0}, new(interface{}), Object{"a": 1.0}},
+		{
+			"unknown keys are ignored",
+			Object{"x": 1.0, "y": 2.0},
+			new(marshalClass),
+			marshalClass{X: 1},
+		},
+		{
+			"typed object to struct",
+			TypedObject{Type: "other", Object: Object{"x": 3.0}},
+			new(marshalClass),
+			marshalClass{X: 3},
+		},
+		{
+			"embedded pointer is allocated",
+			Object{"Level": 5.0},
+			new(marshalTagged),
+			marshalTagged{MarshalInner: &MarshalInner{Level: 5}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := UnmarshalValue(tt.val, tt.dst); err != nil {
+				t.Fatalf("UnmarshalValue: %v", err)
+			}
+			if got := reflect.ValueOf(tt.dst).Elem().Interface(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("UnmarshalValue = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalValueErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		val  interface{}
+		dst  interface{}
+	}{
+		{"non-pointer", 1.0, 1},
+		{"string to int", "a", new(int)},
+		{"negative to uint", -1.0, new(uint)},
+		{"overflow", 300.0, new(int8)},
+		{"field type", Object{"x": "a"}, new(marshalClass)},
+		{"unexported embedded pointer", Object{"Hidden": 1.0}, new(struct{ *marshalHidden })},
+	}
+	for _, tt := range tests {
+		if err := UnmarshalValue(tt.val, tt.dst); err == nil {
+			t.Errorf("%s: UnmarshalValue succeeded", tt.name)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package amf
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Flags of MetaDataReform.
+const (
+	ADD = 0x0
+	DEL = 0x3
+)
+
+const (
+	SetDataFrame string = "@setDataFrame"
+	OnMetaData   string = "onMetaData"
+)
+
+var setDataFrameHeader = []byte("\x02\x00\x0d" + SetDataFrame)
+
+/*
+MetaDataReform adds or removes the @setDataFrame name publishers put
+in front of their data messages:
+
+	@setDataFrame onMetaData {...}   (published)
+	onMetaData {...}                 (played and recorded)
+
+With ADD the name is prepended unless present, with DEL it is removed
+if present. p must start with an AMF0 string.
+*/
+func MetaDataReform(p []byte, flag uint8) ([]byte, error) {
+	r := bytes.NewReader(p)
+	v, err := NewDecoder().DecodeAmf0(r)
+	if err != nil {
+		return nil, err
+	}
+	name, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("amf: data message name is %T, not a string", v)
+	}
+
+	switch flag {
+	case ADD:
+		if name == SetDataFrame {
+			return p, nil
+		}
+		b := make([]byte, 0, len(setDataFrameHeader)+len(p))
+		b = append(b, setDataFrameHeader...)
+		return append(b, p...), nil
+	case DEL:
+		if name != SetDataFrame {
+			return p, nil
+		}
+		// The name may also have been sent as a long string.
+		return p[len(p)-r.Len():], nil
+	}
+	return nil, fmt.Errorf("amf: invalid metadata reform flag %d", flag)
+}
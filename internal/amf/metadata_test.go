@@ -0,0 +1,52 @@
+package amf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMetaDataReform(t *testing.T) {
+	onMetaData := []byte("\x02\x00\x0aonMetaData\x08\x00\x00\x00\x00\x00\x00\x09")
+	withName := append([]byte("\x02\x00\x0d@setDataFrame"), onMetaData...)
+	withLongName := append([]byte("\x0c\x00\x00\x00\x0d@setDataFrame"), onMetaData...)
+
+	tests := []struct {
+		name string
+		p    []byte
+		flag uint8
+		want []byte
+	}{
+		{"add", onMetaData, ADD, withName},
+		{"add when present", withName, ADD, withName},
+		{"delete", withName, DEL, onMetaData},
+		{"delete long string name", withLongName, DEL, onMetaData},
+		{"delete when absent", onMetaData, DEL, onMetaData},
+	}
+	for _, tt := range tests {
+		got, err := MetaDataReform(tt.p, tt.flag)
+		if err != nil {
+			t.Errorf("%s: MetaDataReform: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: MetaDataReform = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMetaDataReformErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		p    []byte
+		flag uint8
+	}{
+		{"empty", nil, DEL},
+		{"not a string", []byte{0x00, 0, 0, 0, 0, 0, 0, 0, 0}, DEL},
+		{"invalid flag", []byte("\x02\x00\x01a"), 1},
+	}
+	for _, tt := range tests {
+		if _, err := MetaDataReform(tt.p, tt.flag); err == nil {
+			t.Errorf("%s: MetaDataReform succeeded", tt.name)
+		}
+	}
+}
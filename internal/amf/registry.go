@@ -0,0 +1,86 @@
+package amf
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// registry maps the class names of typed objects to Go types and back.
+var registry struct {
+	sync.RWMutex
+	types map[string]reflect.Type
+	names map[reflect.Type]string
+}
+
+/*
+RegisterType maps the class name of AMF0 typed objects and AMF3 class
+instances to the struct type of v:
+
+	amf.RegisterType("com.example.Foo", Foo{})
+
+Objects of the class then decode into a Foo, or a *Foo when v is a
+pointer, filled as UnmarshalValue does. Foo and *Foo values encode as
+typed objects of the class, their fields named as in Marshal.
+
+RegisterType panics when v is not a struct or pointer to struct, or
+when the name or type is already registered differently.
+*/
+func RegisterType(name string, v interface{}) {
+	t := reflect.TypeOf(v)
+	st := t
+	if st != nil && st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+	if name == "" {
+		panic("amf: RegisterType with an empty class name")
+	}
+	if st == nil || st.Kind() != reflect.Struct || st == timeType {
+		panic(fmt.Sprintf("amf: RegisterType of %s: %T is not a struct", name, v))
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if registry.types == nil {
+		registry.types = make(map[string]reflect.Type)
+		registry.names = make(map[reflect.Type]string)
+	}
+	if other, ok := registry.types[name]; ok && other != t {
+		panic(fmt.Sprintf("amf: class %s registered for both %s and %s", name, other, t))
+	}
+	if other, ok := registry.names[st]; ok && other != name {
+		panic(fmt.Sprintf("amf: type %s registered as both %s and %s", st, other, name))
+	}
+	registry.types[name] = t
+	registry.names[st] = name
+}
+
+// registeredName returns the class name t is registered as.
+func registeredName(t reflect.Type) (string, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	name, ok := registry.names[t]
+	return name, ok
+}
+
+// registeredValue returns obj as a value of the type registered for
+// class, or false when no type is.
+func registeredValue(class string, obj Object) (interface{}, bool, error) {
+	if class == "" {
+		return nil, false, nil
+	}
+
+	registry.RLock()
+	t, ok := registry.types[class]
+	registry.RUnlock()
+	if !ok {
+		return nil, false, nil
+	}
+
+	v := reflect.New(t).Elem()
+	if err := unmarshalValue(obj, v); err != nil {
+		return nil, true, fmt.Errorf("amf: class %s: %v", class, err)
+	}
+	return v.Interface(), true, nil
+}
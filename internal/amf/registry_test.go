@@ -0,0 +1,99 @@
+package amf
+
+import (
+	"reflect"
+	"testing"
+)
+
+type registeredClass struct {
+	X int `amf:"x"`
+}
+
+type registeredPointer struct {
+	Y string `amf:"y"`
+}
+
+func init() {
+	RegisterType("test.RegisteredClass", registeredClass{})
+	RegisterType("test.RegisteredPointer", &registeredPointer{})
+}
+
+func TestMarshalRegisteredType(t *testing.T) {
+	tests := []struct {
+		name string
+		val  interface{}
+		want interface{}
+	}{
+		{"value", registeredClass{X: 1}, TypedObject{Type: "test.RegisteredClass", Object: Object{"x": 1}}},
+		{"pointer", &registeredClass{X: 2}, TypedObject{Type: "test.RegisteredClass", Object: Object{"x": 2}}},
+		{"pointer registration", registeredPointer{Y: "a"}, TypedObject{Type: "test.RegisteredPointer", Object: Object{"y": "a"}}},
+	}
+	for _, tt := range tests {
+		got, err := MarshalValue(tt.val)
+		if err != nil {
+			t.Errorf("%s: MarshalValue: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: MarshalValue = %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeRegisteredType(t *testing.T) {
+	tests := []struct {
+		name string
+		val  interface{}
+		want interface{}
+	}{
+		{"value", registeredClass{X: 9}, registeredClass{X: 9}},
+		{"pointer", &registeredPointer{Y: "b"}, &registeredPointer{Y: "b"}},
+		{"unknown class", TypedObject{Type: "test.Unknown", Object: Object{"x": 1.0}}, nil},
+	}
+
+	for _, ver := range []Version{AMF0, AMF3} {
+		for _, tt := range tests {
+			b, err := Marshal(tt.val, ver)
+			if err != nil {
+				t.Fatalf("AMF%d %s: Marshal: %v", ver, tt.name, err)
+			}
+			var got interface{}
+			if err := Unmarshal(b, &got, ver); err != nil {
+				t.Fatalf("AMF%d %s: Unmarshal: %v", ver, tt.name, err)
+			}
+			if tt.want == nil {
+				// unregistered classes keep their properties only
+				if _, ok := toObject(got); !ok {
+					t.Errorf("AMF%d %s: Unmarshal = %#v", ver, tt.name, got)
+				}
+				continue
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AMF%d %s: Unmarshal = %#v, want %#v", ver, tt.name, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestRegisterTypePanics(t *testing.T) {
+	tests := []struct {
+		name  string
+		class string
+		v     interface{}
+	}{
+		{"empty name", "", registeredClass{}},
+		{"not a struct", "test.Int", 1},
+		{"name taken", "test.RegisteredClass", registeredPointer{}},
+		{"type taken", "test.Other", registeredClass{}},
+	}
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: RegisterType did not panic", tt.name)
+				}
+			}()
+			RegisterType(tt.class, tt.v)
+		}()
+	}
+}
@@ -1,6 +1,8 @@
 package av
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 )
@@ -24,6 +26,7 @@ const (
 	SOUND_NELLYMOSER            = 6
 	SOUND_ALAW                  = 7
 	SOUND_MULAW                 = 8
+	SOUND_EX_HEADER             = 9
 	SOUND_AAC                   = 10
 	SOUND_SPEEX                 = 11
 
@@ -42,17 +45,62 @@ const (
 	AAC_RAW    = 1
 )
 
+// Enhanced RTMP audio packet types, carried in place of the sound rate,
+// size and type when SoundFormat is SOUND_EX_HEADER.
+const (
+	AUDIO_SEQUENCE_START      = 0
+	AUDIO_CODED_FRAMES        = 1
+	AUDIO_SEQUENCE_END        = 2
+	AUDIO_MULTICHANNEL_CONFIG = 4
+	AUDIO_MULTITRACK          = 5
+	AUDIO_MOD_EX              = 7
+)
+
+// Enhanced RTMP multitrack types.
+const (
+	MULTITRACK_ONE_TRACK               = 0
+	MULTITRACK_MANY_TRACKS             = 1
+	MULTITRACK_MANY_TRACKS_MANY_CODECS = 2
+)
+
 const (
 	AVC_SEQHDR = 0
 	AVC_NALU   = 1
 	AVC_EOS    = 2
 
-	FRAME_KEY   = 1
-	FRAME_INTER = 2
+	FRAME_KEY     = 1
+	FRAME_INTER   = 2
+	FRAME_COMMAND = 5
 
 	VIDEO_H264 = 7
 )
 
+// Enhanced RTMP video packet types, carried in place of the codec id
+// when the IsExHeader bit of the first byte is set.
+const (
+	PKT_SEQUENCE_START         = 0
+	PKT_CODED_FRAMES           = 1
+	PKT_SEQUENCE_END           = 2
+	PKT_CODED_FRAMES_X         = 3
+	PKT_METADATA               = 4
+	PKT_MPEG2TS_SEQUENCE_START = 5
+)
+
+// Enhanced RTMP codec FourCCs.
+const (
+	FOURCC_AVC  = "avc1"
+	FOURCC_HEVC = "hvc1"
+	FOURCC_AV1  = "av01"
+	FOURCC_VP9  = "vp09"
+
+	FOURCC_OPUS = "Opus"
+	FOURCC_FLAC = "fLaC"
+	FOURCC_AC3  = "ac-3"
+	FOURCC_EAC3 = "ec-3"
+	FOURCC_AAC  = "mp4a"
+	FOURCC_MP3  = ".mp3"
+)
+
 var (
 	PUBLISH = "publish"
 	PLAY    = "play"
@@ -132,6 +180,15 @@ type Info struct {
 	Inter bool
 }
 
+// NewUID returns a random identifier for Info.UID.
+func NewUID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("av: unable to generate uid: %s", err))
+	}
+	return hex.EncodeToString(b[:])
+}
+
 func (info Info) IsInterval() bool {
 	return info.Inter
 }
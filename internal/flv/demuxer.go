@@ -0,0 +1,28 @@
+package flv
+
+import (
+	"rtmp-example/internal/av"
+)
+
+var (
+	_ av.Demuxer           = (*Demuxer)(nil)
+	_ av.AudioPacketHeader = (*AudioTagHeader)(nil)
+	_ av.VideoPacketHeader = (*VideoTagHeader)(nil)
+)
+
+// Demuxer implements av.Demuxer for packets whose Data is an FLV tag
+// body, as carried by RTMP messages and read by Reader.
+type Demuxer struct{}
+
+func NewDemuxer() *Demuxer {
+	return &Demuxer{}
+}
+
+// Demux sets p.Header to an *AudioTagHeader or a *VideoTagHeader and
+// returns p. Metadata packets are returned untouched.
+func (d *Demuxer) Demux(p *av.Packet) (*av.Packet, error) {
+	if err := ParseHeader(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,35 @@
+package flv
+
+import (
+	"io"
+
+	"rtmp-example/internal/av"
+)
+
+var _ av.Muxer = (*Muxer)(nil)
+
+// Muxer implements av.Muxer and writes packets as an FLV stream: the
+// file header before the first tag, then a tag per packet stamped with
+// its timestamp.
+type Muxer struct {
+	// NoHeader skips the file header, to continue an existing file.
+	NoHeader bool
+
+	started bool
+}
+
+func NewMuxer() *Muxer {
+	return &Muxer{}
+}
+
+func (m *Muxer) Mux(p *av.Packet, w io.Writer) error {
+	if !m.started {
+		if !m.NoHeader {
+			if err := WriteHeader(w); err != nil {
+				return err
+			}
+		}
+		m.started = true
+	}
+	return WriteTag(w, p, p.TimeStamp)
+}
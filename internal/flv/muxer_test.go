@@ -0,0 +1,72 @@
+package flv
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"rtmp-example/internal/av"
+)
+
+func TestMuxDemux(t *testing.T) {
+	packets := []*av.Packet{
+		{IsMetadata: true, TimeStamp: 0, Data: []byte{0x02, 0x00, 0x0a, 'o', 'n', 'M', 'e', 't', 'a', 'D', 'a', 't', 'a'}},
+		{IsVideo: true, TimeStamp: 0, Data: []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x64}},
+		{IsAudio: true, TimeStamp: 0, Data: []byte{0xaf, 0x00, 0x12, 0x10}},
+		{IsVideo: true, TimeStamp: 40, Data: []byte{0x17, 0x01, 0x00, 0x00, 0x50, 0xaa}},
+		{IsAudio: true, TimeStamp: 46, Data: []byte{0xaf, 0x01, 0x21, 0x22}},
+		{IsVideo: true, TimeStamp: 80, Data: []byte{0x27, 0x01, 0xff, 0xff, 0xd8, 0xbb}},
+		{IsVideo: true, TimeStamp: 0x01000000, Data: []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0xcc}},
+		{IsAudio: true, TimeStamp: 0x01000010, Data: []byte{0xaf, 0x01, 0xdd}},
+	}
+
+	var b bytes.Buffer
+	m := NewMuxer()
+	for _, p := range packets {
+		if err := m.Mux(p, &b); err != nil {
+			t.Fatalf("Mux: %v", err)
+		}
+	}
+
+	r, err := NewReader(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	d := NewDemuxer()
+	for i, want := range packets {
+		var p av.Packet
+		if err := r.ReadTag(&p); err != nil {
+			t.Fatalf("tag %d: ReadTag: %v", i, err)
+		}
+		got, err := d.Demux(&p)
+		if err != nil {
+			t.Fatalf("tag %d: Demux: %v", i, err)
+		}
+		if got.IsAudio != want.IsAudio || got.IsVideo != want.IsVideo || got.IsMetadata != want.IsMetadata {
+			t.Errorf("tag %d: type differs: %+v", i, got)
+		}
+		if got.TimeStamp != want.TimeStamp {
+			t.Errorf("tag %d: TimeStamp = %#x, want %#x", i, got.TimeStamp, want.TimeStamp)
+		}
+		if !bytes.Equal(got.Data, want.Data) {
+			t.Errorf("tag %d: Data = % x, want % x", i, got.Data, want.Data)
+		}
+		if want.IsMetadata != (got.Header == nil) {
+			t.Errorf("tag %d: Header = %v", i, got.Header)
+		}
+
+		wp := *want
+		if err := ParseHeader(&wp); err != nil {
+			t.Fatalf("tag %d: ParseHeader: %v", i, err)
+		}
+		if !reflect.DeepEqual(got.Header, wp.Header) {
+			t.Errorf("tag %d: Header = %+v, want %+v", i, got.Header, wp.Header)
+		}
+	}
+
+	var p av.Packet
+	if err := r.ReadTag(&p); err != io.EOF {
+		t.Errorf("ReadTag after the last tag = %v, want EOF", err)
+	}
+}
@@ -0,0 +1,240 @@
+package flv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/bitops"
+)
+
+// Keyframe locates a video keyframe tag inside a file.
+type Keyframe struct {
+	Offset    int64
+	Timestamp uint32
+}
+
+// HeaderTag is a metadata or sequence header tag found by Headers.
+type HeaderTag struct {
+	Offset int64
+	Packet *av.Packet
+}
+
+var errNotSeekable = errors.New("flv: reader is not seekable")
+
+// Reader reads the tags of an FLV file or stream. Rewind, SeekTo and
+// Keyframes need the underlying reader to be an io.Seeker.
+type Reader struct {
+	r     io.Reader
+	start int64
+}
+
+// NewReader checks the file header and positions r on the first tag.
+func NewReader(r io.Reader) (*Reader, error) {
+	var hdr [headerLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("flv: unable to read file header: %s", err)
+	}
+	if hdr[0] != 'F' || hdr[1] != 'L' || hdr[2] != 'V' {
+		return nil, fmt.Errorf("flv: not an flv file")
+	}
+
+	// DataOffset is the header size; the first PreviousTagSize follows.
+	start := int64(bitops.U32BE(hdr[5:9])) + 4
+	if start < headerLen+4 {
+		return nil, fmt.Errorf("flv: invalid data offset %d", start-4)
+	}
+	if _, err := io.CopyN(io.Discard, r, start-headerLen); err != nil {
+		return nil, fmt.Errorf("flv: unable to read file header: %s", err)
+	}
+
+	return &Reader{r: r, start: start}, nil
+}
+
+// ReadTag reads the next audio, video or script tag into p and parses
+// its header. Other tags are skipped. It returns io.EOF at the end of
+// the file.
+func (fr *Reader) ReadTag(p *av.Packet) error {
+	for {
+		var h [tagHeaderLen]byte
+		if _, err := io.ReadFull(fr.r, h[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return io.EOF
+			}
+			return err
+		}
+
+		size := bitops.U24BE(h[1:4])
+		data := make([]byte, size)
+		if _, err := io.ReadFull(fr.r, data); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return io.EOF
+			}
+			return err
+		}
+		// PreviousTagSize
+		var prev [4]byte
+		if _, err := io.ReadFull(fr.r, prev[:]); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		// The upper bits flag filtered (encrypted) tags.
+		tagType := h[0]
+		if tagType&0xe0 != 0 {
+			continue
+		}
+
+		*p = av.Packet{
+			IsAudio:    tagType == av.TAG_AUDIO,
+			IsVideo:    tagType == av.TAG_VIDEO,
+			IsMetadata: tagType == av.TAG_SCRIPTDATAAMF0,
+			TimeStamp:  bitops.U24BE(h[4:7]) | uint32(h[7])<<24,
+			Data:       data,
+		}
+		if !p.IsAudio && !p.IsVideo && !p.IsMetadata {
+			continue
+		}
+
+		if err := ParseHeader(p); err != nil {
+			continue
+		}
+		return nil
+	}
+}
+
+// Rewind positions the reader on the first tag.
+func (fr *Reader) Rewind() error {
+	return fr.SeekTo(fr.start)
+}
+
+// SeekTo positions the reader on the tag starting at offset, usually
+// taken from Keyframes.
+func (fr *Reader) SeekTo(offset int64) error {
+	rs, ok := fr.r.(io.Seeker)
+	if !ok {
+		return errNotSeekable
+	}
+	_, err := rs.Seek(offset, io.SeekStart)
+	return err
+}
+
+// Keyframes scans the file and returns its video keyframes in order.
+// The reader is left on the first tag.
+func (fr *Reader) Keyframes() ([]Keyframe, error) {
+	if err := fr.Rewind(); err != nil {
+		return nil, err
+	}
+	defer fr.Rewind()
+
+	var ret []Keyframe
+	offset := fr.start
+	for {
+		var h [tagHeaderLen + 1]byte
+		_, err := io.ReadFull(fr.r, h[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		size := int64(bitops.U24BE(h[1:4]))
+		if h[0] == av.TAG_VIDEO && size > 0 && (h[tagHeaderLen]>>4)&0x07 == av.FRAME_KEY {
+			ret = append(ret, Keyframe{
+				Offset:    offset,
+				Timestamp: bitops.U24BE(h[4:7]) | uint32(h[7])<<24,
+			})
+		}
+
+		offset += tagHeaderLen + size + 4
+		if err := fr.SeekTo(offset); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Headers scans the file and returns its metadata and sequence header
+// tags in order. Only tags whose first bytes may start a header are
+// read in full. The reader is left on the first tag.
+func (fr *Reader) Headers() ([]HeaderTag, error) {
+	if err := fr.Rewind(); err != nil {
+		return nil, err
+	}
+	defer fr.Rewind()
+
+	var ret []HeaderTag
+	offset := fr.start
+	for {
+		var h [tagHeaderLen + 2]byte
+		n, err := io.ReadFull(fr.r, h[:])
+		if n < tagHeaderLen && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			return ret, nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+
+		size := int64(bitops.U24BE(h[1:4]))
+		if size > 0 && mayBeHeader(h[0], h[tagHeaderLen:n]) {
+			if err := fr.SeekTo(offset); err != nil {
+				return nil, err
+			}
+			p := &av.Packet{}
+			if err := fr.ReadTag(p); err != nil {
+				if err == io.EOF {
+					return ret, nil
+				}
+				return nil, err
+			}
+			if isHeaderTag(p) {
+				ret = append(ret, HeaderTag{Offset: offset, Packet: p})
+			}
+		}
+
+		offset += tagHeaderLen + size + 4
+		if err := fr.SeekTo(offset); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// mayBeHeader tells from the first bytes of a tag body whether the tag
+// can be metadata or a sequence header, so media tags are skipped
+// without reading them.
+func mayBeHeader(tagType uint8, b []byte) bool {
+	switch tagType {
+	case av.TAG_SCRIPTDATAAMF0:
+		return true
+	case av.TAG_VIDEO:
+		if len(b) < 1 {
+			return false
+		}
+		if b[0]&0x80 != 0 {
+			pt := b[0] & 0x0f
+			return pt != av.PKT_CODED_FRAMES && pt != av.PKT_CODED_FRAMES_X
+		}
+		return (b[0]>>4)&0x07 == av.FRAME_KEY && len(b) > 1 && b[1] == av.AVC_SEQHDR
+	case av.TAG_AUDIO:
+		if len(b) < 1 {
+			return false
+		}
+		switch b[0] >> 4 {
+		case av.SOUND_EX_HEADER:
+			return b[0]&0x0f != av.AUDIO_CODED_FRAMES
+		case av.SOUND_AAC:
+			return len(b) > 1 && b[1] == av.AAC_SEQHDR
+		}
+	}
+	return false
+}
+
+func isHeaderTag(p *av.Packet) bool {
+	switch h := p.Header.(type) {
+	case *VideoTagHeader:
+		return p.IsVideo && h.IsSeq()
+	case *AudioTagHeader:
+		return p.IsAudio && h.IsSeq()
+	}
+	return p.IsMetadata
+}
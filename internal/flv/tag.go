@@ -0,0 +1,399 @@
+package flv
+
+import (
+	"fmt"
+
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/bitops"
+)
+
+/*
+Audio tag header:
+
+	+--------------+-------------+-------------+-------------+--------------------+
+	| SoundFormat  | SoundRate   | SoundSize   | SoundType   | AACPacketType      |
+	| (4 bits)     | (2 bits)    | (1 bit)     | (1 bit)     | (8 bits, AAC only) |
+	+--------------+-------------+-------------+-------------+--------------------+
+
+Enhanced RTMP sets SoundFormat to av.SOUND_EX_HEADER and replaces the
+rest of the byte with a PacketType. ModEx packet types prefix the
+header with extensions, which are skipped. Multitrack packets then give
+the multitrack type and the actual packet type, followed by the tracks:
+
+	+-------------+----------------+------------+------------+---------------+---------+
+	| SoundFormat | PacketType     | Multitrack | PacketType | FourCC        | Tracks  |
+	| (4 bits, 9) | (4 bits)       | Type (4)   | (4 bits)   | (32 bits, not | ...     |
+	|             |                |            |            |  many codecs) |         |
+	+-------------+----------------+------------+------------+---------------+---------+
+
+	Track: [FourCC (many codecs)] | TrackID (8 bits) | Size (UI24, not one track) | Body
+
+Other packets carry the FourCC and the body of the single track 0.
+*/
+type AudioTagHeader struct {
+	soundFormat    uint8
+	soundRate      uint8
+	soundSize      uint8
+	soundType      uint8
+	aacPacketType  uint8
+	packetType     uint8
+	multitrack     bool
+	multitrackType uint8
+	tracks         []AudioTrack
+}
+
+// AudioTrack is a track of an Enhanced RTMP audio tag. Data is the
+// codec payload, within the tag.
+type AudioTrack struct {
+	ID     uint8
+	FourCC string
+	Data   []byte
+}
+
+func (h *AudioTagHeader) SoundFormat() uint8 {
+	return h.soundFormat
+}
+
+// SoundRate returns the rate code, av.SOUND_5_5Khz to av.SOUND_44Khz.
+// AAC always announces 44 kHz whatever its actual rate.
+func (h *AudioTagHeader) SoundRate() uint8 {
+	return h.soundRate
+}
+
+// SoundSize returns av.SOUND_8BIT or av.SOUND_16BIT.
+func (h *AudioTagHeader) SoundSize() uint8 {
+	return h.soundSize
+}
+
+// SoundType returns av.SOUND_MONO or av.SOUND_STEREO.
+func (h *AudioTagHeader) SoundType() uint8 {
+	return h.soundType
+}
+
+func (h *AudioTagHeader) AACPacketType() uint8 {
+	return h.aacPacketType
+}
+
+// IsExHeader reports whether the tag uses the Enhanced RTMP header.
+func (h *AudioTagHeader) IsExHeader() bool {
+	return h.soundFormat == av.SOUND_EX_HEADER
+}
+
+// PacketType returns the Enhanced RTMP packet type, such as
+// av.AUDIO_SEQUENCE_START. For multitrack tags it is the packet type of
+// the tracks.
+func (h *AudioTagHeader) PacketType() uint8 {
+	return h.packetType
+}
+
+// IsMultitrack reports whether the tag is an Enhanced RTMP multitrack
+// tag, whose type MultitrackType returns.
+func (h *AudioTagHeader) IsMultitrack() bool {
+	return h.multitrack
+}
+
+// MultitrackType returns av.MULTITRACK_ONE_TRACK,
+// av.MULTITRACK_MANY_TRACKS or av.MULTITRACK_MANY_TRACKS_MANY_CODECS.
+func (h *AudioTagHeader) MultitrackType() uint8 {
+	return h.multitrackType
+}
+
+// FourCC returns the codec of the first track of an Enhanced RTMP tag,
+// such as av.FOURCC_OPUS.
+func (h *AudioTagHeader) FourCC() string {
+	if len(h.tracks) == 0 {
+		return ""
+	}
+	return h.tracks[0].FourCC
+}
+
+// Tracks returns the tracks of an Enhanced RTMP tag.
+func (h *AudioTagHeader) Tracks() []AudioTrack {
+	return h.tracks
+}
+
+// IsSeq reports whether the tag carries an AAC AudioSpecificConfig or
+// an Enhanced RTMP sequence start.
+func (h *AudioTagHeader) IsSeq() bool {
+	if h.IsExHeader() {
+		return h.packetType == av.AUDIO_SEQUENCE_START
+	}
+	return h.soundFormat == av.SOUND_AAC && h.aacPacketType == av.AAC_SEQHDR
+}
+
+/*
+Video tag header:
+
+	+--------------+-------------+------------------+---------------------------+
+	| FrameType    | CodecID     | AVCPacketType    | CompositionTime           |
+	| (4 bits)     | (4 bits)    | (8 bits, AVC)    | (SI24, AVC only)          |
+	+--------------+-------------+------------------+---------------------------+
+
+Enhanced RTMP sets the high bit of FrameType, IsExHeader, and replaces
+CodecID with a PacketType followed by the codec FourCC:
+
+	+------------+-----------+------------+-------------+--------------------------+
+	| IsExHeader | FrameType | PacketType | FourCC      | CompositionTime          |
+	| (1 bit)    | (3 bits)  | (4 bits)   | (32 bits)   | (SI24, hvc1 and avc1     |
+	|            |           |            |             |  CodedFrames only)       |
+	+------------+-----------+------------+-------------+--------------------------+
+
+CodecID is 0 for enhanced tags, which are told apart by FourCC.
+*/
+type VideoTagHeader struct {
+	frameType       uint8
+	codecID         uint8
+	avcPacketType   uint8
+	compositionTime int32
+	exHeader        bool
+	packetType      uint8
+	fourCC          string
+}
+
+// FrameType returns the frame type, such as av.FRAME_KEY.
+func (h *VideoTagHeader) FrameType() uint8 {
+	return h.frameType
+}
+
+// AVCPacketType returns av.AVC_SEQHDR, av.AVC_NALU or av.AVC_EOS for
+// AVC tags.
+func (h *VideoTagHeader) AVCPacketType() uint8 {
+	return h.avcPacketType
+}
+
+// IsExHeader reports whether the tag uses the Enhanced RTMP header.
+func (h *VideoTagHeader) IsExHeader() bool {
+	return h.exHeader
+}
+
+// PacketType returns the Enhanced RTMP packet type, such as
+// av.PKT_SEQUENCE_START.
+func (h *VideoTagHeader) PacketType() uint8 {
+	return h.packetType
+}
+
+// FourCC returns the Enhanced RTMP codec, such as av.FOURCC_HEVC.
+func (h *VideoTagHeader) FourCC() string {
+	return h.fourCC
+}
+
+func (h *VideoTagHeader) IsKeyFrame() bool {
+	if h.exHeader {
+		return h.frameType == av.FRAME_KEY && h.isCodedFrames()
+	}
+	return h.frameType == av.FRAME_KEY
+}
+
+func (h *VideoTagHeader) IsSeq() bool {
+	if h.exHeader {
+		return h.packetType == av.PKT_SEQUENCE_START || h.packetType == av.PKT_MPEG2TS_SEQUENCE_START
+	}
+	return h.frameType == av.FRAME_KEY && h.avcPacketType == av.AVC_SEQHDR
+}
+
+func (h *VideoTagHeader) CodecID() uint8 {
+	return h.codecID
+}
+
+func (h *VideoTagHeader) CompositionTime() int32 {
+	return h.compositionTime
+}
+
+func (h *VideoTagHeader) isCodedFrames() bool {
+	return h.packetType == av.PKT_CODED_FRAMES || h.packetType == av.PKT_CODED_FRAMES_X
+}
+
+// hasCompositionTime reports whether an enhanced tag carries a
+// composition time; CodedFramesX implies 0.
+func (h *VideoTagHeader) hasCompositionTime() bool {
+	return h.packetType == av.PKT_CODED_FRAMES &&
+		(h.fourCC == av.FOURCC_HEVC || h.fourCC == av.FOURCC_AVC)
+}
+
+// ParseAudioTagHeader decodes the audio tag header at the start of b.
+func ParseAudioTagHeader(b []byte) (*AudioTagHeader, error) {
+	if len(b) < 1 {
+		return nil, fmt.Errorf("flv: audio tag too short: %d bytes", len(b))
+	}
+
+	if b[0]>>4 == av.SOUND_EX_HEADER {
+		return parseExAudioTagHeader(b)
+	}
+
+	h := &AudioTagHeader{
+		soundFormat: b[0] >> 4,
+		soundRate:   (b[0] >> 2) & 0x03,
+		soundSize:   (b[0] >> 1) & 0x01,
+		soundType:   b[0] & 0x01,
+	}
+
+	if h.soundFormat == av.SOUND_AAC {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("flv: aac tag too short: %d bytes", len(b))
+		}
+		h.aacPacketType = b[1]
+	}
+
+	return h, nil
+}
+
+// parseExAudioTagHeader decodes an Enhanced RTMP audio tag header and
+// splits its tracks.
+func parseExAudioTagHeader(b []byte) (*AudioTagHeader, error) {
+	h := &AudioTagHeader{
+		soundFormat: av.SOUND_EX_HEADER,
+		packetType:  b[0] & 0x0f,
+	}
+	n := len(b)
+	short := func() error {
+		return fmt.Errorf("flv: enhanced audio tag too short: %d bytes", n)
+	}
+	b = b[1:]
+
+	for h.packetType == av.AUDIO_MOD_EX {
+		if len(b) < 1 {
+			return nil, short()
+		}
+		size := int(b[0]) + 1
+		b = b[1:]
+		if size == 256 {
+			if len(b) < 2 {
+				return nil, short()
+			}
+			size = int(bitops.U16BE(b)) + 1
+			b = b[2:]
+		}
+		if len(b) < size+1 {
+			return nil, short()
+		}
+		h.packetType = b[size] & 0x0f
+		b = b[size+1:]
+	}
+
+	if h.packetType != av.AUDIO_MULTITRACK {
+		if len(b) < 4 {
+			return nil, short()
+		}
+		h.tracks = []AudioTrack{{FourCC: string(b[:4]), Data: b[4:]}}
+		return h, nil
+	}
+
+	if len(b) < 1 {
+		return nil, short()
+	}
+	h.multitrack = true
+	h.multitrackType = b[0] >> 4
+	h.packetType = b[0] & 0x0f
+	b = b[1:]
+
+	var fourCC string
+	if h.multitrackType != av.MULTITRACK_MANY_TRACKS_MANY_CODECS {
+		if len(b) < 4 {
+			return nil, short()
+		}
+		fourCC = string(b[:4])
+		b = b[4:]
+	}
+
+	for len(b) > 0 {
+		if h.multitrackType == av.MULTITRACK_MANY_TRACKS_MANY_CODECS {
+			if len(b) < 4 {
+				return nil, short()
+			}
+			fourCC = string(b[:4])
+			b = b[4:]
+		}
+		if len(b) < 1 {
+			return nil, short()
+		}
+		t := AudioTrack{ID: b[0], FourCC: fourCC}
+		b = b[1:]
+
+		if h.multitrackType == av.MULTITRACK_ONE_TRACK {
+			t.Data = b
+			h.tracks = append(h.tracks, t)
+			break
+		}
+		if len(b) < 3 {
+			return nil, short()
+		}
+		size := int(bitops.U24BE(b))
+		if len(b) < 3+size {
+			return nil, short()
+		}
+		t.Data = b[3 : 3+size]
+		b = b[3+size:]
+		h.tracks = append(h.tracks, t)
+	}
+
+	return h, nil
+}
+
+// ParseVideoTagHeader decodes the video tag header at the start of b.
+func ParseVideoTagHeader(b []byte) (*VideoTagHeader, error) {
+	if len(b) < 1 {
+		return nil, fmt.Errorf("flv: video tag too short: %d bytes", len(b))
+	}
+
+	if b[0]&0x80 != 0 {
+		return parseExVideoTagHeader(b)
+	}
+
+	h := &VideoTagHeader{
+		frameType: b[0] >> 4,
+		codecID:   b[0] & 0x0f,
+	}
+
+	if h.codecID == av.VIDEO_H264 {
+		if len(b) < 5 {
+			return nil, fmt.Errorf("flv: avc tag too short: %d bytes", len(b))
+		}
+		h.avcPacketType = b[1]
+		h.compositionTime = int32(uint32(b[2])<<24|uint32(b[3])<<16|uint32(b[4])<<8) >> 8
+	}
+
+	return h, nil
+}
+
+// parseExVideoTagHeader decodes an Enhanced RTMP video tag header.
+func parseExVideoTagHeader(b []byte) (*VideoTagHeader, error) {
+	if len(b) < 5 {
+		return nil, fmt.Errorf("flv: enhanced video tag too short: %d bytes", len(b))
+	}
+
+	h := &VideoTagHeader{
+		frameType:  (b[0] >> 4) & 0x07,
+		exHeader:   true,
+		packetType: b[0] & 0x0f,
+		fourCC:     string(b[1:5]),
+	}
+
+	if h.hasCompositionTime() {
+		if len(b) < 8 {
+			return nil, fmt.Errorf("flv: %s tag too short: %d bytes", h.fourCC, len(b))
+		}
+		h.compositionTime = int32(uint32(b[5])<<24|uint32(b[6])<<16|uint32(b[7])<<8) >> 8
+	}
+
+	return h, nil
+}
+
+// ParseHeader fills p.Header from the tag header at the start of
+// p.Data. Metadata packets are left untouched.
+func ParseHeader(p *av.Packet) error {
+	switch {
+	case p.IsAudio:
+		h, err := ParseAudioTagHeader(p.Data)
+		if err != nil {
+			return err
+		}
+		p.Header = h
+	case p.IsVideo:
+		h, err := ParseVideoTagHeader(p.Data)
+		if err != nil {
+			return err
+		}
+		p.Header = h
+	}
+	return nil
+}
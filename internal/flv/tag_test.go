@@ -0,0 +1,301 @@
+package flv
+
+import (
+	"reflect"
+	"testing"
+
+	"rtmp-example/internal/av"
+)
+
+func TestParseVideoTagHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		frame    uint8
+		codec    uint8
+		ex       bool
+		pktType  uint8
+		fourCC   string
+		cts      int32
+		keyFrame bool
+		seq      bool
+	}{
+		{
+			name:     "avc sequence header",
+			data:     []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01},
+			frame:    av.FRAME_KEY,
+			codec:    av.VIDEO_H264,
+			keyFrame: true,
+			seq:      true,
+		},
+		{
+			name:     "avc keyframe",
+			data:     []byte{0x17, 0x01, 0x00, 0x00, 0x28, 0xaa},
+			frame:    av.FRAME_KEY,
+			codec:    av.VIDEO_H264,
+			cts:      40,
+			keyFrame: true,
+		},
+		{
+			name:  "avc negative composition time",
+			data:  []byte{0x27, 0x01, 0xff, 0xff, 0xd8, 0xaa},
+			frame: av.FRAME_INTER,
+			codec: av.VIDEO_H264,
+			cts:   -40,
+		},
+		{
+			name:  "avc largest negative composition time",
+			data:  []byte{0x27, 0x01, 0x80, 0x00, 0x00},
+			frame: av.FRAME_INTER,
+			codec: av.VIDEO_H264,
+			cts:   -1 << 23,
+		},
+		{
+			name:  "sorenson has no avc fields",
+			data:  []byte{0x22, 0x01, 0x02},
+			frame: av.FRAME_INTER,
+			codec: 2,
+		},
+		{
+			name:    "hevc sequence start",
+			data:    []byte{0x90, 'h', 'v', 'c', '1', 0x01},
+			frame:   av.FRAME_KEY,
+			ex:      true,
+			pktType: av.PKT_SEQUENCE_START,
+			fourCC:  av.FOURCC_HEVC,
+			seq:     true,
+		},
+		{
+			name:     "hevc coded frames",
+			data:     []byte{0x91, 'h', 'v', 'c', '1', 0xff, 0xff, 0xec, 0xaa},
+			frame:    av.FRAME_KEY,
+			ex:       true,
+			pktType:  av.PKT_CODED_FRAMES,
+			fourCC:   av.FOURCC_HEVC,
+			cts:      -20,
+			keyFrame: true,
+		},
+		{
+			name:     "av1 coded frames have no composition time",
+			data:     []byte{0x91, 'a', 'v', '0', '1', 0x0a, 0x0b, 0x0c},
+			frame:    av.FRAME_KEY,
+			ex:       true,
+			pktType:  av.PKT_CODED_FRAMES,
+			fourCC:   av.FOURCC_AV1,
+			keyFrame: true,
+		},
+		{
+			name:    "hevc coded frames x",
+			data:    []byte{0xa3, 'h', 'v', 'c', '1', 0xaa},
+			frame:   av.FRAME_INTER,
+			ex:      true,
+			pktType: av.PKT_CODED_FRAMES_X,
+			fourCC:  av.FOURCC_HEVC,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := ParseVideoTagHeader(tt.data)
+			if err != nil {
+				t.Fatalf("ParseVideoTagHeader: %v", err)
+			}
+			if h.FrameType() != tt.frame {
+				t.Errorf("FrameType = %d, want %d", h.FrameType(), tt.frame)
+			}
+			if h.IsExHeader() != tt.ex {
+				t.Errorf("IsExHeader = %v, want %v", h.IsExHeader(), tt.ex)
+			}
+			if tt.ex {
+				if h.PacketType() != tt.pktType {
+					t.Errorf("PacketType = %d, want %d", h.PacketType(), tt.pktType)
+				}
+				if h.FourCC() != tt.fourCC {
+					t.Errorf("FourCC = %q, want %q", h.FourCC(), tt.fourCC)
+				}
+			} else if h.CodecID() != tt.codec {
+				t.Errorf("CodecID = %d, want %d", h.CodecID(), tt.codec)
+			}
+			if h.CompositionTime() != tt.cts {
+				t.Errorf("CompositionTime = %d, want %d", h.CompositionTime(), tt.cts)
+			}
+			if h.IsKeyFrame() != tt.keyFrame {
+				t.Errorf("IsKeyFrame = %v, want %v", h.IsKeyFrame(), tt.keyFrame)
+			}
+			if h.IsSeq() != tt.seq {
+				t.Errorf("IsSeq = %v, want %v", h.IsSeq(), tt.seq)
+			}
+		})
+	}
+}
+
+func TestParseVideoTagHeaderShort(t *testing.T) {
+	for _, data := range [][]byte{
+		{},
+		{0x17, 0x01, 0x00},
+		{0x91, 'h', 'v'},
+		{0x91, 'h', 'v', 'c', '1', 0x00},
+	} {
+		if _, err := ParseVideoTagHeader(data); err == nil {
+			t.Errorf("ParseVideoTagHeader(% x) succeeded", data)
+		}
+	}
+}
+
+func TestParseAudioTagHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       []byte
+		format     uint8
+		rate       uint8
+		size       uint8
+		typ        uint8
+		pktType    uint8
+		multitrack bool
+		seq        bool
+		tracks     []AudioTrack
+	}{
+		{
+			name:   "aac sequence header",
+			data:   []byte{0xaf, 0x00, 0x12, 0x10},
+			format: av.SOUND_AAC,
+			rate:   av.SOUND_44Khz,
+			size:   av.SOUND_16BIT,
+			typ:    av.SOUND_STEREO,
+			seq:    true,
+		},
+		{
+			name:   "aac raw",
+			data:   []byte{0xaf, 0x01, 0x21},
+			format: av.SOUND_AAC,
+			rate:   av.SOUND_44Khz,
+			size:   av.SOUND_16BIT,
+			typ:    av.SOUND_STEREO,
+		},
+		{
+			name:   "mp3 mono 22 kHz 8 bits",
+			data:   []byte{0x28, 0xff},
+			format: av.SOUND_MP3,
+			rate:   av.SOUND_22Khz,
+			size:   av.SOUND_8BIT,
+			typ:    av.SOUND_MONO,
+		},
+		{
+			name:    "opus sequence start",
+			data:    []byte{0x90, 'O', 'p', 'u', 's', 0x01, 0x02},
+			format:  av.SOUND_EX_HEADER,
+			pktType: av.AUDIO_SEQUENCE_START,
+			seq:     true,
+			tracks:  []AudioTrack{{FourCC: av.FOURCC_OPUS, Data: []byte{0x01, 0x02}}},
+		},
+		{
+			name: "mod ex prefix is skipped",
+			data: []byte{
+				0x97,       // ModEx
+				0x01,       // 2 bytes of data
+				0xaa, 0xbb, // data
+				0x01, // coded frames
+				'O', 'p', 'u', 's', 0x03,
+			},
+			format:  av.SOUND_EX_HEADER,
+			pktType: av.AUDIO_CODED_FRAMES,
+			tracks:  []AudioTrack{{FourCC: av.FOURCC_OPUS, Data: []byte{0x03}}},
+		},
+		{
+			name: "multitrack one codec",
+			data: []byte{
+				0x95,               // multitrack
+				0x10,               // many tracks, sequence start
+				'm', 'p', '4', 'a', // codec
+				0x00, 0x00, 0x00, 0x02, // track 0, 2 bytes
+				0x12, 0x10,
+				0x01, 0x00, 0x00, 0x01, // track 1, 1 byte
+				0x13,
+			},
+			format:     av.SOUND_EX_HEADER,
+			pktType:    av.AUDIO_SEQUENCE_START,
+			multitrack: true,
+			seq:        true,
+			tracks: []AudioTrack{
+				{ID: 0, FourCC: av.FOURCC_AAC, Data: []byte{0x12, 0x10}},
+				{ID: 1, FourCC: av.FOURCC_AAC, Data: []byte{0x13}},
+			},
+		},
+		{
+			name: "multitrack many codecs",
+			data: []byte{
+				0x95,               // multitrack
+				0x21,               // many tracks many codecs, coded frames
+				'O', 'p', 'u', 's', // codec of track 0
+				0x00, 0x00, 0x00, 0x01, 0xaa,
+				'f', 'L', 'a', 'C',
+				0x02, 0x00, 0x00, 0x01, 0xbb,
+			},
+			format:     av.SOUND_EX_HEADER,
+			pktType:    av.AUDIO_CODED_FRAMES,
+			multitrack: true,
+			tracks: []AudioTrack{
+				{ID: 0, FourCC: av.FOURCC_OPUS, Data: []byte{0xaa}},
+				{ID: 2, FourCC: av.FOURCC_FLAC, Data: []byte{0xbb}},
+			},
+		},
+		{
+			name: "multitrack one track",
+			data: []byte{
+				0x95,               // multitrack
+				0x01,               // one track, coded frames
+				'O', 'p', 'u', 's', // codec
+				0x03, 0xaa, 0xbb,
+			},
+			format:     av.SOUND_EX_HEADER,
+			pktType:    av.AUDIO_CODED_FRAMES,
+			multitrack: true,
+			tracks:     []AudioTrack{{ID: 3, FourCC: av.FOURCC_OPUS, Data: []byte{0xaa, 0xbb}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := ParseAudioTagHeader(tt.data)
+			if err != nil {
+				t.Fatalf("ParseAudioTagHeader: %v", err)
+			}
+			if h.SoundFormat() != tt.format {
+				t.Errorf("SoundFormat = %d, want %d", h.SoundFormat(), tt.format)
+			}
+			if h.IsExHeader() {
+				if h.PacketType() != tt.pktType {
+					t.Errorf("PacketType = %d, want %d", h.PacketType(), tt.pktType)
+				}
+			} else {
+				if h.SoundRate() != tt.rate || h.SoundSize() != tt.size || h.SoundType() != tt.typ {
+					t.Errorf("rate, size, type = %d, %d, %d, want %d, %d, %d",
+						h.SoundRate(), h.SoundSize(), h.SoundType(), tt.rate, tt.size, tt.typ)
+				}
+			}
+			if h.IsMultitrack() != tt.multitrack {
+				t.Errorf("IsMultitrack = %v, want %v", h.IsMultitrack(), tt.multitrack)
+			}
+			if h.IsSeq() != tt.seq {
+				t.Errorf("IsSeq = %v, want %v", h.IsSeq(), tt.seq)
+			}
+			if !reflect.DeepEqual(h.Tracks(), tt.tracks) {
+				t.Errorf("Tracks = %+v, want %+v", h.Tracks(), tt.tracks)
+			}
+		})
+	}
+}
+
+func TestParseAudioTagHeaderShort(t *testing.T) {
+	for _, data := range [][]byte{
+		{},
+		{0xaf},
+		{0x90, 'O', 'p'},
+		{0x97, 0x03, 0xaa},
+		{0x95, 0x10, 'm', 'p', '4', 'a', 0x00, 0x00, 0x00, 0x05, 0x12},
+	} {
+		if _, err := ParseAudioTagHeader(data); err == nil {
+			t.Errorf("ParseAudioTagHeader(% x) succeeded", data)
+		}
+	}
+}
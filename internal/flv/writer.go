@@ -0,0 +1,124 @@
+package flv
+
+import (
+	"fmt"
+	"io"
+
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/bitops"
+)
+
+const (
+	headerLen    = 9
+	tagHeaderLen = 11
+)
+
+/*
+File header, followed by PreviousTagSize0 = 0:
+
+	+---------+---------+--------------------+------------+
+	| "FLV"   | Version | Flags              | DataOffset |
+	| (3)     | (1)     | (1, audio 0x04 and | (4, = 9)   |
+	|         |         |  video 0x01)       |            |
+	+---------+---------+--------------------+------------+
+*/
+var fileHeader = []byte{'F', 'L', 'V', 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}
+
+// WriteHeader writes the file header announcing audio and video,
+// followed by the first PreviousTagSize.
+func WriteHeader(w io.Writer) error {
+	_, err := w.Write(fileHeader)
+	return err
+}
+
+/*
+WriteTag writes p as a tag stamped ts, followed by its PreviousTagSize.
+
+	+---------+-----------+-----------+-------------+-----------+------+
+	| TagType | DataSize  | Timestamp | TimestampEx | StreamID  | Data |
+	| (1)     | (3)       | (3)       | (1)         | (3, 0)    |      |
+	+---------+-----------+-----------+-------------+-----------+------+
+*/
+func WriteTag(w io.Writer, p *av.Packet, ts uint32) error {
+	var tagType uint8
+	switch {
+	case p.IsAudio:
+		tagType = av.TAG_AUDIO
+	case p.IsVideo:
+		tagType = av.TAG_VIDEO
+	case p.IsMetadata:
+		tagType = av.TAG_SCRIPTDATAAMF0
+	default:
+		return fmt.Errorf("flv: packet is neither audio, video nor metadata")
+	}
+
+	dataLen := len(p.Data)
+	if dataLen > 0xffffff {
+		return fmt.Errorf("flv: tag too large: %d bytes", dataLen)
+	}
+
+	var h [tagHeaderLen]byte
+	h[0] = tagType
+	bitops.PutU24BE(h[1:4], uint32(dataLen))
+	bitops.PutU24BE(h[4:7], ts&0xffffff)
+	h[7] = byte(ts >> 24)
+
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(p.Data); err != nil {
+		return err
+	}
+
+	var size [4]byte
+	bitops.PutU32BE(size[:], uint32(tagHeaderLen+dataLen))
+	_, err := w.Write(size[:])
+	return err
+}
+
+// LastTimestamp returns the timestamp of the last tag of an FLV file,
+// found through the trailing PreviousTagSize. A file without tags
+// yields 0.
+func LastTimestamp(r io.ReadSeeker) (uint32, error) {
+	var hdr [headerLen]byte
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, fmt.Errorf("flv: unable to read file header: %s", err)
+	}
+	if hdr[0] != 'F' || hdr[1] != 'L' || hdr[2] != 'V' {
+		return 0, fmt.Errorf("flv: not an flv file")
+	}
+
+	end, err := r.Seek(-4, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, err
+	}
+	prev := int64(bitops.U32BE(size[:]))
+	if prev == 0 {
+		return 0, nil
+	}
+	if prev < tagHeaderLen || end-prev < headerLen+4 {
+		return 0, fmt.Errorf("flv: invalid previous tag size %d", prev)
+	}
+
+	if _, err := r.Seek(end-prev, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	var h [tagHeaderLen]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, err
+	}
+	if int64(bitops.U24BE(h[1:4]))+tagHeaderLen != prev {
+		return 0, fmt.Errorf("flv: last tag size mismatch")
+	}
+
+	return bitops.U24BE(h[4:7]) | uint32(h[7])<<24, nil
+}
@@ -0,0 +1,57 @@
+package fmp4
+
+import (
+	"rtmp-example/internal/bitops"
+)
+
+// box returns an ISO BMFF box of type typ holding the given payloads.
+func box(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+
+	b := make([]byte, 8, size)
+	bitops.PutU32BE(b[0:4], uint32(size))
+	copy(b[4:8], typ)
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// fullBox returns a box whose payload starts with a version and flags.
+func fullBox(typ string, version uint8, flags uint32, payloads ...[]byte) []byte {
+	vf := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(typ, append([][]byte{vf}, payloads...)...)
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	bitops.PutU16BE(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	bitops.PutU32BE(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	bitops.PutU32BE(b[0:4], uint32(v>>32))
+	bitops.PutU32BE(b[4:8], uint32(v))
+	return b
+}
+
+func zeros(n int) []byte {
+	return make([]byte, n)
+}
+
+// matrix is the identity transformation matrix of mvhd and tkhd.
+var matrix = []byte{
+	0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0x00, 0x00, 0x00,
+}
@@ -0,0 +1,157 @@
+package fmp4
+
+const (
+	videoTrackID = 1
+	audioTrackID = 2
+
+	videoTimescale = 90000
+)
+
+// initSegment returns ftyp and moov describing the known tracks.
+func (m *Muxer) initSegment() []byte {
+	ftyp := box("ftyp", []byte("iso6"), u32(0), []byte("iso6cmfcmp41"))
+
+	var traks []byte
+	var trexs []byte
+	for _, t := range m.tracks() {
+		traks = append(traks, t.trak()...)
+		trexs = append(trexs, fullBox("trex", 0, 0,
+			u32(t.id),
+			u32(1), // default_sample_description_index
+			u32(0), // default_sample_duration
+			u32(0), // default_sample_size
+			u32(0), // default_sample_flags
+		)...)
+	}
+
+	mvhd := fullBox("mvhd", 0, 0,
+		u32(0), u32(0), // creation and modification time
+		u32(1000), // timescale
+		u32(0),    // duration
+		u32(0x00010000),
+		u16(0x0100),
+		zeros(10),
+		matrix,
+		zeros(24),
+		u32(audioTrackID+1), // next_track_ID
+	)
+
+	moov := box("moov", mvhd, traks, box("mvex", trexs))
+	return append(ftyp, moov...)
+}
+
+func (t *track) trak() []byte {
+	var volume uint16
+	var width, height uint32
+	handler := "vide"
+	name := "VideoHandler"
+	mediaHeader := fullBox("vmhd", 0, 1, zeros(8))
+	if t.isAudio {
+		volume = 0x0100
+		handler = "soun"
+		name = "SoundHandler"
+		mediaHeader = fullBox("smhd", 0, 0, zeros(4))
+	} else {
+		width, height = uint32(t.width)<<16, uint32(t.height)<<16
+	}
+
+	tkhd := fullBox("tkhd", 0, 0x000003,
+		u32(0), u32(0), // creation and modification time
+		u32(t.id),
+		u32(0), // reserved
+		u32(0), // duration
+		zeros(8),
+		u16(0), u16(0), // layer, alternate_group
+		u16(volume),
+		u16(0),
+		matrix,
+		u32(width), u32(height),
+	)
+
+	mdhd := fullBox("mdhd", 0, 0,
+		u32(0), u32(0),
+		u32(t.timescale),
+		u32(0),
+		u16(0x55c4), // "und"
+		u16(0),
+	)
+
+	hdlr := fullBox("hdlr", 0, 0,
+		u32(0),
+		[]byte(handler),
+		zeros(12),
+		append([]byte(name), 0),
+	)
+
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32(1), t.sampleEntry()),
+		fullBox("stts", 0, 0, u32(0)),
+		fullBox("stsc", 0, 0, u32(0)),
+		fullBox("stsz", 0, 0, u32(0), u32(0)),
+		fullBox("stco", 0, 0, u32(0)),
+	)
+
+	return box("trak", tkhd, box("mdia", mdhd, hdlr, box("minf", mediaHeader, dinf, stbl)))
+}
+
+func (t *track) sampleEntry() []byte {
+	if t.isAudio {
+		// The rate is 16.16 fixed point; higher rates are only in mdhd.
+		var rate uint32
+		if t.timescale <= 0xffff {
+			rate = t.timescale << 16
+		}
+		return box("mp4a",
+			zeros(6), u16(1), // reserved, data_reference_index
+			zeros(8),
+			u16(uint16(t.channels)), u16(16), // channelcount, samplesize
+			u16(0), u16(0),
+			u32(rate),
+			t.esds(),
+		)
+	}
+
+	compressor := zeros(32)
+	return box("avc1",
+		zeros(6), u16(1), // reserved, data_reference_index
+		zeros(16),
+		u16(uint16(t.width)), u16(uint16(t.height)),
+		u32(0x00480000), u32(0x00480000), // 72 dpi
+		u32(0),
+		u16(1), // frame_count
+		compressor,
+		u16(0x0018), u16(0xffff), // depth, pre_defined
+		box("avcC", t.config),
+	)
+}
+
+/*
+esds wraps the AudioSpecificConfig in an ES_Descriptor:
+
+	ES_Descriptor (3)
+	  DecoderConfigDescriptor (4), MPEG-4 audio
+	    DecoderSpecificInfo (5), the AudioSpecificConfig
+	  SLConfigDescriptor (6)
+*/
+func (t *track) esds() []byte {
+	dsi := append([]byte{0x05, byte(len(t.config))}, t.config...)
+
+	dcd := []byte{0x04, byte(13 + len(dsi)),
+		0x40,             // objectTypeIndication: MPEG-4 audio
+		0x15,             // streamType: audio
+		0x00, 0x00, 0x00, // bufferSizeDB
+	}
+	dcd = append(dcd, u32(0)...) // maxBitrate
+	dcd = append(dcd, u32(0)...) // avgBitrate
+	dcd = append(dcd, dsi...)
+
+	sl := []byte{0x06, 0x01, 0x02}
+
+	es := []byte{0x03, byte(3 + len(dcd) + len(sl)), 0x00, 0x00, 0x00}
+	es = append(es, dcd...)
+	es = append(es, sl...)
+
+	return fullBox("esds", 0, 0, es)
+}
@@ -0,0 +1,302 @@
+package fmp4
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"rtmp-example/internal/aac"
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/h264"
+)
+
+var ErrUnsupportedCodec = errors.New("fmp4: unsupported codec")
+
+// Sample flags of trun.
+const (
+	flagsSync    = 0x02000000 // depends on no other sample
+	flagsNonSync = 0x01010000 // depends on others, not a sync sample
+)
+
+/*
+Muxer turns FLV packets into CMAF fragmented MP4: an init segment
+holding an H.264 and an AAC track, followed by moof/mdat fragments.
+
+Each fragment holds a single sample. The duration of a sample is only
+known from the next one of its track, so Mux writes the previous
+sample of p's track, and p itself goes out with the next call or with
+Flush. Video samples keep their composition time offset, carried by a
+version 1 trun as a signed value.
+
+A sequence header that differs from the current one flushes the
+pending sample of its track and changes the init segment, whose
+Version is then bumped.
+*/
+type Muxer struct {
+	video   *track
+	audio   *track
+	seq     uint32
+	version int
+}
+
+type track struct {
+	id        uint32
+	isAudio   bool
+	timescale uint32
+	config    []byte
+
+	width    int
+	height   int
+	channels int
+
+	pending      *sample
+	lastDuration uint32
+}
+
+type sample struct {
+	dts  uint64
+	cts  int32
+	key  bool
+	data []byte
+}
+
+func NewMuxer() *Muxer {
+	return &Muxer{}
+}
+
+// HasVideo reports whether an AVC sequence header has been seen.
+func (m *Muxer) HasVideo() bool {
+	return m.video != nil
+}
+
+// HasAudio reports whether an AAC sequence header has been seen.
+func (m *Muxer) HasAudio() bool {
+	return m.audio != nil
+}
+
+// Version changes whenever the init segment does.
+func (m *Muxer) Version() int {
+	return m.version
+}
+
+// WriteInit writes the init segment for the tracks known so far.
+func (m *Muxer) WriteInit(w io.Writer) error {
+	_, err := w.Write(m.initSegment())
+	return err
+}
+
+func (m *Muxer) tracks() []*track {
+	var ret []*track
+	if m.video != nil {
+		ret = append(ret, m.video)
+	}
+	if m.audio != nil {
+		ret = append(ret, m.audio)
+	}
+	return ret
+}
+
+// Mux queues p and writes the sample it completes to w. p.Header must
+// have been parsed.
+func (m *Muxer) Mux(p *av.Packet, w io.Writer) error {
+	switch {
+	case p.IsVideo:
+		return m.muxVideo(p, w)
+	case p.IsAudio:
+		return m.muxAudio(p, w)
+	}
+	return nil
+}
+
+func (m *Muxer) muxVideo(p *av.Packet, w io.Writer) error {
+	vh, ok := p.Header.(av.VideoPacketHeader)
+	if !ok {
+		return fmt.Errorf("fmp4: video packet without header")
+	}
+	if vh.CodecID() != av.VIDEO_H264 {
+		return ErrUnsupportedCodec
+	}
+
+	data := p.Data[5:]
+	if vh.IsSeq() {
+		c, err := h264.ParseDecoderConfig(data)
+		if err != nil {
+			return err
+		}
+		sps, err := c.SPSInfo()
+		if err != nil {
+			return err
+		}
+		if m.video != nil && bytes.Equal(m.video.config, data) {
+			return nil
+		}
+		if err := m.flushTrack(w, m.video); err != nil {
+			return err
+		}
+		m.video = &track{
+			id:        videoTrackID,
+			timescale: videoTimescale,
+			config:    append([]byte(nil), data...),
+			width:     sps.Width,
+			height:    sps.Height,
+		}
+		m.version++
+		return nil
+	}
+	if p.Data[1] != av.AVC_NALU || m.video == nil {
+		return nil
+	}
+
+	t := m.video
+	return m.queue(w, t, &sample{
+		dts:  uint64(p.TimeStamp) * uint64(t.timescale) / 1000,
+		cts:  int32(int64(vh.CompositionTime()) * int64(t.timescale) / 1000),
+		key:  vh.IsKeyFrame(),
+		data: data,
+	})
+}
+
+func (m *Muxer) muxAudio(p *av.Packet, w io.Writer) error {
+	ah, ok := p.Header.(av.AudioPacketHeader)
+	if !ok {
+		return fmt.Errorf("fmp4: audio packet without header")
+	}
+	if ah.SoundFormat() != av.SOUND_AAC {
+		return ErrUnsupportedCodec
+	}
+
+	data := p.Data[2:]
+	if ah.AACPacketType() == av.AAC_SEQHDR {
+		c, err := aac.ParseConfig(data)
+		if err != nil {
+			return err
+		}
+		if m.audio != nil && bytes.Equal(m.audio.config, data) {
+			return nil
+		}
+		if err := m.flushTrack(w, m.audio); err != nil {
+			return err
+		}
+
+		channels := c.Channels()
+		if channels == 0 {
+			channels = 2
+		}
+		m.audio = &track{
+			id:        audioTrackID,
+			isAudio:   true,
+			timescale: uint32(c.Frequency),
+			config:    append([]byte(nil), data...),
+			channels:  channels,
+		}
+		m.version++
+		return nil
+	}
+	if m.audio == nil {
+		return nil
+	}
+
+	t := m.audio
+	return m.queue(w, t, &sample{
+		dts:  uint64(p.TimeStamp) * uint64(t.timescale) / 1000,
+		key:  true,
+		data: data,
+	})
+}
+
+// queue makes s the pending sample of t, writing the previous one.
+func (m *Muxer) queue(w io.Writer, t *track, s *sample) error {
+	prev := t.pending
+	t.pending = s
+	if prev == nil {
+		return nil
+	}
+
+	if s.dts > prev.dts {
+		t.lastDuration = uint32(s.dts - prev.dts)
+	}
+	return m.writeFragment(w, t, prev, t.lastDuration)
+}
+
+// Flush writes the pending samples, reusing the last known duration
+// of their tracks.
+func (m *Muxer) Flush(w io.Writer) error {
+	for _, t := range m.tracks() {
+		if err := m.flushTrack(w, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Muxer) flushTrack(w io.Writer, t *track) error {
+	if t == nil || t.pending == nil {
+		return nil
+	}
+
+	d := t.lastDuration
+	if d == 0 {
+		d = t.defaultDuration()
+	}
+	s := t.pending
+	t.pending = nil
+	return m.writeFragment(w, t, s, d)
+}
+
+func (t *track) defaultDuration() uint32 {
+	if t.isAudio {
+		return 1024
+	}
+	return t.timescale / 30
+}
+
+/*
+writeFragment writes s as moof and mdat:
+
+	moof
+	  mfhd   sequence number
+	  traf
+	    tfhd   track, base data offset at moof
+	    tfdt   decode time of s
+	    trun   duration, size, flags and composition offset of s
+	mdat
+*/
+func (m *Muxer) writeFragment(w io.Writer, t *track, s *sample, duration uint32) error {
+	m.seq++
+
+	flags := uint32(flagsNonSync)
+	if s.key {
+		flags = flagsSync
+	}
+
+	// data_offset points past moof and the mdat header. trun has a
+	// fixed size, so moof is built once with a placeholder.
+	trun := func(offset uint32) []byte {
+		return fullBox("trun", 1, 0x000f01,
+			u32(1), // sample_count
+			u32(offset),
+			u32(duration),
+			u32(uint32(len(s.data))),
+			u32(flags),
+			u32(uint32(s.cts)),
+		)
+	}
+	moof := func(offset uint32) []byte {
+		return box("moof",
+			fullBox("mfhd", 0, 0, u32(m.seq)),
+			box("traf",
+				fullBox("tfhd", 0, 0x020000, u32(t.id)),
+				fullBox("tfdt", 1, 0, u64(s.dts)),
+				trun(offset),
+			),
+		)
+	}
+
+	size := len(moof(0))
+	b := moof(uint32(size + 8))
+	b = append(b, box("mdat", s.data)...)
+
+	_, err := w.Write(b)
+	return err
+}
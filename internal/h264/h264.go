@@ -0,0 +1,129 @@
+package h264
+
+import (
+	"fmt"
+
+	"rtmp-example/internal/bitops"
+)
+
+// NAL unit types.
+const (
+	NALU_NONIDR = 1
+	NALU_IDR    = 5
+	NALU_SEI    = 6
+	NALU_SPS    = 7
+	NALU_PPS    = 8
+	NALU_AUD    = 9
+)
+
+// StartCode prefixes every NAL unit of an Annex B byte stream.
+var StartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// NALUType returns the type of the NAL unit nalu.
+func NALUType(nalu []byte) uint8 {
+	if len(nalu) == 0 {
+		return 0
+	}
+	return nalu[0] & 0x1f
+}
+
+/*
+DecoderConfig is the AVCDecoderConfigurationRecord carried by AVC
+sequence headers:
+
+	+---------+---------+-------------+-------+-------------------+
+	| Version | Profile | Compat.     | Level | 6 bits reserved,  |
+	| (1)     | (1)     | (1)         | (1)   | LengthSizeMinus1  |
+	+---------+---------+-------------+-------+-------------------+
+	| 3 bits reserved, NumSPS (5) | { Length (2) | SPS } ...      |
+	+-----------------------------+-------------------------------+
+	| NumPPS (1)                  | { Length (2) | PPS } ...      |
+	+-----------------------------+-------------------------------+
+*/
+type DecoderConfig struct {
+	Profile       uint8
+	Compatibility uint8
+	Level         uint8
+	LengthSize    int
+	SPS           [][]byte
+	PPS           [][]byte
+}
+
+// ParseDecoderConfig decodes an AVCDecoderConfigurationRecord.
+func ParseDecoderConfig(b []byte) (*DecoderConfig, error) {
+	if len(b) < 7 {
+		return nil, fmt.Errorf("h264: decoder config too short: %d bytes", len(b))
+	}
+	if b[0] != 1 {
+		return nil, fmt.Errorf("h264: unknown decoder config version %d", b[0])
+	}
+
+	c := &DecoderConfig{
+		Profile:       b[1],
+		Compatibility: b[2],
+		Level:         b[3],
+		LengthSize:    int(b[4]&0x03) + 1,
+	}
+
+	var err error
+	n := int(b[5] & 0x1f)
+	b = b[6:]
+	if c.SPS, b, err = readParamSets(b, n); err != nil {
+		return nil, err
+	}
+
+	if len(b) < 1 {
+		return nil, fmt.Errorf("h264: decoder config has no pps count")
+	}
+	n = int(b[0])
+	if c.PPS, _, err = readParamSets(b[1:], n); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Codec returns the RFC 6381 codecs parameter of the stream, such as
+// avc1.64001f.
+func (c *DecoderConfig) Codec() string {
+	return fmt.Sprintf("avc1.%02x%02x%02x", c.Profile, c.Compatibility, c.Level)
+}
+
+func readParamSets(b []byte, n int) ([][]byte, []byte, error) {
+	ret := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		if len(b) < 2 {
+			return nil, nil, fmt.Errorf("h264: truncated parameter set")
+		}
+		size := int(bitops.U16BE(b))
+		if len(b) < 2+size {
+			return nil, nil, fmt.Errorf("h264: truncated parameter set")
+		}
+		ret = append(ret, b[2:2+size])
+		b = b[2+size:]
+	}
+	return ret, b, nil
+}
+
+// SplitNALUs splits the length prefixed NAL units of an AVC frame.
+func SplitNALUs(b []byte, lengthSize int) ([][]byte, error) {
+	var ret [][]byte
+	for len(b) > 0 {
+		if len(b) < lengthSize {
+			return nil, fmt.Errorf("h264: truncated nalu length")
+		}
+
+		var size int
+		for i := 0; i < lengthSize; i++ {
+			size = size<<8 | int(b[i])
+		}
+		b = b[lengthSize:]
+
+		if size > len(b) {
+			return nil, fmt.Errorf("h264: nalu of %d bytes exceeds frame", size)
+		}
+		ret = append(ret, b[:size])
+		b = b[size:]
+	}
+	return ret, nil
+}
@@ -0,0 +1,296 @@
+package h264
+
+import (
+	"fmt"
+)
+
+/*
+SPS holds the fields of a sequence parameter set needed to describe a
+stream. Width and Height are the displayed size, after cropping.
+FrameRate comes from the VUI timing information and is 0 when the
+encoder did not send it.
+*/
+type SPS struct {
+	ID              uint
+	ProfileIDC      uint8
+	ConstraintFlags uint8
+	LevelIDC        uint8
+	ChromaFormatIDC uint
+	BitDepthLuma    uint
+	BitDepthChroma  uint
+	Width           int
+	Height          int
+	FrameRate       float64
+}
+
+// profiles with chroma format, bit depth and scaling matrix fields.
+var highProfiles = map[uint8]bool{
+	100: true, 110: true, 122: true, 244: true, 44: true, 83: true,
+	86: true, 118: true, 128: true, 138: true, 139: true, 134: true, 135: true,
+}
+
+// ParseSPS decodes the SPS NAL unit nalu, header byte included.
+func ParseSPS(nalu []byte) (*SPS, error) {
+	if NALUType(nalu) != NALU_SPS {
+		return nil, fmt.Errorf("h264: nal unit type %d is not an sps", NALUType(nalu))
+	}
+	if len(nalu) < 4 {
+		return nil, fmt.Errorf("h264: sps too short: %d bytes", len(nalu))
+	}
+
+	r := newBitReader(unescapeRBSP(nalu[1:]))
+	s := &SPS{
+		ProfileIDC:      uint8(r.bits(8)),
+		ConstraintFlags: uint8(r.bits(8)),
+		LevelIDC:        uint8(r.bits(8)),
+		ID:              r.ue(),
+		ChromaFormatIDC: 1,
+		BitDepthLuma:    8,
+		BitDepthChroma:  8,
+	}
+
+	separateColourPlane := false
+	if highProfiles[s.ProfileIDC] {
+		s.ChromaFormatIDC = r.ue()
+		if s.ChromaFormatIDC == 3 {
+			separateColourPlane = r.flag()
+		}
+		s.BitDepthLuma = r.ue() + 8
+		s.BitDepthChroma = r.ue() + 8
+		r.flag() // qpprime_y_zero_transform_bypass_flag
+		if r.flag() {
+			n := 8
+			if s.ChromaFormatIDC == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				if !r.flag() {
+					continue
+				}
+				if i < 6 {
+					r.scalingList(16)
+				} else {
+					r.scalingList(64)
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.flag() // delta_pic_order_always_zero_flag
+		r.se()   // offset_for_non_ref_pic
+		r.se()   // offset_for_top_to_bottom_field
+		n := r.ue()
+		for i := uint(0); i < n && r.err == nil; i++ {
+			r.se()
+		}
+	}
+	r.ue()   // max_num_ref_frames
+	r.flag() // gaps_in_frame_num_value_allowed_flag
+
+	widthMbs := int(r.ue()) + 1
+	heightMapUnits := int(r.ue()) + 1
+	frameMbsOnly := r.flag()
+	if !frameMbsOnly {
+		r.flag() // mb_adaptive_frame_field_flag
+	}
+	r.flag() // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom int
+	if r.flag() {
+		cropLeft = int(r.ue())
+		cropRight = int(r.ue())
+		cropTop = int(r.ue())
+		cropBottom = int(r.ue())
+	}
+
+	fieldFactor := 2
+	if frameMbsOnly {
+		fieldFactor = 1
+	}
+
+	// Cropping is counted in chroma samples, and in field pairs for
+	// interlaced streams.
+	cropX, cropY := 1, fieldFactor
+	if !separateColourPlane {
+		switch s.ChromaFormatIDC {
+		case 1:
+			cropX, cropY = 2, 2*fieldFactor
+		case 2:
+			cropX = 2
+		}
+	}
+
+	s.Width = widthMbs*16 - cropX*(cropLeft+cropRight)
+	s.Height = fieldFactor*heightMapUnits*16 - cropY*(cropTop+cropBottom)
+
+	if r.err != nil {
+		return nil, fmt.Errorf("h264: truncated sps")
+	}
+	if s.Width <= 0 || s.Height <= 0 {
+		return nil, fmt.Errorf("h264: invalid sps size %dx%d", s.Width, s.Height)
+	}
+
+	// Some encoders truncate the VUI; the size is still good.
+	if r.flag() {
+		s.FrameRate = r.vuiFrameRate()
+	}
+	return s, nil
+}
+
+// PPS holds the leading fields of a picture parameter set.
+type PPS struct {
+	ID    uint
+	SPSID uint
+	CABAC bool
+}
+
+// ParsePPS decodes the PPS NAL unit nalu, header byte included.
+func ParsePPS(nalu []byte) (*PPS, error) {
+	if NALUType(nalu) != NALU_PPS {
+		return nil, fmt.Errorf("h264: nal unit type %d is not a pps", NALUType(nalu))
+	}
+
+	r := newBitReader(unescapeRBSP(nalu[1:]))
+	p := &PPS{
+		ID:    r.ue(),
+		SPSID: r.ue(),
+		CABAC: r.flag(),
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("h264: truncated pps")
+	}
+	return p, nil
+}
+
+// SPSInfo parses the first SPS of the decoder config.
+func (c *DecoderConfig) SPSInfo() (*SPS, error) {
+	if len(c.SPS) == 0 {
+		return nil, fmt.Errorf("h264: decoder config has no sps")
+	}
+	return ParseSPS(c.SPS[0])
+}
+
+// vuiFrameRate skips the VUI fields preceding the timing information
+// and returns the frame rate it gives, or 0.
+func (r *bitReader) vuiFrameRate() float64 {
+	if r.flag() { // aspect_ratio_info_present_flag
+		if r.bits(8) == 255 { // Extended_SAR
+			r.bits(16)
+			r.bits(16)
+		}
+	}
+	if r.flag() { // overscan_info_present_flag
+		r.flag()
+	}
+	if r.flag() { // video_signal_type_present_flag
+		r.bits(4) // video_format, video_full_range_flag
+		if r.flag() {
+			r.bits(24) // colour primaries, transfer and matrix
+		}
+	}
+	if r.flag() { // chroma_loc_info_present_flag
+		r.ue()
+		r.ue()
+	}
+	if !r.flag() { // timing_info_present_flag
+		return 0
+	}
+
+	unitsInTick := r.bits(32)
+	timeScale := r.bits(32)
+	if r.err != nil || unitsInTick == 0 {
+		return 0
+	}
+	// A frame lasts two ticks, one per field.
+	return float64(timeScale) / float64(2*unitsInTick)
+}
+
+// scalingList skips a scaling list of size entries.
+func (r *bitReader) scalingList(size int) {
+	last, next := 8, 8
+	for i := 0; i < size && r.err == nil; i++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// unescapeRBSP removes the emulation prevention bytes of a NAL unit
+// payload, the 0x03 in 0x000003.
+func unescapeRBSP(b []byte) []byte {
+	ret := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 0x03 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+// bitReader reads the bit fields of a parameter set. Reading past the
+// end sets err and yields zeros.
+type bitReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func newBitReader(b []byte) *bitReader {
+	return &bitReader{b: b}
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.b)*8 {
+			r.err = fmt.Errorf("h264: read past end")
+			return 0
+		}
+		bit := r.b[r.pos/8] >> (7 - r.pos%8) & 1
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) flag() bool {
+	return r.bits(1) == 1
+}
+
+// ue reads an unsigned Exp-Golomb code.
+func (r *bitReader) ue() uint {
+	zeros := 0
+	for !r.flag() {
+		if r.err != nil || zeros > 31 {
+			r.err = fmt.Errorf("h264: invalid exp-golomb code")
+			return 0
+		}
+		zeros++
+	}
+	return uint(1)<<zeros - 1 + uint(r.bits(zeros))
+}
+
+// se reads a signed Exp-Golomb code.
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v&1 == 1 {
+		return int(v+1) / 2
+	}
+	return -int(v / 2)
+}
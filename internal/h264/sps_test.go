@@ -0,0 +1,149 @@
+package h264
+
+import (
+	"encoding/hex"
+	"math"
+	"testing"
+)
+
+func TestParseSPS(t *testing.T) {
+	tests := []struct {
+		name      string
+		sps       string
+		profile   uint8
+		level     uint8
+		chroma    uint
+		width     int
+		height    int
+		frameRate float64
+	}{
+		{
+			name:      "x264 high 720p24",
+			sps:       "6764001facd9405005bb011000000300100000030300f1831960",
+			profile:   100,
+			level:     31,
+			chroma:    1,
+			width:     1280,
+			height:    720,
+			frameRate: 24,
+		},
+		{
+			name:      "x264 high 1080p30 cropped from 1088",
+			sps:       "67640028acd940780227e5c044000003000400000300f03c60c658",
+			profile:   100,
+			level:     40,
+			chroma:    1,
+			width:     1920,
+			height:    1080,
+			frameRate: 30,
+		},
+		{
+			name:      "main 1080p25",
+			sps:       "674d4028eca03c0113f2e02d4040405000000300100000030320f1831960",
+			profile:   77,
+			level:     40,
+			chroma:    1,
+			width:     1920,
+			height:    1080,
+			frameRate: 25,
+		},
+		{
+			name:      "high 2160p30",
+			sps:       "67640033ac2ca400f0010fb0110000030001000003003c0f18b6a0",
+			profile:   100,
+			level:     51,
+			chroma:    1,
+			width:     3840,
+			height:    2160,
+			frameRate: 30,
+		},
+		{
+			// 45x18 field pair macroblocks cropped by 1 unit on every
+			// side, vertical units counting two rows per field
+			name:      "interlaced crop",
+			sps:       "674d0028d940b424e9250800000300080000030196",
+			profile:   77,
+			level:     40,
+			chroma:    1,
+			width:     720 - 2*2,
+			height:    576 - 2*4,
+			frameRate: 25,
+		},
+		{
+			// high 4:2:2 with a scaling matrix, cropped to 632x360
+			name:    "4:2:2 crop",
+			sps:     "677a0028bda4924924924900d940a02fe58940",
+			profile: 122,
+			level:   40,
+			chroma:  2,
+			width:   632,
+			height:  360,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := hex.DecodeString(tt.sps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := ParseSPS(b)
+			if err != nil {
+				t.Fatalf("ParseSPS: %v", err)
+			}
+			if s.ProfileIDC != tt.profile || s.LevelIDC != tt.level || s.ChromaFormatIDC != tt.chroma {
+				t.Errorf("profile, level, chroma = %d, %d, %d, want %d, %d, %d",
+					s.ProfileIDC, s.LevelIDC, s.ChromaFormatIDC, tt.profile, tt.level, tt.chroma)
+			}
+			if s.Width != tt.width || s.Height != tt.height {
+				t.Errorf("size = %dx%d, want %dx%d", s.Width, s.Height, tt.width, tt.height)
+			}
+			if math.Abs(s.FrameRate-tt.frameRate) > 0.01 {
+				t.Errorf("FrameRate = %f, want %f", s.FrameRate, tt.frameRate)
+			}
+		})
+	}
+}
+
+func TestParseSPSErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		sps  string
+	}{
+		{"pps", "68ebe3cb22c0"},
+		{"too short", "6764"},
+		{"truncated", "6764001facd9"},
+		{"cropped to nothing", "67420028ecaf94ba"},
+	}
+	for _, tt := range tests {
+		b, _ := hex.DecodeString(tt.sps)
+		if _, err := ParseSPS(b); err == nil {
+			t.Errorf("%s: ParseSPS succeeded", tt.name)
+		}
+	}
+}
+
+func TestParsePPS(t *testing.T) {
+	tests := []struct {
+		name  string
+		pps   string
+		id    uint
+		spsID uint
+		cabac bool
+	}{
+		{"x264 high", "68ebe3cb22c0", 0, 0, true},
+		{"baseline", "68ce3c80", 0, 0, false},
+		{"ids", "6822c0", 3, 1, true},
+	}
+	for _, tt := range tests {
+		b, _ := hex.DecodeString(tt.pps)
+		p, err := ParsePPS(b)
+		if err != nil {
+			t.Errorf("%s: ParsePPS: %v", tt.name, err)
+			continue
+		}
+		if p.ID != tt.id || p.SPSID != tt.spsID || p.CABAC != tt.cabac {
+			t.Errorf("%s: ParsePPS = %+v", tt.name, p)
+		}
+	}
+}
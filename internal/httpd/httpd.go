@@ -0,0 +1,158 @@
+package httpd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultShutdownTimeout = 10 * time.Second
+
+// ErrServing is returned when a server is started twice.
+var ErrServing = errors.New("httpd: server is already serving")
+
+/*
+Server runs the http.Server of the HTTP-FLV, HLS and DASH servers:
+
+	hs, err := srv.httpd.Start(srv)
+	if err != nil {
+		listen.Close()
+		return err
+	}
+	// register on the hub, log...
+	return httpd.Run(ctx, hs, listen, srv.Shutdown, srv.ShutdownTimeout)
+
+The zero value is ready to use.
+*/
+type Server struct {
+	mu      sync.Mutex
+	closing bool
+	server  *http.Server
+}
+
+// Listen listens on host:port.
+func Listen(host string, port int) (net.Listener, error) {
+	return net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// Start sets up the http.Server serving h. It returns
+// http.ErrServerClosed after Shutdown, and ErrServing when s was
+// already started.
+func (s *Server) Start(h http.Handler) (*http.Server, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return nil, http.ErrServerClosed
+	}
+	if s.server != nil {
+		return nil, ErrServing
+	}
+	s.server = &http.Server{Handler: h}
+	return s.server, nil
+}
+
+// Shutdown shuts the server down, see http.Server.Shutdown.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	hs := s.server
+	s.mu.Unlock()
+
+	if hs == nil {
+		return nil
+	}
+	return hs.Shutdown(ctx)
+}
+
+// Run serves requests on listen until hs is shut down. Once ctx is
+// cancelled, shutdown is called with a context bounded by timeout, zero
+// meaning 10 seconds, and its error is returned. Otherwise Run returns
+// the error of hs.Serve.
+func Run(ctx context.Context, hs *http.Server, listen net.Listener, shutdown func(context.Context) error, timeout time.Duration) error {
+	shutdownErr := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if timeout <= 0 {
+				timeout = defaultShutdownTimeout
+			}
+			sctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			shutdownErr <- shutdown(sctx)
+		case <-stop:
+		}
+	}()
+
+	err := hs.Serve(listen)
+	if err == http.ErrServerClosed && ctx.Err() != nil {
+		if serr := <-shutdownErr; serr != nil {
+			return serr
+		}
+	}
+	return err
+}
+
+// Accept sets the CORS headers of the response and answers preflight
+// requests and methods other than GET and HEAD. It reports whether the
+// request is left to the caller.
+func Accept(w http.ResponseWriter, r *http.Request, allowOrigin string) bool {
+	setCORS(w.Header(), r, allowOrigin)
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+	return false
+}
+
+func setCORS(h http.Header, r *http.Request, origin string) {
+	if origin == "" {
+		origin = "*"
+	} else {
+		h.Add("Vary", "Origin")
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+
+	if r.Method == http.MethodOptions {
+		h.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+		if req := r.Header.Get("Access-Control-Request-Headers"); req != "" {
+			h.Set("Access-Control-Allow-Headers", req)
+		}
+		h.Set("Access-Control-Max-Age", "86400")
+	}
+}
+
+// ServeData answers with data, or 404 when data is nil.
+func ServeData(w http.ResponseWriter, r *http.Request, contentType string, data []byte) {
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(data)
+}
+
+// ValidKey reports whether key has the app/stream form.
+func ValidKey(key string) bool {
+	app, name, ok := strings.Cut(key, "/")
+	return ok && app != "" && name != "" && !strings.Contains(name, "/")
+}
@@ -0,0 +1,35 @@
+package mediaseg
+
+import (
+	"time"
+
+	"rtmp-example/internal/av"
+)
+
+// StartsSegment reports whether p may start a segment: a keyframe, or
+// any audio frame when there is no video.
+func StartsSegment(p *av.Packet, hasVideo bool) bool {
+	if hasVideo {
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		return p.IsVideo && ok && vh.IsKeyFrame()
+	}
+	return p.IsAudio
+}
+
+func IsSeqHeader(p *av.Packet) bool {
+	switch h := p.Header.(type) {
+	case av.VideoPacketHeader:
+		return p.IsVideo && h.IsSeq()
+	case av.AudioPacketHeader:
+		return p.IsAudio && h.SoundFormat() == av.SOUND_AAC && h.AACPacketType() == av.AAC_SEQHDR
+	}
+	return false
+}
+
+// Span returns the duration between two timestamps in milliseconds.
+func Span(start, end uint32) time.Duration {
+	if end <= start {
+		return 0
+	}
+	return time.Duration(end-start) * time.Millisecond
+}
@@ -7,10 +7,17 @@ type Pool struct {
 
 const maxpoolsize = 500 * 1024
 
+// Get hands out size bytes from the current buffer. Once the buffer is
+// exhausted a fresh one is allocated, so slices returned earlier are never
+// overwritten and may safely outlive the next call.
 func (pool *Pool) Get(size int) []byte {
+	if size > maxpoolsize {
+		return make([]byte, size)
+	}
+
 	if maxpoolsize-pool.pos < size {
 		pool.pos = 0
-		pool.buf = make([]byte, size)
+		pool.buf = make([]byte, maxpoolsize)
 	}
 
 	b := pool.buf[pool.pos : pool.pos+size]
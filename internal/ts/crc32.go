@@ -0,0 +1,26 @@
+package ts
+
+// crcTable is the MPEG-2 CRC32 table: polynomial 0x04c11db7, not
+// reflected, which hash/crc32 does not provide.
+var crcTable = func() (t [256]uint32) {
+	for i := range t {
+		c := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if c&0x80000000 != 0 {
+				c = c<<1 ^ 0x04c11db7
+			} else {
+				c <<= 1
+			}
+		}
+		t[i] = c
+	}
+	return
+}()
+
+func crc32(b []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, v := range b {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^v]
+	}
+	return crc
+}
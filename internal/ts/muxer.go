@@ -0,0 +1,373 @@
+package ts
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"rtmp-example/internal/aac"
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/bitops"
+	"rtmp-example/internal/h264"
+)
+
+const (
+	PacketSize = 188
+
+	pidPAT   = 0x0000
+	pidPMT   = 0x1000
+	pidVideo = 0x0100
+	pidAudio = 0x0101
+
+	streamTypeH264 = 0x1b
+	streamTypeAAC  = 0x0f
+
+	streamIDVideo = 0xe0
+	streamIDAudio = 0xc0
+)
+
+var ErrUnsupportedCodec = errors.New("ts: unsupported codec")
+
+// audSample is an access unit delimiter starting every video PES.
+var audSample = []byte{0x00, 0x00, 0x00, 0x01, 0x09, 0xf0}
+
+/*
+Muxer turns FLV packets into an MPEG-TS stream holding one program
+with an H.264 and an AAC elementary stream.
+
+Sequence headers are kept and produce no output. Video frames are
+converted to Annex B, with SPS and PPS repeated before every keyframe,
+and AAC frames get an ADTS header. The PCR is carried by the video
+stream, or by the audio stream when there is no video.
+
+WriteTables starts a new segment: it writes PAT and PMT listing the
+streams seen so far. Continuity counters run across segments.
+*/
+type Muxer struct {
+	avc *h264.DecoderConfig
+	aac *aac.Config
+
+	cc  map[uint16]uint8
+	pkt [PacketSize]byte
+}
+
+func NewMuxer() *Muxer {
+	return &Muxer{
+		cc: make(map[uint16]uint8),
+	}
+}
+
+// HasVideo reports whether an AVC sequence header has been seen.
+func (m *Muxer) HasVideo() bool {
+	return m.avc != nil
+}
+
+// HasAudio reports whether an AAC sequence header has been seen.
+func (m *Muxer) HasAudio() bool {
+	return m.aac != nil
+}
+
+// Mux writes p to w. p.Header must have been parsed.
+func (m *Muxer) Mux(p *av.Packet, w io.Writer) error {
+	switch {
+	case p.IsVideo:
+		return m.muxVideo(p, w)
+	case p.IsAudio:
+		return m.muxAudio(p, w)
+	}
+	return nil
+}
+
+func (m *Muxer) muxVideo(p *av.Packet, w io.Writer) error {
+	vh, ok := p.Header.(av.VideoPacketHeader)
+	if !ok {
+		return fmt.Errorf("ts: video packet without header")
+	}
+	if vh.CodecID() != av.VIDEO_H264 {
+		return ErrUnsupportedCodec
+	}
+
+	data := p.Data[5:]
+	if vh.IsSeq() {
+		c, err := h264.ParseDecoderConfig(data)
+		if err != nil {
+			return err
+		}
+		m.avc = c
+		return nil
+	}
+	if p.Data[1] != av.AVC_NALU || m.avc == nil {
+		return nil
+	}
+
+	nalus, err := h264.SplitNALUs(data, m.avc.LengthSize)
+	if err != nil {
+		return err
+	}
+
+	key := vh.IsKeyFrame()
+	es := make([]byte, 0, len(data)+len(audSample)+64)
+	es = append(es, audSample...)
+
+	hasParams := false
+	for _, nalu := range nalus {
+		if t := h264.NALUType(nalu); t == h264.NALU_SPS || t == h264.NALU_PPS {
+			hasParams = true
+		}
+	}
+	if key && !hasParams {
+		for _, ps := range append(append([][]byte{}, m.avc.SPS...), m.avc.PPS...) {
+			es = append(es, h264.StartCode...)
+			es = append(es, ps...)
+		}
+	}
+
+	for _, nalu := range nalus {
+		if h264.NALUType(nalu) == h264.NALU_AUD {
+			continue
+		}
+		es = append(es, h264.StartCode...)
+		es = append(es, nalu...)
+	}
+
+	dts := int64(p.TimeStamp) * 90
+	pts := dts + int64(vh.CompositionTime())*90
+	if pts < 0 {
+		// a negative composition time at the start of the stream
+		// would wrap around the 33 bit PTS
+		pts = 0
+	}
+	return m.writePES(w, pidVideo, streamIDVideo, pts, dts, key, es)
+}
+
+func (m *Muxer) muxAudio(p *av.Packet, w io.Writer) error {
+	ah, ok := p.Header.(av.AudioPacketHeader)
+	if !ok {
+		return fmt.Errorf("ts: audio packet without header")
+	}
+	if ah.SoundFormat() != av.SOUND_AAC {
+		return ErrUnsupportedCodec
+	}
+
+	data := p.Data[2:]
+	if ah.AACPacketType() == av.AAC_SEQHDR {
+		c, err := aac.ParseConfig(data)
+		if err != nil {
+			return err
+		}
+		if _, err := c.ADTSHeader(0); err != nil {
+			return err
+		}
+		m.aac = c
+		return nil
+	}
+	if m.aac == nil {
+		return nil
+	}
+
+	es, err := m.aac.ADTS(data)
+	if err != nil {
+		return err
+	}
+
+	pts := int64(p.TimeStamp) * 90
+	return m.writePES(w, pidAudio, streamIDAudio, pts, pts, !m.HasVideo(), es)
+}
+
+// WriteTables writes PAT and PMT for the streams seen so far.
+func (m *Muxer) WriteTables(w io.Writer) error {
+	// One program, whose PMT lists the elementary streams.
+	pat := []byte{
+		0x00,       // table_id
+		0xb0, 0x00, // section_syntax_indicator, section_length
+		0x00, 0x01, // transport_stream_id
+		0xc1,       // version 0, current_next_indicator
+		0x00, 0x00, // section_number, last_section_number
+		0x00, 0x01, // program_number
+		0xe0 | pidPMT>>8, pidPMT & 0xff,
+	}
+	if err := m.writeSection(w, pidPAT, pat); err != nil {
+		return err
+	}
+
+	pcrPID := uint16(pidVideo)
+	if !m.HasVideo() {
+		pcrPID = pidAudio
+	}
+
+	pmt := []byte{
+		0x02,       // table_id
+		0xb0, 0x00, // section_syntax_indicator, section_length
+		0x00, 0x01, // program_number
+		0xc1,       // version 0, current_next_indicator
+		0x00, 0x00, // section_number, last_section_number
+		0xe0 | byte(pcrPID>>8), byte(pcrPID),
+		0xf0, 0x00, // program_info_length
+	}
+	if m.HasVideo() {
+		pmt = append(pmt, streamTypeH264, 0xe0|pidVideo>>8, pidVideo&0xff, 0xf0, 0x00)
+	}
+	if m.HasAudio() {
+		pmt = append(pmt, streamTypeAAC, 0xe0|pidAudio>>8, pidAudio&0xff, 0xf0, 0x00)
+	}
+	return m.writeSection(w, pidPMT, pmt)
+}
+
+// writeSection completes the section length and CRC of a PSI table
+// and writes it in a single packet.
+func (m *Muxer) writeSection(w io.Writer, pid uint16, section []byte) error {
+	size := len(section) - 3 + 4
+	section[1] |= byte(size>>8) & 0x0f
+	section[2] = byte(size)
+
+	var crc [4]byte
+	bitops.PutU32BE(crc[:], crc32(section))
+	section = append(section, crc[:]...)
+
+	pkt := m.pkt[:]
+	for i := range pkt {
+		pkt[i] = 0xff
+	}
+	pkt[0] = 0x47
+	pkt[1] = 0x40 | byte(pid>>8)&0x1f
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10 | m.nextCC(pid)
+	pkt[4] = 0x00 // pointer_field
+	copy(pkt[5:], section)
+
+	_, err := w.Write(pkt)
+	return err
+}
+
+/*
+writePES wraps es in a PES packet and splits it into TS packets:
+
+	+--------+----------+--------+-------+-------+---------+-----------+
+	| 000001 | StreamID | Length | Flags | Flags | HdrLen  | PTS [DTS] |
+	| (3)    | (1)      | (2)    | (1)   | (1)   | (1)     | (5) [(5)] |
+	+--------+----------+--------+-------+-------+---------+-----------+
+
+The first TS packet carries the PCR when pid carries it, and marks
+random access points.
+*/
+func (m *Muxer) writePES(w io.Writer, pid uint16, streamID byte, pts, dts int64, key bool, es []byte) error {
+	hdr := make([]byte, 0, 19)
+	hdr = append(hdr, 0x00, 0x00, 0x01, streamID, 0x00, 0x00, 0x80)
+	if pts != dts {
+		hdr = append(hdr, 0xc0, 10)
+		hdr = appendTimestamp(hdr, 0x3, pts)
+		hdr = appendTimestamp(hdr, 0x1, dts)
+	} else {
+		hdr = append(hdr, 0x80, 5)
+		hdr = appendTimestamp(hdr, 0x2, pts)
+	}
+
+	// Video may exceed the 16 bit length, where 0 means unbounded.
+	if size := len(hdr) - 6 + len(es); size <= 0xffff && streamID != streamIDVideo {
+		bitops.PutU16BE(hdr[4:6], uint16(size))
+	}
+
+	pcr := int64(-1)
+	if pid == pidVideo || !m.HasVideo() {
+		pcr = dts
+	}
+
+	payload := append(hdr, es...)
+	first := true
+	for len(payload) > 0 {
+		pkt := m.pkt[:]
+		for i := range pkt {
+			pkt[i] = 0xff
+		}
+		pkt[0] = 0x47
+		pkt[1] = byte(pid>>8) & 0x1f
+		if first {
+			pkt[1] |= 0x40
+		}
+		pkt[2] = byte(pid)
+		cc := m.nextCC(pid)
+
+		var flags byte
+		if first && key {
+			flags |= 0x40 // random_access_indicator
+		}
+		if first && pcr >= 0 {
+			flags |= 0x10 // PCR_flag
+		}
+
+		hasAF := flags != 0
+		afLen := 0
+		if hasAF {
+			afLen = 1
+			if flags&0x10 != 0 {
+				afLen += 6
+			}
+		}
+
+		space := PacketSize - 4
+		if hasAF {
+			space -= 1 + afLen
+		}
+		if len(payload) < space {
+			stuff := space - len(payload)
+			if hasAF {
+				afLen += stuff
+			} else {
+				hasAF = true
+				afLen = stuff - 1
+			}
+		}
+
+		n := 4
+		if hasAF {
+			pkt[3] = 0x30 | cc
+			pkt[4] = byte(afLen)
+			if afLen > 0 {
+				pkt[5] = flags
+			}
+			if flags&0x10 != 0 {
+				putPCR(pkt[6:12], pcr)
+			}
+			n = 5 + afLen
+		} else {
+			pkt[3] = 0x10 | cc
+		}
+
+		k := copy(pkt[n:], payload)
+		payload = payload[k:]
+		first = false
+
+		if _, err := w.Write(pkt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Muxer) nextCC(pid uint16) uint8 {
+	cc := m.cc[pid]
+	m.cc[pid] = (cc + 1) & 0x0f
+	return cc
+}
+
+// appendTimestamp appends a 33 bit PTS or DTS with its 4 bit prefix.
+func appendTimestamp(b []byte, prefix byte, ts int64) []byte {
+	return append(b,
+		prefix<<4|byte(ts>>29)&0x0e|0x01,
+		byte(ts>>22),
+		byte(ts>>14)&0xfe|0x01,
+		byte(ts>>7),
+		byte(ts<<1)&0xfe|0x01,
+	)
+}
+
+// putPCR writes a PCR with a 33 bit base and a zero extension.
+func putPCR(b []byte, base int64) {
+	b[0] = byte(base >> 25)
+	b[1] = byte(base >> 17)
+	b[2] = byte(base >> 9)
+	b[3] = byte(base >> 1)
+	b[4] = byte(base<<7)&0x80 | 0x7e
+	b[5] = 0x00
+}
@@ -0,0 +1,310 @@
+package ts
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/flv"
+)
+
+var (
+	testSPS = "6764001facd9405005bb011000000300100000030300f1831960"
+	testPPS = "68ebe3cb22c0"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// avcSeqHeader returns the FLV tag data of the AVC sequence header
+// holding testSPS and testPPS.
+func avcSeqHeader() []byte {
+	sps, pps := mustHex(testSPS), mustHex(testPPS)
+	b := []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x64, 0x00, 0x1f, 0xff, 0xe1, 0x00, byte(len(sps))}
+	b = append(b, sps...)
+	b = append(b, 0x01, 0x00, byte(len(pps)))
+	return append(b, pps...)
+}
+
+func packet(t *testing.T, video bool, ts uint32, data []byte) *av.Packet {
+	p := &av.Packet{IsVideo: video, IsAudio: !video, TimeStamp: ts, Data: data}
+	if err := flv.ParseHeader(p); err != nil {
+		t.Fatalf("ParseHeader: %v", err)
+	}
+	return p
+}
+
+type tsPacket struct {
+	pid     uint16
+	pusi    bool
+	cc      uint8
+	af      []byte
+	payload []byte
+}
+
+func parsePackets(t *testing.T, b []byte) []tsPacket {
+	if len(b)%PacketSize != 0 {
+		t.Fatalf("output of %d bytes is not made of TS packets", len(b))
+	}
+	var ret []tsPacket
+	for ; len(b) > 0; b = b[PacketSize:] {
+		if b[0] != 0x47 {
+			t.Fatalf("sync byte %#x", b[0])
+		}
+		p := tsPacket{
+			pid:  uint16(b[1]&0x1f)<<8 | uint16(b[2]),
+			pusi: b[1]&0x40 != 0,
+			cc:   b[3] & 0x0f,
+		}
+		n := 4
+		if b[3]&0x20 != 0 {
+			n = 5 + int(b[4])
+			p.af = b[5:n]
+		}
+		if b[3]&0x10 != 0 {
+			p.payload = b[n:PacketSize]
+		}
+		ret = append(ret, p)
+	}
+	return ret
+}
+
+// section returns the PSI section of p after checking its CRC.
+func section(t *testing.T, p tsPacket) []byte {
+	if !p.pusi || p.payload[0] != 0 {
+		t.Fatalf("pid %#x: no section start", p.pid)
+	}
+	s := p.payload[1:]
+	size := int(s[1]&0x0f)<<8 | int(s[2])
+	s = s[:3+size]
+	if crc32(s) != 0 {
+		t.Errorf("pid %#x: section % x has a bad CRC", p.pid, s)
+	}
+	return s
+}
+
+func pesTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+func pcrBase(af []byte) int64 {
+	return int64(af[1])<<25 | int64(af[2])<<17 | int64(af[3])<<9 | int64(af[4])<<1 | int64(af[5]>>7)
+}
+
+func TestWriteTables(t *testing.T) {
+	tests := []struct {
+		name    string
+		video   bool
+		pcrPID  uint16
+		streams []byte
+	}{
+		{"video and audio", true, pidVideo, []byte{streamTypeH264, 0xe1, 0x00, 0xf0, 0x00, streamTypeAAC, 0xe1, 0x01, 0xf0, 0x00}},
+		{"audio only", false, pidAudio, []byte{streamTypeAAC, 0xe1, 0x01, 0xf0, 0x00}},
+	}
+
+	for _, tt := range tests {
+		m := NewMuxer()
+		var b bytes.Buffer
+		if tt.video {
+			m.Mux(packet(t, true, 0, avcSeqHeader()), &b)
+		}
+		m.Mux(packet(t, false, 0, []byte{0xaf, 0x00, 0x12, 0x10}), &b)
+		if b.Len() != 0 {
+			t.Fatalf("%s: sequence headers wrote % x", tt.name, b.Bytes())
+		}
+
+		for seg := 0; seg < 2; seg++ {
+			b.Reset()
+			if err := m.WriteTables(&b); err != nil {
+				t.Fatalf("%s: WriteTables: %v", tt.name, err)
+			}
+			pkts := parsePackets(t, b.Bytes())
+			if len(pkts) != 2 || pkts[0].pid != pidPAT || pkts[1].pid != pidPMT {
+				t.Fatalf("%s: tables written as %+v", tt.name, pkts)
+			}
+			if pkts[0].cc != uint8(seg) || pkts[1].cc != uint8(seg) {
+				t.Errorf("%s: continuity counters %d, %d in segment %d", tt.name, pkts[0].cc, pkts[1].cc, seg)
+			}
+
+			pat := section(t, pkts[0])
+			if pmtPID := uint16(pat[10]&0x1f)<<8 | uint16(pat[11]); pmtPID != pidPMT {
+				t.Errorf("%s: PAT points to PMT %#x", tt.name, pmtPID)
+			}
+			pmt := section(t, pkts[1])
+			if pcrPID := uint16(pmt[8]&0x1f)<<8 | uint16(pmt[9]); pcrPID != tt.pcrPID {
+				t.Errorf("%s: PCR PID %#x, want %#x", tt.name, pcrPID, tt.pcrPID)
+			}
+			if streams := pmt[12 : len(pmt)-4]; !bytes.Equal(streams, tt.streams) {
+				t.Errorf("%s: PMT streams % x, want % x", tt.name, streams, tt.streams)
+			}
+		}
+	}
+}
+
+// pes reassembles the PES packets of pid in pkts.
+func pes(t *testing.T, pkts []tsPacket, pid uint16) [][]byte {
+	var ret [][]byte
+	var cc uint8
+	for _, p := range pkts {
+		if p.pid != pid {
+			continue
+		}
+		if p.pusi {
+			ret = append(ret, nil)
+		} else if p.cc != (cc+1)&0x0f {
+			t.Errorf("pid %#x: continuity counter %d after %d", pid, p.cc, cc)
+		}
+		cc = p.cc
+		ret[len(ret)-1] = append(ret[len(ret)-1], p.payload...)
+	}
+	return ret
+}
+
+func TestMuxVideo(t *testing.T) {
+	idr := append([]byte{0x65, 0x88}, bytes.Repeat([]byte{0xab}, 400)...)
+	key := append([]byte{0x17, 0x01, 0x00, 0x00, 0x28, 0x00, 0x00, 0x01, byte(len(idr) - 256)}, idr...)
+
+	tests := []struct {
+		name string
+		ts   uint32
+		data []byte
+		pts  int64
+		dts  int64
+		key  bool
+		es   []byte
+	}{
+		{
+			name: "keyframe with parameter sets",
+			ts:   1000,
+			data: key,
+			pts:  1040 * 90,
+			dts:  1000 * 90,
+			key:  true,
+			es: bytes.Join([][]byte{
+				audSample,
+				{0x00, 0x00, 0x00, 0x01}, mustHex(testSPS),
+				{0x00, 0x00, 0x00, 0x01}, mustHex(testPPS),
+				{0x00, 0x00, 0x00, 0x01}, idr,
+			}, nil),
+		},
+		{
+			name: "frame without composition time",
+			ts:   1040,
+			data: []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x41, 0x9a, 0x02},
+			pts:  1040 * 90,
+			dts:  1040 * 90,
+			es:   append(append(append([]byte{}, audSample...), 0x00, 0x00, 0x00, 0x01), 0x41, 0x9a, 0x02),
+		},
+		{
+			name: "negative presentation time is clamped",
+			ts:   20,
+			data: []byte{0x27, 0x01, 0xff, 0xff, 0xd8, 0x00, 0x00, 0x00, 0x03, 0x41, 0x9a, 0x02},
+			pts:  0,
+			dts:  20 * 90,
+			es:   append(append(append([]byte{}, audSample...), 0x00, 0x00, 0x00, 0x01), 0x41, 0x9a, 0x02),
+		},
+	}
+
+	for _, tt := range tests {
+		m := NewMuxer()
+		var b bytes.Buffer
+		m.Mux(packet(t, true, 0, avcSeqHeader()), &b)
+		if err := m.Mux(packet(t, true, tt.ts, tt.data), &b); err != nil {
+			t.Fatalf("%s: Mux: %v", tt.name, err)
+		}
+
+		pkts := parsePackets(t, b.Bytes())
+		af := pkts[0].af
+		if len(af) < 7 || af[0]&0x10 == 0 {
+			t.Fatalf("%s: first packet has no PCR: % x", tt.name, af)
+		}
+		if (af[0]&0x40 != 0) != tt.key {
+			t.Errorf("%s: random access indicator %v, want %v", tt.name, af[0]&0x40 != 0, tt.key)
+		}
+		if pcr := pcrBase(af); pcr != tt.dts {
+			t.Errorf("%s: PCR %d, want %d", tt.name, pcr, tt.dts)
+		}
+
+		all := pes(t, pkts, pidVideo)
+		if len(all) != 1 {
+			t.Fatalf("%s: %d PES packets", tt.name, len(all))
+		}
+		h := all[0]
+		if !bytes.Equal(h[:4], []byte{0x00, 0x00, 0x01, streamIDVideo}) || h[4] != 0 || h[5] != 0 {
+			t.Fatalf("%s: PES header % x", tt.name, h[:9])
+		}
+		var pts, dts int64
+		switch h[7] {
+		case 0xc0:
+			pts, dts = pesTimestamp(h[9:]), pesTimestamp(h[14:])
+		case 0x80:
+			pts = pesTimestamp(h[9:])
+			dts = pts
+		default:
+			t.Fatalf("%s: PTS DTS flags %#x", tt.name, h[7])
+		}
+		if pts != tt.pts || dts != tt.dts {
+			t.Errorf("%s: PTS, DTS = %d, %d, want %d, %d", tt.name, pts, dts, tt.pts, tt.dts)
+		}
+		if es := h[9+int(h[8]):]; !bytes.Equal(es, tt.es) {
+			t.Errorf("%s: elementary stream\n% x\nwant\n% x", tt.name, es, tt.es)
+		}
+	}
+}
+
+func TestMuxAudio(t *testing.T) {
+	for _, video := range []bool{false, true} {
+		m := NewMuxer()
+		var b bytes.Buffer
+		if video {
+			m.Mux(packet(t, true, 0, avcSeqHeader()), &b)
+		}
+		m.Mux(packet(t, false, 0, []byte{0xaf, 0x00, 0x12, 0x10}), &b)
+		if err := m.Mux(packet(t, false, 1000, []byte{0xaf, 0x01, 0xaa, 0xbb}), &b); err != nil {
+			t.Fatalf("Mux: %v", err)
+		}
+
+		pkts := parsePackets(t, b.Bytes())
+		if len(pkts) != 1 || pkts[0].pid != pidAudio {
+			t.Fatalf("video %v: audio written as %+v", video, pkts)
+		}
+		// without video, audio carries the PCR and random access points
+		if hasPCR := len(pkts[0].af) > 0 && pkts[0].af[0]&0x50 == 0x50; hasPCR == video {
+			t.Errorf("video %v: adaptation field % x", video, pkts[0].af)
+		}
+
+		h := pkts[0].payload
+		want := []byte{0x00, 0x00, 0x01, streamIDAudio, 0x00, 0x11, 0x80, 0x80, 0x05}
+		if !bytes.Equal(h[:9], want) {
+			t.Errorf("video %v: PES header % x, want % x", video, h[:9], want)
+		}
+		if pts := pesTimestamp(h[9:]); pts != 1000*90 {
+			t.Errorf("video %v: PTS %d, want %d", video, pts, 1000*90)
+		}
+		adts := []byte{0xff, 0xf1, 0x50, 0x80, 0x01, 0x3f, 0xfc, 0xaa, 0xbb}
+		if !bytes.Equal(h[14:], adts) {
+			t.Errorf("video %v: elementary stream % x, want % x", video, h[14:], adts)
+		}
+	}
+}
+
+func TestMuxUnsupported(t *testing.T) {
+	m := NewMuxer()
+	var b bytes.Buffer
+	if err := m.Mux(packet(t, true, 0, []byte{0x90, 'h', 'v', 'c', '1', 0x01}), &b); err != ErrUnsupportedCodec {
+		t.Errorf("hevc: Mux = %v, want %v", err, ErrUnsupportedCodec)
+	}
+	if err := m.Mux(packet(t, false, 0, []byte{0x2f, 0xff, 0xfb}), &b); err != ErrUnsupportedCodec {
+		t.Errorf("mp3: Mux = %v, want %v", err, ErrUnsupportedCodec)
+	}
+	// frames before the sequence header are dropped
+	if err := m.Mux(packet(t, false, 0, []byte{0xaf, 0x01, 0xaa}), &b); err != nil || b.Len() != 0 {
+		t.Errorf("aac before the sequence header: Mux = %v, wrote %d bytes", err, b.Len())
+	}
+}
@@ -1,14 +1,99 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"rtmp-example/dash"
+	"rtmp-example/hls"
+	"rtmp-example/httpflv"
 	"rtmp-example/rtmp"
+
+	log "github.com/sirupsen/logrus"
 )
 
 const (
-	PORT = 1935
+	PORT          = 1935
+	HTTP_FLV_PORT = 7001
+	HLS_PORT      = 7002
+	DASH_PORT     = 7003
 )
 
+// appURLs collects repeated app=url flags.
+type appURLs map[string][]string
+
+func (f appURLs) String() string {
+	return fmt.Sprint(map[string][]string(f))
+}
+
+func (f appURLs) Set(v string) error {
+	app, url, ok := strings.Cut(v, "=")
+	if !ok || app == "" || url == "" {
+		return fmt.Errorf("want app=url, got %q", v)
+	}
+	f[app] = append(f[app], url)
+	return nil
+}
+
+// last returns the last URL given for every app.
+func (f appURLs) last() map[string]string {
+	ret := make(map[string]string, len(f))
+	for app, urls := range f {
+		ret[app] = urls[len(urls)-1]
+	}
+	return ret
+}
+
 func main() {
-	rtmpserver := rtmp.Server{Port: PORT}
-	rtmpserver.Init()
+	push := appURLs{}
+	flag.Var(push, "push", "push the streams of an app to an upstream server, as `app=url` (repeatable)")
+	origins := appURLs{}
+	flag.Var(origins, "origin", "play the streams of an app from an origin server when not published here, as `app=url`")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	hub := rtmp.NewStreamHub()
+
+	flvserver := httpflv.Server{Port: HTTP_FLV_PORT, Hub: hub}
+	flvdone := make(chan struct{})
+	go func() {
+		defer close(flvdone)
+		if err := flvserver.ListenAndServe(ctx); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	hlsserver := hls.Server{Port: HLS_PORT, Hub: hub}
+	hlsdone := make(chan struct{})
+	go func() {
+		defer close(hlsdone)
+		if err := hlsserver.ListenAndServe(ctx); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	dashserver := dash.Server{Port: DASH_PORT, Hub: hub}
+	dashdone := make(chan struct{})
+	go func() {
+		defer close(dashdone)
+		if err := dashserver.ListenAndServe(ctx); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	rtmpserver := rtmp.Server{Port: PORT, Hub: hub, Push: push, Origins: origins.last()}
+	if err := rtmpserver.ListenAndServe(ctx); err != nil && err != rtmp.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-flvdone
+	<-hlsdone
+	<-dashdone
 }
@@ -0,0 +1,201 @@
+package rtmp
+
+import (
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/flv"
+)
+
+const (
+	defaultCacheGops     = 1
+	defaultCacheMaxBytes = 16 * 1024 * 1024
+)
+
+/*
+Cache keeps what a player needs to start decoding right away: the
+last onMetaData packet, the video sequence header, the audio sequence
+header of every track and the most recent GOPs, each starting at a
+keyframe.
+
+The GOPs are bounded both by count and by their total size in bytes.
+When a single GOP outgrows the byte limit it is discarded and caching
+resumes at the next keyframe.
+*/
+type Cache struct {
+	maxGops  int
+	maxBytes int
+
+	metadata  *av.Packet
+	videoSeq  *av.Packet
+	audioSeqs audioSeqs
+
+	gops  []*gop
+	bytes int
+}
+
+type gop struct {
+	packets []*av.Packet
+	bytes   int
+}
+
+func NewCache(maxGops, maxBytes int) *Cache {
+	return &Cache{
+		maxGops:  maxGops,
+		maxBytes: maxBytes,
+	}
+}
+
+// Write records p. Packets are kept by reference and must not be
+// modified afterwards.
+func (cache *Cache) Write(p *av.Packet) {
+	if p.IsMetadata {
+		if isOnMetaData(p) {
+			cache.metadata = p
+		}
+		return
+	}
+
+	switch {
+	case isVideoSeq(p):
+		cache.videoSeq = p
+		return
+	case isAudioSeq(p):
+		cache.audioSeqs.set(p)
+		return
+	case isKeyFrame(p):
+		cache.startGop()
+	}
+
+	if cache.maxGops <= 0 || len(cache.gops) == 0 {
+		return
+	}
+
+	cur := cache.gops[len(cache.gops)-1]
+	cur.packets = append(cur.packets, p)
+	cur.bytes += len(p.Data)
+	cache.bytes += len(p.Data)
+
+	cache.trim()
+}
+
+func (cache *Cache) startGop() {
+	if cache.maxGops <= 0 {
+		return
+	}
+	cache.gops = append(cache.gops, &gop{})
+	cache.trim()
+}
+
+// trim drops the oldest GOPs until both limits hold again.
+func (cache *Cache) trim() {
+	for len(cache.gops) > cache.maxGops ||
+		(cache.maxBytes > 0 && cache.bytes > cache.maxBytes && len(cache.gops) > 0) {
+		cache.bytes -= cache.gops[0].bytes
+		cache.gops[0] = nil
+		cache.gops = cache.gops[1:]
+	}
+}
+
+// Send replays the cached packets to w in decoding order.
+func (cache *Cache) Send(w av.WriteCloser) error {
+	headers := append([]*av.Packet{cache.metadata, cache.videoSeq}, cache.audioSeqs.packets()...)
+	for _, p := range headers {
+		if p == nil {
+			continue
+		}
+		if err := w.Write(p); err != nil {
+			return err
+		}
+	}
+
+	for _, g := range cache.gops {
+		for _, p := range g.packets {
+			if err := w.Write(p); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reset forgets everything, e.g. when the publisher goes away.
+func (cache *Cache) Reset() {
+	cache.metadata = nil
+	cache.videoSeq = nil
+	cache.audioSeqs = nil
+	cache.gops = nil
+	cache.bytes = 0
+}
+
+func isVideoSeq(p *av.Packet) bool {
+	vh, ok := p.Header.(av.VideoPacketHeader)
+	return p.IsVideo && ok && vh.IsSeq()
+}
+
+func isAudioSeq(p *av.Packet) bool {
+	if h, ok := p.Header.(*flv.AudioTagHeader); ok && h.IsExHeader() {
+		return p.IsAudio && h.IsSeq()
+	}
+	ah, ok := p.Header.(av.AudioPacketHeader)
+	return p.IsAudio && ok && ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR
+}
+
+// audioSeqs keeps the latest audio sequence header of every track, in
+// arrival order. Legacy and single track streams only have track 0. A
+// multitrack header is for each of its tracks, and is dropped once
+// newer headers cover all of them, so that replaying the headers in
+// order leaves every track with its latest one.
+type audioSeqs []*av.Packet
+
+func (s *audioSeqs) set(p *av.Packet) {
+	all := append(*s, p)
+
+	covered := make(map[uint8]bool)
+	keep := make([]bool, len(all))
+	for i := len(all) - 1; i >= 0; i-- {
+		for _, id := range audioTracks(all[i]) {
+			if !covered[id] {
+				covered[id] = true
+				keep[i] = true
+			}
+		}
+	}
+
+	kept := all[:0]
+	for i, q := range all {
+		if keep[i] {
+			kept = append(kept, q)
+		}
+	}
+	*s = kept
+}
+
+// packets returns the headers in arrival order.
+func (s audioSeqs) packets() []*av.Packet {
+	return append([]*av.Packet(nil), s...)
+}
+
+// audioTracks returns the IDs of the tracks audio packet p is for.
+func audioTracks(p *av.Packet) []uint8 {
+	h, ok := p.Header.(*flv.AudioTagHeader)
+	if !ok || !h.IsMultitrack() {
+		return []uint8{0}
+	}
+	ids := make([]uint8, 0, len(h.Tracks()))
+	for _, t := range h.Tracks() {
+		ids = append(ids, t.ID)
+	}
+	return ids
+}
+
+// isHeader reports whether p is metadata or a sequence header, which
+// the packets after it need to be decoded.
+func isHeader(p *av.Packet) bool {
+	return p.IsMetadata || isVideoSeq(p) || isAudioSeq(p)
+}
+
+// isKeyFrame reports whether p is a keyframe carrying picture data.
+func isKeyFrame(p *av.Packet) bool {
+	vh, ok := p.Header.(av.VideoPacketHeader)
+	return p.IsVideo && ok && vh.IsKeyFrame() && !vh.IsSeq()
+}
@@ -0,0 +1,135 @@
+package rtmp
+
+import (
+	"testing"
+
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/flv"
+)
+
+func TestCacheLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxGops  int
+		maxBytes int
+		gops     int
+		size     int
+		want     []uint32 // timestamps replayed after the sequence header
+	}{
+		{
+			name:    "headers only",
+			maxGops: 0,
+			gops:    2,
+			size:    3,
+		},
+		{
+			name:    "last gop",
+			maxGops: 1,
+			gops:    3,
+			size:    3,
+			want:    []uint32{6, 7, 8},
+		},
+		{
+			name:    "two gops",
+			maxGops: 2,
+			gops:    3,
+			size:    3,
+			want:    []uint32{3, 4, 5, 6, 7, 8},
+		},
+		{
+			// a gop of three 6 byte frames fits, two do not
+			name:     "byte limit drops the oldest gop",
+			maxGops:  4,
+			maxBytes: 20,
+			gops:     3,
+			size:     3,
+			want:     []uint32{6, 7, 8},
+		},
+		{
+			// the current gop outgrew the limit, nothing is replayed
+			// before the next keyframe
+			name:     "gop larger than the byte limit",
+			maxGops:  4,
+			maxBytes: 15,
+			gops:     2,
+			size:     3,
+		},
+	}
+
+	for _, tt := range tests {
+		cache := NewCache(tt.maxGops, tt.maxBytes)
+		for _, p := range testGops(t, tt.gops, tt.size) {
+			cache.Write(p)
+		}
+
+		w := newTestWriter("live/test")
+		if err := cache.Send(w); err != nil {
+			t.Fatalf("%s: Send: %v", tt.name, err)
+		}
+		if len(w.packets) == 0 || !isVideoSeq(&w.packets[0]) {
+			t.Errorf("%s: replay does not start with the sequence header", tt.name)
+			continue
+		}
+		var got []uint32
+		for _, p := range w.packets[1:] {
+			got = append(got, p.TimeStamp)
+		}
+		if !equalUint32s(got, tt.want) {
+			t.Errorf("%s: replayed %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCacheHeaders(t *testing.T) {
+	cache := NewCache(1, 0)
+
+	meta := &av.Packet{IsMetadata: true, Data: []byte("\x02\x00\x0aonMetaData\x08\x00\x00\x00\x00\x00\x00\x09")}
+	aacSeq := &av.Packet{IsAudio: true, Data: []byte{0xaf, 0x00, 0x12, 0x10}}
+	aacSeq2 := &av.Packet{IsAudio: true, Data: []byte{0xaf, 0x00, 0x11, 0x90}}
+	aacRaw := &av.Packet{IsAudio: true, Data: []byte{0xaf, 0x01, 0x21}}
+	for _, p := range []*av.Packet{aacSeq, aacSeq2, aacRaw} {
+		if err := flv.ParseHeader(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seq := testVideo(t, 0, 0x17, 0x00, 0x00, 0x00, 0x00)
+	key := testVideo(t, 40, 0x17, 0x01, 0x00, 0x00, 0x00, 0xaa)
+
+	// audio before the first keyframe has no gop to go to
+	for _, p := range []*av.Packet{meta, aacSeq, seq, aacRaw, aacSeq2, key, aacRaw} {
+		cache.Write(p)
+	}
+
+	w := newTestWriter("live/test")
+	if err := cache.Send(w); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	want := []*av.Packet{meta, seq, aacSeq2, key, aacRaw}
+	if len(w.packets) != len(want) {
+		t.Fatalf("replayed %d packets, want %d", len(w.packets), len(want))
+	}
+	for i := range want {
+		if string(w.packets[i].Data) != string(want[i].Data) {
+			t.Errorf("packet %d = % x, want % x", i, w.packets[i].Data, want[i].Data)
+		}
+	}
+
+	cache.Reset()
+	w = newTestWriter("live/test")
+	cache.Send(w)
+	if len(w.packets) != 0 {
+		t.Errorf("replayed %d packets after Reset", len(w.packets))
+	}
+}
+
+func equalUint32s(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
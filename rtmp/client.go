@@ -0,0 +1,598 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rtmp-example/internal/amf"
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/bitops"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPort        = "1935"
+	defaultDialTimeout = 10 * time.Second
+	clientBufferLength = 1000
+)
+
+var ErrClientClosed = errors.New("rtmp: client closed")
+
+/*
+Client is an outgoing RTMP connection that either publishes or plays
+a single stream. A publishing client is an av.WriteCloser and a
+playing client an av.ReadCloser, so both plug into a StreamHub.
+
+A publishing client reads what the server sends in the background, so
+that pings are answered and received bytes acknowledged. It closes
+itself when the connection fails or the server reports an error, and
+Write then returns the cause.
+*/
+type Client struct {
+	conn   *Connection
+	method string
+	info   av.Info
+
+	app      string
+	name     string
+	tcURL    string
+	streamID uint32
+
+	transactionID int
+	encoder       *amf.Encoder
+	decoder       *amf.Decoder
+	bytesw        *bytes.Buffer
+	wmu           sync.Mutex
+
+	// media received before the play command completed
+	pending []av.Packet
+
+	baseTimestamp uint32
+	lastTimestamp uint32
+	closed        int32
+
+	// done is closed by Close, after err is set
+	done chan struct{}
+	err  error
+}
+
+// Dial connects to rawurl (rtmp://host[:port]/app/name) and starts
+// publishing or playing the stream, method being av.PUBLISH or av.PLAY.
+func Dial(rawurl string, method string) (*Client, error) {
+	return DialContext(context.Background(), rawurl, method)
+}
+
+// DialContext is Dial with a context bounding the connection setup.
+func DialContext(ctx context.Context, rawurl string, method string) (*Client, error) {
+	if method != av.PUBLISH && method != av.PLAY {
+		return nil, fmt.Errorf("rtmp: unsupported method %q", method)
+	}
+
+	host, app, name, tcURL, err := parseURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+	netconn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &Client{
+		conn:   NewConn(netconn, 4*1024),
+		method: method,
+		info: av.Info{
+			Key: app + "/" + name,
+			URL: rawurl,
+			UID: av.NewUID(),
+		},
+		app:     app,
+		name:    name,
+		tcURL:   tcURL,
+		encoder: &amf.Encoder{},
+		decoder: &amf.Decoder{},
+		bytesw:  bytes.NewBuffer(nil),
+		done:    make(chan struct{}),
+	}
+
+	deadline := time.Now().Add(defaultDialTimeout)
+	if dl, ok := ctx.Deadline(); ok {
+		deadline = dl
+	}
+	netconn.SetDeadline(deadline)
+
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			netconn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	err = cc.start()
+	close(stop)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		netconn.Close()
+		return nil, err
+	}
+
+	netconn.SetDeadline(time.Time{})
+	if method == av.PUBLISH {
+		go cc.serve()
+	}
+	return cc, nil
+}
+
+// parseURL splits rtmp://host[:port]/app/name?query into its parts.
+// The query string stays part of the stream name, as servers commonly
+// read tokens from it.
+func parseURL(rawurl string) (host, app, name, tcURL string, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "rtmp" {
+		err = fmt.Errorf("rtmp: unsupported scheme %q", u.Scheme)
+		return
+	}
+
+	host = u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+
+	ps := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if len(ps) != 2 || ps[0] == "" || ps[1] == "" {
+		err = fmt.Errorf("rtmp: url %q has no app and stream name", rawurl)
+		return
+	}
+	app = ps[0]
+	name = ps[1]
+	if u.RawQuery != "" {
+		name += "?" + u.RawQuery
+	}
+	tcURL = "rtmp://" + u.Host + "/" + app
+	return
+}
+
+func (cc *Client) start() error {
+	if err := HandshakeClient(cc.conn); err != nil {
+		return err
+	}
+
+	c := cc.conn.NewSetChunkSize(1024)
+	if err := cc.conn.Write(&c); err != nil {
+		return err
+	}
+
+	if err := cc.connect(); err != nil {
+		return err
+	}
+	if err := cc.createStream(); err != nil {
+		return err
+	}
+
+	if cc.method == av.PUBLISH {
+		return cc.publish()
+	}
+	return cc.play()
+}
+
+func (cc *Client) connect() error {
+	event := ConnectInfo{
+		App:           cc.app,
+		Type:          "nonprivate",
+		Flashver:      "FMLE/3.0 (compatible; rtmp-example)",
+		TcUrl:         cc.tcURL,
+		Capabilities:  15,
+		AudioCodecs:   4071,
+		VideoCodecs:   252,
+		VideoFunction: 1,
+		FourCcList:    fourCCs,
+
+		AudioFourCcInfoMap: audioFourCCs,
+	}
+
+	id := cc.nextTransactionID()
+	if err := cc.writeMsg(3, 0, cmdConnect, id, event); err != nil {
+		return err
+	}
+
+	_, err := cc.waitResult(id)
+	return err
+}
+
+func (cc *Client) createStream() error {
+	if cc.method == av.PUBLISH {
+		if err := cc.writeMsg(3, 0, cmdReleaseStream, cc.nextTransactionID(), nil, cc.name); err != nil {
+			return err
+		}
+		if err := cc.writeMsg(3, 0, cmdFcpublish, cc.nextTransactionID(), nil, cc.name); err != nil {
+			return err
+		}
+	}
+
+	id := cc.nextTransactionID()
+	if err := cc.writeMsg(3, 0, cmdCreateStream, id, nil); err != nil {
+		return err
+	}
+
+	vs, err := cc.waitResult(id)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range vs {
+		if sid, ok := v.(float64); ok {
+			cc.streamID = uint32(sid)
+			return nil
+		}
+	}
+	return fmt.Errorf("rtmp: createStream result has no stream id: %#v", vs)
+}
+
+func (cc *Client) publish() error {
+	if err := cc.writeMsg(8, cc.streamID, cmdPublish, 0, nil, cc.name, publishLive); err != nil {
+		return err
+	}
+	return cc.waitStatus("NetStream.Publish.Start")
+}
+
+func (cc *Client) play() error {
+	if err := cc.writeMsg(8, cc.streamID, cmdPlay, 0, nil, cc.name, -2); err != nil {
+		return err
+	}
+
+	c := cc.conn.userControlMsg(setBufferLen, 8)
+	c.StreamID = 0
+	bitops.PutU32BE(c.Data[2:6], cc.streamID)
+	bitops.PutU32BE(c.Data[6:10], clientBufferLength)
+	if err := cc.conn.Write(&c); err != nil {
+		return err
+	}
+	if err := cc.conn.Flush(); err != nil {
+		return err
+	}
+
+	return cc.waitStatus("NetStream.Play.Start")
+}
+
+func (cc *Client) nextTransactionID() int {
+	cc.transactionID++
+	return cc.transactionID
+}
+
+func (cc *Client) writeMsg(csid, streamID uint32, args ...interface{}) error {
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+
+	cc.bytesw.Reset()
+	if _, err := cc.encoder.EncodeBatch(cc.bytesw, amf.AMF0, args...); err != nil {
+		return err
+	}
+
+	msg := cc.bytesw.Bytes()
+	c := ChunkStream{
+		Format:   0,
+		CSID:     csid,
+		TypeID:   20,
+		StreamID: streamID,
+		Length:   uint32(len(msg)),
+		Data:     msg,
+	}
+
+	if err := cc.conn.Write(&c); err != nil {
+		return err
+	}
+	return cc.conn.Flush()
+}
+
+// readCmd returns the next command message, queueing media messages
+// and answering pings that arrive meanwhile.
+func (cc *Client) readCmd() ([]interface{}, error) {
+	var c ChunkStream
+
+	for {
+		if err := cc.readMsg(&c); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case isMediaMessage(c.TypeID):
+			var p av.Packet
+			err := chunkToPacket(&c, &p)
+			if err != nil || p.IsMetadata && isServerNotice(p.Data) {
+				continue
+			}
+			cc.pending = append(cc.pending, p)
+		case c.TypeID == 20 || c.TypeID == 17:
+			return cc.decodeCmd(&c)
+		}
+	}
+}
+
+func (cc *Client) decodeCmd(c *ChunkStream) ([]interface{}, error) {
+	data := c.Data
+	if c.TypeID == 17 && len(data) > 0 {
+		data = data[1:]
+	}
+
+	vs, err := cc.decoder.DecodeBatch(bytes.NewReader(data), amf.AMF0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(vs) == 0 {
+		return nil, ErrReq
+	}
+	return vs, nil
+}
+
+// readMsg reads the next message and answers ping requests.
+func (cc *Client) readMsg(c *ChunkStream) error {
+	for {
+		if err := cc.conn.Read(c); err != nil {
+			return err
+		}
+
+		if c.TypeID == idUserControlMessages && len(c.Data) >= 6 &&
+			uint32(c.Data[0])<<8|uint32(c.Data[1]) == pingRequest {
+			ret := cc.conn.userControlMsg(pingResponse, 4)
+			ret.StreamID = 0
+			copy(ret.Data[2:], c.Data[2:6])
+			cc.conn.Write(&ret)
+			cc.conn.Flush()
+			continue
+		}
+
+		return nil
+	}
+}
+
+// waitResult waits for the _result or _error answering transaction id.
+func (cc *Client) waitResult(id int) ([]interface{}, error) {
+	for {
+		vs, err := cc.readCmd()
+		if err != nil {
+			return nil, err
+		}
+
+		name, _ := vs[0].(string)
+		if name != "_result" && name != "_error" {
+			continue
+		}
+		if len(vs) < 2 {
+			continue
+		}
+		if tid, ok := vs[1].(float64); !ok || int(tid) != id {
+			continue
+		}
+
+		if name == "_error" {
+			return nil, fmt.Errorf("rtmp: command %d failed: %#v", id, vs[2:])
+		}
+		return vs[2:], nil
+	}
+}
+
+// waitStatus waits for the onStatus event with the given code and
+// fails on any error level event.
+func (cc *Client) waitStatus(code string) error {
+	for {
+		vs, err := cc.readCmd()
+		if err != nil {
+			return err
+		}
+
+		if name, _ := vs[0].(string); name != "onStatus" {
+			continue
+		}
+
+		for _, v := range vs[1:] {
+			var event StatusEvent
+			if _, ok := v.(amf.Object); !ok || amf.UnmarshalValue(v, &event) != nil {
+				continue
+			}
+			if event.Level == "error" {
+				return fmt.Errorf("rtmp: %s: %s", event.Code, event.Description)
+			}
+			if event.Code == code {
+				return nil
+			}
+		}
+	}
+}
+
+// serve reads from the server until the connection fails or the
+// server reports an error, and closes the client with the cause. Pings
+// are answered by readMsg, acknowledgements sent by Connection.Read.
+func (cc *Client) serve() {
+	var c ChunkStream
+	for {
+		if err := cc.readMsg(&c); err != nil {
+			cc.Close(err)
+			return
+		}
+		if c.TypeID != 20 && c.TypeID != 17 {
+			continue
+		}
+
+		vs, err := cc.decodeCmd(&c)
+		if err != nil {
+			continue
+		}
+		if err := statusError(vs); err != nil {
+			log.Warnf("client %s: %v", cc.info.UID, err)
+			cc.Close(err)
+			return
+		}
+	}
+}
+
+// statusError returns the error reported by vs if it is an error
+// level onStatus event.
+func statusError(vs []interface{}) error {
+	if name, _ := vs[0].(string); name != "onStatus" {
+		return nil
+	}
+	for _, v := range vs[1:] {
+		var event StatusEvent
+		if _, ok := v.(amf.Object); !ok || amf.UnmarshalValue(v, &event) != nil {
+			continue
+		}
+		if event.Level == "error" {
+			return fmt.Errorf("rtmp: %s: %s", event.Code, event.Description)
+		}
+	}
+	return nil
+}
+
+// Read returns the next media packet of a playing client. It returns
+// io.EOF once the server reports that the stream stopped.
+func (cc *Client) Read(p *av.Packet) error {
+	if cc.method != av.PLAY {
+		return fmt.Errorf("rtmp: read on a %s client", cc.method)
+	}
+
+	if len(cc.pending) > 0 {
+		*p = cc.pending[0]
+		cc.pending = cc.pending[1:]
+		return nil
+	}
+
+	var c ChunkStream
+	for {
+		if err := cc.readMsg(&c); err != nil {
+			return err
+		}
+
+		switch {
+		case isMediaMessage(c.TypeID):
+			if err := chunkToPacket(&c, p); err != nil {
+				log.Debugf("client %s: skip packet: %v", cc.info.UID, err)
+				continue
+			}
+			if p.IsMetadata && isServerNotice(p.Data) {
+				continue
+			}
+			return nil
+		case c.TypeID == 20 || c.TypeID == 17:
+			vs, err := cc.decodeCmd(&c)
+			if err != nil {
+				return err
+			}
+			if isStreamEnd(vs) {
+				return io.EOF
+			}
+		}
+	}
+}
+
+// isStreamEnd reports whether vs is an onStatus event ending playback.
+func isStreamEnd(vs []interface{}) bool {
+	if name, _ := vs[0].(string); name != "onStatus" {
+		return false
+	}
+	for _, v := range vs[1:] {
+		var event StatusEvent
+		if _, ok := v.(amf.Object); !ok || amf.UnmarshalValue(v, &event) != nil {
+			continue
+		}
+		switch event.Code {
+		case "NetStream.Play.Stop", "NetStream.Play.UnpublishNotify", "NetStream.Play.Complete":
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Write sends p on a publishing client. Once the client is closed it
+returns the cause, ErrClientClosed when Close was called without one.
+
+onMetaData is sent with the @setDataFrame name servers expect in
+front of the metadata to keep, which the hub strips for players.
+*/
+func (cc *Client) Write(p *av.Packet) error {
+	if cc.method != av.PUBLISH {
+		return fmt.Errorf("rtmp: write on a %s client", cc.method)
+	}
+	if !cc.Alive() {
+		return cc.closeErr()
+	}
+
+	ts := p.TimeStamp + atomic.LoadUint32(&cc.baseTimestamp)
+	atomic.StoreUint32(&cc.lastTimestamp, ts)
+
+	c := packetToChunk(p, cc.streamID)
+	c.Timestamp = ts
+	if isOnMetaData(p) {
+		data, err := amf.MetaDataReform(p.Data, amf.ADD)
+		if err != nil {
+			return err
+		}
+		c.Data = data
+		c.Length = uint32(len(data))
+	}
+	if err := cc.conn.Write(&c); err != nil {
+		return err
+	}
+	return cc.conn.Flush()
+}
+
+func (cc *Client) CalcBaseTimestamp() {
+	atomic.StoreUint32(&cc.baseTimestamp, atomic.LoadUint32(&cc.lastTimestamp))
+}
+
+func (cc *Client) Info() av.Info {
+	return cc.info
+}
+
+func (cc *Client) Alive() bool {
+	return atomic.LoadInt32(&cc.closed) == 0
+}
+
+// closeErr returns the error a closed client was closed with.
+func (cc *Client) closeErr() error {
+	select {
+	case <-cc.done:
+		return cc.err
+	default:
+		// Close is still running
+		return ErrClientClosed
+	}
+}
+
+// Close ends the stream politely and closes the connection.
+func (cc *Client) Close(err error) {
+	if !atomic.CompareAndSwapInt32(&cc.closed, 0, 1) {
+		return
+	}
+	if err == nil {
+		err = ErrClientClosed
+	}
+	cc.err = err
+	close(cc.done)
+
+	cc.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if cc.method == av.PUBLISH {
+		cc.writeMsg(3, 0, cmdFCUnpublish, cc.nextTransactionID(), nil, cc.name)
+	}
+	cc.writeMsg(3, 0, cmdDeleteStream, cc.nextTransactionID(), nil, cc.streamID)
+
+	cc.conn.Close()
+}
@@ -0,0 +1,155 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/flv"
+)
+
+// testServer serves a new hub on a loopback port and returns its
+// rtmp URL base.
+func testServer(t *testing.T, srv *Server) string {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(context.Background(), listen)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	return "rtmp://" + listen.Addr().String()
+}
+
+func TestClientPublishPlay(t *testing.T) {
+	base := testServer(t, &Server{})
+
+	player, err := Dial(base+"/live/test", av.PLAY)
+	if err != nil {
+		t.Fatalf("Dial play: %v", err)
+	}
+	defer player.Close(nil)
+	player.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	pub, err := Dial(base+"/live/test", av.PUBLISH)
+	if err != nil {
+		t.Fatalf("Dial publish: %v", err)
+	}
+	defer pub.Close(nil)
+
+	meta := &av.Packet{IsMetadata: true, Data: []byte("\x02\x00\x0aonMetaData\x08\x00\x00\x00\x01\x00\x05width\x00\x40\x94\x00\x00\x00\x00\x00\x00\x00\x00\x09")}
+	packets := []*av.Packet{
+		meta,
+		testVideo(t, 0, 0x17, 0x00, 0x00, 0x00, 0x00),
+		testVideo(t, 0, 0x17, 0x01, 0x00, 0x00, 0x00, 0xaa),
+		testVideo(t, 40, 0x27, 0x01, 0x00, 0x00, 0x00, 0xbb),
+	}
+	for _, p := range packets {
+		if err := pub.Write(p); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	var p av.Packet
+	if err := player.Read(&p); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !isOnMetaData(&p) || !bytes.Contains(p.Data, []byte("width")) {
+		t.Errorf("first packet = %q, want onMetaData", p.Data)
+	}
+	for _, want := range packets[1:] {
+		if err := player.Read(&p); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if err := flv.ParseHeader(&p); err != nil {
+			t.Fatalf("ParseHeader: %v", err)
+		}
+		if p.TimeStamp != want.TimeStamp || !bytes.Equal(p.Data, want.Data) {
+			t.Errorf("Read = %d % x, want %d % x", p.TimeStamp, p.Data, want.TimeStamp, want.Data)
+		}
+	}
+
+	pub.Close(nil)
+	if err := player.Read(&p); err == nil {
+		t.Errorf("Read after unpublish = % x, want an error", p.Data)
+	}
+}
+
+func TestClientPublishError(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	// a server that checks the metadata, then refuses the stream
+	got := make(chan []byte, 1)
+	go func() {
+		netconn, err := listen.Accept()
+		if err != nil {
+			return
+		}
+		defer netconn.Close()
+
+		conn := NewConn(netconn, 4096)
+		if HandshakeServer(conn) != nil {
+			return
+		}
+		h := NewHandler(conn)
+		if h.InitConnection() != nil {
+			return
+		}
+		var c ChunkStream
+		for c.TypeID != av.TAG_SCRIPTDATAAMF0 {
+			if h.Read(&c) != nil {
+				return
+			}
+		}
+		got <- append([]byte(nil), c.Data...)
+		h.sendStatus("error", "NetStream.Publish.BadName", "Stream already publishing.")
+
+		// wait for the client to hang up
+		for h.Read(&c) == nil {
+		}
+	}()
+
+	pub, err := Dial("rtmp://"+listen.Addr().String()+"/live/test", av.PUBLISH)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer pub.Close(nil)
+
+	meta := []byte("\x02\x00\x0aonMetaData\x08\x00\x00\x00\x00\x00\x00\x09")
+	if err := pub.Write(&av.Packet{IsMetadata: true, Data: meta}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	select {
+	case data := <-got:
+		if want := append([]byte("\x02\x00\x0d@setDataFrame"), meta...); !bytes.Equal(data, want) {
+			t.Errorf("metadata sent as %q, want %q", data, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no metadata received")
+	}
+
+	select {
+	case <-pub.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client still open after an error status")
+	}
+	if pub.Alive() {
+		t.Error("client alive after an error status")
+	}
+	err = pub.Write(testVideo(t, 0, 0x17, 0x00, 0x00, 0x00, 0x00))
+	if err == nil || !strings.Contains(err.Error(), "NetStream.Publish.BadName") {
+		t.Errorf("Write after an error status = %v, want NetStream.Publish.BadName", err)
+	}
+}
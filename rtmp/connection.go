@@ -5,6 +5,7 @@ import (
 	"net"
 	"rtmp-example/internal/bitops"
 	"rtmp-example/internal/pool"
+	"sync"
 	"time"
 )
 
@@ -30,6 +31,10 @@ type Connection struct {
 	rw                  *ReadWriter
 	chunks              map[uint32]ChunkStream
 	pool                *pool.Pool
+
+	// wmu serializes writers, e.g. a player's media loop and the
+	// command replies sent from the reading goroutine.
+	wmu sync.Mutex
 }
 
 func NewConn(c net.Conn, buffSize int) *Connection {
@@ -103,7 +108,9 @@ func (conn *Connection) ack(size uint32) {
 
 	if conn.ackReceived >= conn.remoteWindowAckSize {
 		cs := conn.NewAck(conn.ackReceived)
+		conn.wmu.Lock()
 		cs.writeChunk(conn.rw, int(conn.chunkSize))
+		conn.wmu.Unlock()
 		conn.ackReceived = 0
 	}
 }
@@ -127,6 +134,9 @@ func initControlMsg(id, size, value uint32) ChunkStream {
 }
 
 func (conn *Connection) Flush() error {
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+
 	return conn.rw.Flush()
 }
 
@@ -161,6 +171,9 @@ func (conn *Connection) NewSetPeerBandwidth(size uint32) ChunkStream {
 }
 
 func (conn *Connection) Write(c *ChunkStream) error {
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+
 	if c.TypeID == idSetChunkSize {
 		conn.chunkSize = binary.BigEndian.Uint32(c.Data)
 	}
@@ -207,6 +220,14 @@ func (conn *Connection) SetBegin() {
 	conn.Write(&ret)
 }
 
+func (conn *Connection) SetEOF() {
+	ret := conn.userControlMsg(streamEOF, 4)
+	for i := 0; i < 4; i++ {
+		ret.Data[2+i] = byte(1 >> uint32((3-i)*8) & 0xff)
+	}
+	conn.Write(&ret)
+}
+
 func (conn *Connection) SetRecorded() {
 	ret := conn.userControlMsg(streamIsRecorded, 4)
 	for i := 0; i < 4; i++ {
@@ -0,0 +1,149 @@
+package rtmp
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"rtmp-example/internal/av"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultEdgeIdleTimeout = 5 * time.Second
+	edgeIdleCheckInterval  = time.Second
+)
+
+/*
+PullRelay turns the server into an edge: when a player asks for app/name
+and nobody publishes it locally, the stream is played from
+<origin>/name and fanned out to the local viewers. The upstream
+connection is closed once the stream had no viewer for IdleTimeout.
+
+Set it on the hub with StreamHub.SetPuller.
+*/
+type PullRelay struct {
+	IdleTimeout time.Duration
+
+	hub     *StreamHub
+	mu      sync.Mutex
+	origins map[string]string
+	pulling map[string]struct{}
+}
+
+func NewPullRelay(hub *StreamHub) *PullRelay {
+	return &PullRelay{
+		IdleTimeout: defaultEdgeIdleTimeout,
+		hub:         hub,
+		origins:     make(map[string]string),
+		pulling:     make(map[string]struct{}),
+	}
+}
+
+// AddOrigin pulls streams of app from the rtmp URL origin,
+// e.g. AddOrigin("live", "rtmp://origin.example.com/live").
+func (relay *PullRelay) AddOrigin(app, origin string) {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+
+	relay.origins[app] = strings.TrimSuffix(origin, "/")
+}
+
+// Pull implements Puller.
+func (relay *PullRelay) Pull(key string) {
+	app, name := splitKey(key)
+
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+
+	origin, ok := relay.origins[app]
+	if !ok {
+		return
+	}
+	if _, ok := relay.pulling[key]; ok {
+		return
+	}
+	relay.pulling[key] = struct{}{}
+
+	go relay.pull(key, origin+"/"+name)
+}
+
+// Pulling reports whether key is currently fetched from an origin.
+func (relay *PullRelay) Pulling(key string) bool {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+
+	_, ok := relay.pulling[key]
+	return ok
+}
+
+func (relay *PullRelay) pull(key, url string) {
+	defer func() {
+		relay.mu.Lock()
+		delete(relay.pulling, key)
+		relay.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDialTimeout)
+	cc, err := DialContext(ctx, url, av.PLAY)
+	cancel()
+	if err != nil {
+		log.Warnf("edge %s: pull from %s failed: %v", key, url, err)
+		relay.hub.CloseStream(key, err)
+		return
+	}
+
+	log.Infof("edge %s: pulling from %s", key, url)
+
+	r := &pulledStream{Client: cc, key: key}
+	done := make(chan struct{})
+	go relay.watchIdle(r, done)
+	relay.hub.HandleReader(r)
+	close(done)
+
+	log.Infof("edge %s: stopped pulling from %s", key, url)
+}
+
+// watchIdle closes r once its stream had no viewer for IdleTimeout.
+func (relay *PullRelay) watchIdle(r *pulledStream, done chan struct{}) {
+	ticker := time.NewTicker(edgeIdleCheckInterval)
+	defer ticker.Stop()
+
+	var idleSince time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			s, ok := relay.hub.Stream(r.key)
+			if ok && s.NumViewers() > 0 {
+				idleSince = time.Time{}
+				continue
+			}
+			if idleSince.IsZero() {
+				idleSince = now
+			}
+			if now.Sub(idleSince) >= relay.IdleTimeout {
+				log.Infof("edge %s: no viewers left", r.key)
+				r.Close(nil)
+				return
+			}
+		}
+	}
+}
+
+// pulledStream publishes a playing client under the local stream key,
+// which may differ from the key on the origin.
+type pulledStream struct {
+	*Client
+	key string
+}
+
+func (r *pulledStream) Info() av.Info {
+	info := r.Client.Info()
+	info.Key = r.key
+	info.Inter = true
+	return info
+}
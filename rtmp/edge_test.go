@@ -0,0 +1,108 @@
+package rtmp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/flv"
+)
+
+// testOrigin serves a hub publishing live/test with a keyframe and
+// returns its rtmp URL base along with the published packets.
+func testOrigin(t *testing.T) (string, []*av.Packet) {
+	origin := &Server{Hub: NewStreamHub()}
+	base := testServer(t, origin)
+
+	pub, err := Dial(base+"/live/test", av.PUBLISH)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { pub.Close(nil) })
+
+	w := newTestWriter("live/test")
+	origin.Hub.HandleWriter(w)
+
+	packets := []*av.Packet{
+		{IsMetadata: true, Data: testMetadata},
+		testVideo(t, 0, 0x17, 0x00, 0x00, 0x00, 0x00),
+		testVideo(t, 0, 0x17, 0x01, 0x00, 0x00, 0x00, 0xaa),
+	}
+	for _, p := range packets {
+		if err := pub.Write(p); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	waitFor(t, "the origin stream", func() bool { return len(w.received()) >= len(packets) })
+	return base, packets
+}
+
+func TestServerEdge(t *testing.T) {
+	obase, packets := testOrigin(t)
+	edge := &Server{Hub: NewStreamHub(), Origins: map[string]string{"live": obase + "/live"}}
+	ebase := testServer(t, edge)
+
+	player, err := Dial(ebase+"/live/test", av.PLAY)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer player.Close(nil)
+	player.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var p av.Packet
+	if err := player.Read(&p); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !isOnMetaData(&p) {
+		t.Errorf("first packet = %q, want onMetaData", p.Data)
+	}
+	for _, want := range packets[1:] {
+		if err := player.Read(&p); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if err := flv.ParseHeader(&p); err != nil {
+			t.Fatalf("ParseHeader: %v", err)
+		}
+		if !bytes.Equal(p.Data, want.Data) {
+			t.Errorf("Read = % x, want % x", p.Data, want.Data)
+		}
+	}
+}
+
+func TestPullRelayIdle(t *testing.T) {
+	obase, _ := testOrigin(t)
+
+	hub := NewStreamHub()
+	relay := NewPullRelay(hub)
+	relay.IdleTimeout = 10 * time.Millisecond
+	relay.AddOrigin("live", obase+"/live/")
+	hub.SetPuller(relay)
+
+	// no origin for the app, nothing is pulled
+	other := newTestWriter("other/test")
+	hub.HandleWriter(other)
+	if relay.Pulling("other/test") {
+		t.Error("pulling a stream of an app without origin")
+	}
+	hub.RemoveWriter(other)
+
+	w := newTestWriter("live/test")
+	hub.HandleWriter(w)
+	if !relay.Pulling("live/test") {
+		t.Fatal("not pulling live/test")
+	}
+	waitFor(t, "pulled packets", func() bool { return len(w.received()) >= 3 })
+
+	// a second viewer shares the upstream connection
+	w2 := newTestWriter("live/test")
+	hub.HandleWriter(w2)
+	waitFor(t, "the cache", func() bool { return len(w2.received()) >= 3 })
+
+	hub.RemoveWriter(w)
+	hub.RemoveWriter(w2)
+	waitFor(t, "the idle stream to stop", func() bool { return !relay.Pulling("live/test") })
+	if _, ok := hub.Stream("live/test"); ok {
+		t.Error("idle stream still in the hub")
+	}
+}
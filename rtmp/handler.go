@@ -5,8 +5,12 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"reflect"
+	"sync"
+	"time"
 
 	"rtmp-example/internal/amf"
+	"rtmp-example/internal/av"
 )
 
 /*
@@ -22,6 +26,30 @@ var (
 	ErrReq = fmt.Errorf("req error")
 )
 
+// fourCCs lists the Enhanced RTMP video codecs accepted from
+// publishers, advertised in fourCcList.
+var fourCCs = []string{av.FOURCC_AV1, av.FOURCC_VP9, av.FOURCC_HEVC}
+
+/*
+Capabilities of a codec in the FourCC info maps
+*/
+const (
+	fourCcCanDecode  = 0x01
+	fourCcCanEncode  = 0x02
+	fourCcCanForward = 0x04
+)
+
+// audioFourCCs maps the Enhanced RTMP audio codecs accepted from
+// publishers to their capabilities, advertised in audioFourCcInfoMap.
+// They are only forwarded, never decoded.
+var audioFourCCs = map[string]int{
+	av.FOURCC_OPUS: fourCcCanForward,
+	av.FOURCC_FLAC: fourCcCanForward,
+	av.FOURCC_AC3:  fourCcCanForward,
+	av.FOURCC_EAC3: fourCcCanForward,
+	av.FOURCC_AAC:  fourCcCanForward,
+}
+
 /*
 Types of commands
 */
@@ -33,32 +61,51 @@ var (
 	cmdPublish       = "publish"
 	cmdFCUnpublish   = "FCUnpublish"
 	cmdDeleteStream  = "deleteStream"
+	cmdCloseStream   = "closeStream"
 	cmdPlay          = "play"
+	cmdSeek          = "seek"
+	cmdPause         = "pause"
 )
 
+// ConnectInfo is the command object of connect.
 type ConnectInfo struct {
-	App            string `amf:"app" json:"app"`
-	Flashver       string `amf:"flashVer" json:"flashVer"`
-	SwfUrl         string `amf:"swfUrl" json:"swfUrl"`
-	TcUrl          string `amf:"tcUrl" json:"tcUrl"`
-	Fpad           bool   `amf:"fpad" json:"fpad"`
-	AudioCodecs    int    `amf:"audioCodecs" json:"audioCodecs"`
-	VideoCodecs    int    `amf:"videoCodecs" json:"videoCodecs"`
-	VideoFunction  int    `amf:"videoFunction" json:"videoFunction"`
-	PageUrl        string `amf:"pageUrl" json:"pageUrl"`
-	ObjectEncoding int    `amf:"objectEncoding" json:"objectEncoding"`
+	App            string   `amf:"app" json:"app"`
+	Type           string   `amf:"type,omitempty" json:"type,omitempty"`
+	Flashver       string   `amf:"flashVer" json:"flashVer"`
+	SwfUrl         string   `amf:"swfUrl,omitempty" json:"swfUrl"`
+	TcUrl          string   `amf:"tcUrl" json:"tcUrl"`
+	Fpad           bool     `amf:"fpad" json:"fpad"`
+	Capabilities   int      `amf:"capabilities,omitempty" json:"capabilities,omitempty"`
+	AudioCodecs    int      `amf:"audioCodecs" json:"audioCodecs"`
+	VideoCodecs    int      `amf:"videoCodecs" json:"videoCodecs"`
+	VideoFunction  int      `amf:"videoFunction" json:"videoFunction"`
+	PageUrl        string   `amf:"pageUrl,omitempty" json:"pageUrl"`
+	ObjectEncoding int      `amf:"objectEncoding" json:"objectEncoding"`
+	FourCcList     []string `amf:"fourCcList,omitempty" json:"fourCcList"`
+
+	AudioFourCcInfoMap map[string]int `amf:"audioFourCcInfoMap,omitempty" json:"audioFourCcInfoMap"`
 }
 
+// ConnectResp is the properties object of the connect _result.
 type ConnectResp struct {
-	FMSVer       string `amf:"fmsVer"`
-	Capabilities int    `amf:"capabilities"`
+	FMSVer       string   `amf:"fmsVer"`
+	Capabilities int      `amf:"capabilities"`
+	FourCcList   []string `amf:"fourCcList,omitempty"`
+
+	AudioFourCcInfoMap map[string]int `amf:"audioFourCcInfoMap,omitempty"`
 }
 
+// StatusEvent is the information object of onStatus and onPlayStatus.
+type StatusEvent struct {
+	Level       string `amf:"level"`
+	Code        string `amf:"code"`
+	Description string `amf:"description,omitempty"`
+}
+
+// ConnectEvent is the information object of the connect _result.
 type ConnectEvent struct {
-	Level          string `amf:"level"`
-	Code           string `amf:"code"`
-	Description    string `amf:"description"`
-	ObjectEncoding int    `amf:"objectEncoding"`
+	StatusEvent
+	ObjectEncoding int `amf:"objectEncoding"`
 }
 
 type PublishInfo struct {
@@ -66,18 +113,56 @@ type PublishInfo struct {
 	Type string
 }
 
+/*
+PlayInfo holds the optional arguments of the play command.
+Start is -2 (live, then recorded), -1 (live only) or an offset into a
+recorded stream. Duration is -1 to play until the end. The command
+sends offsets and durations in seconds; they are kept in milliseconds,
+the unit of the stream timestamps.
+*/
+type PlayInfo struct {
+	Start    float64
+	Duration float64
+	Reset    bool
+}
+
+// LiveOnly reports whether the player refuses recorded streams.
+func (info PlayInfo) LiveOnly() bool {
+	return info.Start == -1
+}
+
+// RecordedOnly reports whether the player asked for a recorded stream.
+func (info PlayInfo) RecordedOnly() bool {
+	return info.Start >= 0
+}
+
+// streamCtl is a seek or pause request of a player, left on the
+// handler for whatever streams to that player.
+type streamCtl struct {
+	seek  bool
+	pause bool
+	ms    float64
+}
+
 type Handler struct {
 	done          bool
+	deleted       bool
 	streamID      int
 	isPublisher   bool
 	conn          *Connection
 	transactionID int
 	ConnInfo      ConnectInfo
 	PublishInfo   PublishInfo
+	PlayInfo      PlayInfo
+	ctl           *streamCtl
 	decoder       *amf.Decoder
 	encoder       *amf.Encoder
 	bytesw        *bytes.Buffer
 	bufferSize    int
+
+	// wmu guards bytesw, as status events may be sent while another
+	// goroutine answers commands.
+	wmu sync.Mutex
 }
 
 func NewHandler(conn *Connection) *Handler {
@@ -131,6 +216,10 @@ func (handler *Handler) handleCmdMsg(c *ChunkStream) error {
 
 	log.Println(fmt.Sprintf("rtmp cmd req: %#v", vs))
 
+	if len(vs) == 0 {
+		return ErrReq
+	}
+
 	switch vs[0].(type) {
 	case string:
 		switch vs[0].(string) {
@@ -159,12 +248,27 @@ func (handler *Handler) handleCmdMsg(c *ChunkStream) error {
 			handler.done = true
 			handler.isPublisher = true
 			log.Println("handle publish req done")
+		case cmdPlay:
+			if err = handler.play(vs[1:]); err != nil {
+				return err
+			}
+			if err = handler.playResp(c); err != nil {
+				return err
+			}
+			handler.done = true
+			handler.isPublisher = false
+			log.Println("handle play req done")
 		case cmdFcpublish:
 			handler.fcPublish(vs)
 		case cmdReleaseStream:
 			handler.releaseStream(vs)
 		case cmdFCUnpublish:
-		case cmdDeleteStream:
+		case cmdDeleteStream, cmdCloseStream:
+			handler.deleted = true
+		case cmdSeek:
+			handler.seek(vs[1:])
+		case cmdPause:
+			handler.pause(vs[1:])
 		default:
 			log.Println(fmt.Sprint("no support command=", vs[0].(string)))
 		}
@@ -184,18 +288,13 @@ func (handler *Handler) connect(vs []interface{}) error {
 			}
 			handler.transactionID = id
 		case amf.Object:
-			obimap := v.(amf.Object)
-			if app, ok := obimap["app"]; ok {
-				handler.ConnInfo.App = app.(string)
-			}
-			if flashVer, ok := obimap["flashVer"]; ok {
-				handler.ConnInfo.Flashver = flashVer.(string)
-			}
-			if tcurl, ok := obimap["tcUrl"]; ok {
-				handler.ConnInfo.TcUrl = tcurl.(string)
-			}
-			if encoding, ok := obimap["objectEncoding"]; ok {
-				handler.ConnInfo.ObjectEncoding = int(encoding.(float64))
+			// Clients disagree on the types of some fields, so one
+			// that does not convert is skipped rather than failing
+			// the connection.
+			for k, val := range v.(amf.Object) {
+				if err := amf.UnmarshalValue(amf.Object{k: val}, &handler.ConnInfo); err != nil {
+					log.Println("connect:", err)
+				}
 			}
 		}
 	}
@@ -211,15 +310,22 @@ func (handler *Handler) connectResp(cur *ChunkStream) error {
 	c = handler.conn.NewSetChunkSize(uint32(1024))
 	handler.conn.Write(&c)
 
-	resp := make(amf.Object)
-	resp["fmsVer"] = "FMS/3,0,1,123"
-	resp["capabilities"] = 31
+	resp := ConnectResp{
+		FMSVer:       "FMS/3,0,1,123",
+		Capabilities: 31,
+		FourCcList:   fourCCs,
 
-	event := make(amf.Object)
-	event["level"] = "status"
-	event["code"] = "NetConnection.Connect.Success"
-	event["description"] = "Connection succeeded."
-	event["objectEncoding"] = handler.ConnInfo.ObjectEncoding
+		AudioFourCcInfoMap: audioFourCCs,
+	}
+
+	event := ConnectEvent{
+		StatusEvent: StatusEvent{
+			Level:       "status",
+			Code:        "NetConnection.Connect.Success",
+			Description: "Connection succeeded.",
+		},
+		ObjectEncoding: handler.ConnInfo.ObjectEncoding,
+	}
 
 	return handler.writeMsg(cur.CSID, cur.StreamID, "_result", handler.transactionID, resp, event)
 }
@@ -244,18 +350,131 @@ func (handler *Handler) publishOrPlay(vs []interface{}) error {
 		}
 	}
 
+	if handler.PublishInfo.Name == "" {
+		return ErrReq
+	}
+
 	return nil
 }
 
 func (handler *Handler) publishResp(cur *ChunkStream) error {
-	event := make(amf.Object)
-	event["level"] = "status"
-	event["code"] = "NetStream.Publish.Start"
-	event["description"] = "Start publishing."
+	event := StatusEvent{
+		Level:       "status",
+		Code:        "NetStream.Publish.Start",
+		Description: "Start publishing.",
+	}
 
 	return handler.writeMsg(cur.CSID, cur.StreamID, "onStatus", handler.transactionID, nil, event)
 }
 
+/*
+play arguments: transaction ID, null, stream name, start, duration
+and reset. Everything after the stream name is optional.
+*/
+func (handler *Handler) play(vs []interface{}) error {
+	handler.PlayInfo = PlayInfo{
+		Start:    -2,
+		Duration: -1,
+		Reset:    true,
+	}
+
+	for k, v := range vs {
+		switch v.(type) {
+		case string:
+			if k == 2 {
+				handler.PublishInfo.Name = v.(string)
+			}
+		case float64:
+			switch k {
+			case 0:
+				handler.transactionID = int(v.(float64))
+			case 3:
+				handler.PlayInfo.Start = playTime(v.(float64))
+			case 4:
+				handler.PlayInfo.Duration = playTime(v.(float64))
+			case 5:
+				handler.PlayInfo.Reset = v.(float64) != 0
+			}
+		case bool:
+			if k == 5 {
+				handler.PlayInfo.Reset = v.(bool)
+			}
+		}
+	}
+
+	if handler.PublishInfo.Name == "" {
+		return ErrReq
+	}
+
+	return nil
+}
+
+// playTime converts a start or duration argument of play from seconds
+// to milliseconds. The negative special values are left as they are.
+func playTime(sec float64) float64 {
+	if sec < 0 {
+		return sec
+	}
+	return sec * 1000
+}
+
+func (handler *Handler) playResp(cur *ChunkStream) error {
+	handler.conn.SetBegin()
+
+	if handler.PlayInfo.Reset {
+		event := StatusEvent{
+			Level:       "status",
+			Code:        "NetStream.Play.Reset",
+			Description: "Playing and resetting stream.",
+		}
+		if err := handler.writeMsg(cur.CSID, cur.StreamID, "onStatus", 0, nil, event); err != nil {
+			return err
+		}
+	}
+
+	event := StatusEvent{
+		Level:       "status",
+		Code:        "NetStream.Play.Start",
+		Description: "Started playing stream.",
+	}
+	if err := handler.writeMsg(cur.CSID, cur.StreamID, "onStatus", 0, nil, event); err != nil {
+		return err
+	}
+
+	return handler.writeDataMsg(cur.CSID, cur.StreamID, "|RtmpSampleAccess", true, true)
+}
+
+// seek arguments: transaction ID, null and the position in milliseconds.
+func (handler *Handler) seek(vs []interface{}) {
+	if len(vs) < 3 {
+		return
+	}
+	if ms, ok := vs[2].(float64); ok {
+		handler.ctl = &streamCtl{seek: true, ms: ms}
+	}
+}
+
+// pause arguments: transaction ID, null, pause or unpause flag and the
+// position in milliseconds.
+func (handler *Handler) pause(vs []interface{}) {
+	if len(vs) < 3 {
+		return
+	}
+	ctl := &streamCtl{}
+	switch v := vs[2].(type) {
+	case bool:
+		ctl.pause = v
+	case float64:
+		ctl.pause = v != 0
+	default:
+		return
+	}
+	if len(vs) > 3 {
+		ctl.ms, _ = vs[3].(float64)
+	}
+	handler.ctl = ctl
+}
+
 func (handler *Handler) createStream(vs []interface{}) error {
 	for _, v := range vs {
 		switch v.(type) {
@@ -277,12 +496,50 @@ func (handler *Handler) releaseStream(vs []interface{}) error {
 	return nil
 }
 
+// writeMsg sends args as a command message, in AMF3 to clients that
+// connected with objectEncoding 3.
 func (handler *Handler) writeMsg(csid, streamID uint32, args ...interface{}) error {
+	if handler.ConnInfo.ObjectEncoding == amf.AMF3 {
+		return handler.writeAmfMsg(17, csid, streamID, args...)
+	}
+	return handler.writeAmfMsg(20, csid, streamID, args...)
+}
+
+// writeDataMsg sends args as an AMF0 data message (type 18).
+func (handler *Handler) writeDataMsg(csid, streamID uint32, args ...interface{}) error {
+	return handler.writeAmfMsg(18, csid, streamID, args...)
+}
+
+// isAmfObject reports whether v is encoded as an object or an array.
+func isAmfObject(v interface{}) bool {
+	switch reflect.Indirect(reflect.ValueOf(v)).Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+		return true
+	}
+	return false
+}
+
+func (handler *Handler) writeAmfMsg(typeID, csid, streamID uint32, args ...interface{}) error {
+	handler.wmu.Lock()
+	defer handler.wmu.Unlock()
+
 	handler.bytesw.Reset()
+	handler.encoder.Reset()
 	log.Println(fmt.Sprintf("rtmp response: %#v\n", args))
 
+	// AMF3 command messages start with a format byte, then the names
+	// and numbers stay AMF0 while objects switch to AMF3.
+	if typeID == 17 {
+		handler.bytesw.WriteByte(0)
+	}
 	for _, v := range args {
-		if _, err := handler.encoder.Encode(handler.bytesw, v, amf.AMF0); err != nil {
+		var err error
+		if typeID == 17 && isAmfObject(v) {
+			_, err = handler.encoder.EncodeAmf0Amf3(handler.bytesw, v)
+		} else {
+			_, err = handler.encoder.Encode(handler.bytesw, v, amf.AMF0)
+		}
+		if err != nil {
 			return err
 		}
 	}
@@ -292,7 +549,7 @@ func (handler *Handler) writeMsg(csid, streamID uint32, args ...interface{}) err
 		Format:    0,
 		CSID:      csid,
 		Timestamp: 0,
-		TypeID:    20,
+		TypeID:    typeID,
 		StreamID:  streamID,
 		Length:    uint32(len(msg)),
 		Data:      msg,
@@ -303,21 +560,6 @@ func (handler *Handler) writeMsg(csid, streamID uint32, args ...interface{}) err
 	return handler.conn.Flush()
 }
 
-/*
-func (handler *Handler) Write(c ChunkStream) error {
-	if c.TypeID == av.TAG_SCRIPTDATAAMF0 ||
-		c.TypeID == av.TAG_SCRIPTDATAAMF3 {
-		var err error
-		if c.Data, err = amf.MetaDataReform(c.Data, amf.DEL); err != nil {
-			return err
-		}
-		c.Length = uint32(len(c.Data))
-	}
-
-	return handler.conn.Write(&c)
-}
-*/
-
 func (handler *Handler) Flush() error {
 	return handler.conn.Flush()
 }
@@ -333,6 +575,42 @@ func (handler *Handler) GetInfo() (app string, name string, url string) {
 	return
 }
 
+// sendStatus sends an onStatus event on the handler's stream without
+// a preceding command from the peer.
+func (handler *Handler) sendStatus(level, code, description string) error {
+	event := StatusEvent{
+		Level:       level,
+		Code:        code,
+		Description: description,
+	}
+
+	return handler.writeMsg(5, uint32(handler.streamID), "onStatus", 0, nil, event)
+}
+
+/*
+Close closes the connection. When the stream ends because the server
+shuts down or the publisher went away, the peer is told so first:
+
+	publisher, ErrServerClosed: NetStream.Unpublish.Success
+	player, ErrServerClosed:    StreamEOF, NetStream.Play.Stop
+	player, ErrUnpublished:     NetStream.Play.UnpublishNotify, StreamEOF
+*/
 func (handler *Handler) Close(err error) {
+	if handler.done && (err == ErrServerClosed || err == ErrUnpublished) {
+		handler.conn.SetWriteDeadline(time.Now().Add(time.Second))
+
+		switch {
+		case handler.isPublisher && err == ErrServerClosed:
+			handler.sendStatus("status", "NetStream.Unpublish.Success", "Server is shutting down.")
+		case !handler.isPublisher && err == ErrServerClosed:
+			handler.conn.SetEOF()
+			handler.sendStatus("status", "NetStream.Play.Stop", "Server is shutting down.")
+		case !handler.isPublisher && err == ErrUnpublished:
+			handler.sendStatus("status", "NetStream.Play.UnpublishNotify", "Stream is now unpublished.")
+			handler.conn.SetEOF()
+			handler.conn.Flush()
+		}
+	}
+
 	handler.conn.Close()
 }
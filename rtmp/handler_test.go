@@ -0,0 +1,206 @@
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"rtmp-example/internal/amf"
+)
+
+func TestPlayArguments(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []interface{}
+		want      PlayInfo
+		liveOnly  bool
+		recording bool
+	}{
+		{
+			name: "stream name only",
+			args: []interface{}{4.0, nil, "test"},
+			want: PlayInfo{Start: -2, Duration: -1, Reset: true},
+		},
+		{
+			name:     "live only",
+			args:     []interface{}{4.0, nil, "test", -1.0},
+			want:     PlayInfo{Start: -1, Duration: -1, Reset: true},
+			liveOnly: true,
+		},
+		{
+			name:      "recorded from the start",
+			args:      []interface{}{4.0, nil, "test", 0.0},
+			want:      PlayInfo{Start: 0, Duration: -1, Reset: true},
+			recording: true,
+		},
+		{
+			name:      "offset and duration in seconds",
+			args:      []interface{}{4.0, nil, "test", 12.5, 30.0, false},
+			want:      PlayInfo{Start: 12500, Duration: 30000},
+			recording: true,
+		},
+		{
+			name: "numeric reset",
+			args: []interface{}{4.0, nil, "test", -2.0, -1.0, 0.0},
+			want: PlayInfo{Start: -2, Duration: -1},
+		},
+	}
+
+	for _, tt := range tests {
+		h := NewHandler(nil)
+		if err := h.play(tt.args); err != nil {
+			t.Errorf("%s: play: %v", tt.name, err)
+			continue
+		}
+		if h.PlayInfo != tt.want {
+			t.Errorf("%s: PlayInfo = %+v, want %+v", tt.name, h.PlayInfo, tt.want)
+		}
+		if h.PlayInfo.LiveOnly() != tt.liveOnly || h.PlayInfo.RecordedOnly() != tt.recording {
+			t.Errorf("%s: LiveOnly, RecordedOnly = %v, %v, want %v, %v", tt.name,
+				h.PlayInfo.LiveOnly(), h.PlayInfo.RecordedOnly(), tt.liveOnly, tt.recording)
+		}
+		if h.transactionID != 4 || h.PublishInfo.Name != "test" {
+			t.Errorf("%s: transaction ID, name = %d, %q", tt.name, h.transactionID, h.PublishInfo.Name)
+		}
+	}
+
+	if err := NewHandler(nil).play([]interface{}{4.0, nil}); err == nil {
+		t.Error("play without a stream name succeeded")
+	}
+}
+
+func TestPublishArguments(t *testing.T) {
+	h := NewHandler(nil)
+	if err := h.publishOrPlay([]interface{}{5.0, nil, "test", "append"}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if h.transactionID != 5 || h.PublishInfo != (PublishInfo{Name: "test", Type: publishAppend}) {
+		t.Errorf("transaction ID, PublishInfo = %d, %+v", h.transactionID, h.PublishInfo)
+	}
+
+	for _, args := range [][]interface{}{
+		{5.0, nil},
+		{5.0, nil, ""},
+		{5.0, nil, "", "record"},
+	} {
+		if err := NewHandler(nil).publishOrPlay(args); err == nil {
+			t.Errorf("publish %#v succeeded", args)
+		}
+	}
+}
+
+func TestConnectResp(t *testing.T) {
+	c, peer := net.Pipe()
+	defer c.Close()
+	defer peer.Close()
+
+	h := NewHandler(NewConn(c, 1024))
+	h.transactionID = 1
+	go h.connectResp(&ChunkStream{CSID: 3})
+
+	conn := NewConn(peer, 1024)
+	var cs ChunkStream
+	for cs.TypeID != 20 {
+		if err := conn.Read(&cs); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	vs, err := amf.NewDecoder().DecodeBatch(bytes.NewReader(cs.Data), amf.AMF0)
+	if err == io.EOF {
+		err = nil
+	}
+	if err != nil || len(vs) != 4 || vs[0] != "_result" {
+		t.Fatalf("connect response %#v: %v", vs, err)
+	}
+
+	var resp ConnectResp
+	if err := amf.UnmarshalValue(vs[2], &resp); err != nil {
+		t.Fatalf("UnmarshalValue: %v", err)
+	}
+	// fourCcList only holds video codecs, audio ones go to the info map
+	if want := []string{"av01", "vp09", "hvc1"}; !reflect.DeepEqual(resp.FourCcList, want) {
+		t.Errorf("fourCcList = %q, want %q", resp.FourCcList, want)
+	}
+	want := map[string]int{"Opus": 4, "fLaC": 4, "ac-3": 4, "ec-3": 4, "mp4a": 4}
+	if !reflect.DeepEqual(resp.AudioFourCcInfoMap, want) {
+		t.Errorf("audioFourCcInfoMap = %v, want %v", resp.AudioFourCcInfoMap, want)
+	}
+}
+
+func TestConnectInfo(t *testing.T) {
+	tests := []struct {
+		name string
+		obj  amf.Object
+		want ConnectInfo
+	}{
+		{
+			name: "OBS",
+			obj: amf.Object{
+				"app":      "live",
+				"type":     "nonprivate",
+				"flashVer": "FMLE/3.0 (compatible; FMSc/1.0)",
+				"swfUrl":   "rtmp://localhost:1935/live",
+				"tcUrl":    "rtmp://localhost:1935/live",
+			},
+			want: ConnectInfo{
+				App:      "live",
+				Type:     "nonprivate",
+				Flashver: "FMLE/3.0 (compatible; FMSc/1.0)",
+				SwfUrl:   "rtmp://localhost:1935/live",
+				TcUrl:    "rtmp://localhost:1935/live",
+			},
+		},
+		{
+			name: "ffmpeg",
+			obj: amf.Object{
+				"app":           "live",
+				"flashVer":      "LNX 9,0,124,2",
+				"tcUrl":         "rtmp://localhost:1935/live",
+				"fpad":          false,
+				"capabilities":  15.0,
+				"audioCodecs":   4071.0,
+				"videoCodecs":   252.0,
+				"videoFunction": 1.0,
+			},
+			want: ConnectInfo{
+				App:           "live",
+				Flashver:      "LNX 9,0,124,2",
+				TcUrl:         "rtmp://localhost:1935/live",
+				Capabilities:  15,
+				AudioCodecs:   4071,
+				VideoCodecs:   252,
+				VideoFunction: 1,
+			},
+		},
+		{
+			name: "mismatched types",
+			obj: amf.Object{
+				"app":            "live",
+				"tcUrl":          "rtmp://localhost:1935/live",
+				"capabilities":   "15",
+				"fpad":           0.0,
+				"objectEncoding": 3.0,
+				"fourCcList":     amf.Array{"hvc1", 1.0},
+				"unknown":        true,
+			},
+			want: ConnectInfo{
+				App:            "live",
+				TcUrl:          "rtmp://localhost:1935/live",
+				ObjectEncoding: 3,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		h := NewHandler(nil)
+		if err := h.connect([]interface{}{1.0, tt.obj}); err != nil {
+			t.Errorf("%s: connect: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(h.ConnInfo, tt.want) {
+			t.Errorf("%s: ConnInfo = %+v, want %+v", tt.name, h.ConnInfo, tt.want)
+		}
+	}
+}
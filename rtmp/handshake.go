@@ -1,8 +1,16 @@
 package rtmp
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"fmt"
 	"io"
+
+	"rtmp-example/internal/bitops"
+
+	log "github.com/sirupsen/logrus"
 )
 
 /*
@@ -53,8 +61,92 @@ var GenuineFPKey = [...]uint8{
 	0x6E, 0xEC, 0x5D, 0x2D, 0x29, 0x80, 0x6F, 0xAB, 0x93, 0xB8, 0xE6, 0x36, 0xCF, 0xEB, 0x31, 0xae,
 }
 
+var (
+	hsClientPartialKey = GenuineFPKey[:30]
+	hsServerFullKey    = GenuineFMSKey[:]
+	hsServerPartialKey = GenuineFMSKey[:36]
+)
+
+// hsServerVersion is announced in S1, clients only check it is non-zero.
+const hsServerVersion = 0x0d0e0a0d
+
 type Handshake struct{}
 
+/*
+The complex handshake hides a 32 byte HMAC-SHA256 digest in C1 and S1.
+The 1528 random bytes after time and version hold a 764 byte key block
+and a 764 byte digest block, in either order:
+
+	schema 0: time(4) version(4) key(764)    digest(764)
+	schema 1: time(4) version(4) digest(764) key(764)
+
+The digest offset inside its block is the sum of the block's first four
+bytes modulo 728, and the digest covers every other byte of C1/S1.
+*/
+func hsCalcDigestPos(p []byte, base int) (pos int) {
+	for i := 0; i < 4; i++ {
+		pos += int(p[base+i])
+	}
+	pos = (pos % 728) + base + 4
+	return
+}
+
+// hsMakeDigest signs src, skipping the 32 digest bytes at gap if gap > 0.
+func hsMakeDigest(key []byte, src []byte, gap int) []byte {
+	h := hmac.New(sha256.New, key)
+	if gap <= 0 {
+		h.Write(src)
+	} else {
+		h.Write(src[:gap])
+		h.Write(src[gap+32:])
+	}
+	return h.Sum(nil)
+}
+
+func hsFindDigest(p []byte, key []byte, base int) int {
+	gap := hsCalcDigestPos(p, base)
+	digest := hsMakeDigest(key, p, gap)
+	if !bytes.Equal(p[gap:gap+32], digest) {
+		return -1
+	}
+	return gap
+}
+
+// hsParse1 validates the digest of C1 (or S1), trying schema 0 then
+// schema 1, and derives the key the peer expects S2 (or C2) signed with.
+func hsParse1(p []byte, peerKey []byte, key []byte) (ok bool, schema int, digest []byte) {
+	var pos int
+	if pos = hsFindDigest(p, peerKey, 772); pos == -1 {
+		if pos = hsFindDigest(p, peerKey, 8); pos == -1 {
+			return
+		}
+		schema = 1
+	}
+	ok = true
+	digest = hsMakeDigest(key, p[pos:pos+32], -1)
+	return
+}
+
+// hsCreate01 fills C0C1 (or S0S1) with random bytes and a schema 1 digest.
+func hsCreate01(p []byte, time uint32, ver uint32, key []byte) {
+	p[0] = 3
+	p1 := p[1:]
+	rand.Read(p1[8:])
+	bitops.PutU32BE(p1[0:4], time)
+	bitops.PutU32BE(p1[4:8], ver)
+	gap := hsCalcDigestPos(p1, 8)
+	digest := hsMakeDigest(key, p1, gap)
+	copy(p1[gap:], digest)
+}
+
+// hsCreate2 fills C2 (or S2) with random bytes signed in the last 32.
+func hsCreate2(p []byte, key []byte) {
+	rand.Read(p)
+	gap := len(p) - 32
+	digest := hsMakeDigest(key, p, gap)
+	copy(p[gap:], digest)
+}
+
 func HandshakeServer(conn *Connection) (err error) {
 	var clientData [1 + 1536*2]byte
 	var serverData [1 + 1536*2]byte
@@ -85,8 +177,30 @@ func HandshakeServer(conn *Connection) (err error) {
 
 	S0[0] = 3
 
-	copy(S0S1, C0C1)
-	copy(S2, C1)
+	/*
+	   Clients that put a non-zero version in C1 expect the complex
+	   handshake. Those whose digest does not check out, and those that
+	   send a zero version, get the plain echo handshake.
+	*/
+	cliTime := bitops.U32BE(C1[0:4])
+	cliVer := bitops.U32BE(C1[4:8])
+	complexOK := false
+	if cliVer != 0 {
+		ok, schema, digest := hsParse1(C1, hsClientPartialKey, hsServerFullKey)
+		if ok {
+			hsCreate01(S0S1, cliTime, hsServerVersion, hsServerPartialKey)
+			hsCreate2(S2, digest)
+			complexOK = true
+			log.Debugf("rtmp: complex handshake, schema %d", schema)
+		} else {
+			log.Debugf("rtmp: C1 digest not found, falling back to simple handshake")
+		}
+	}
+
+	if !complexOK {
+		copy(S0S1, C0C1)
+		copy(S2, C1)
+	}
 
 	if _, err = conn.rw.Write(S0S1); err != nil {
 		return
@@ -106,3 +220,56 @@ func HandshakeServer(conn *Connection) (err error) {
 
 	return
 }
+
+// hsClientVersion is announced in C1 to ask for the complex handshake.
+const hsClientVersion = 0x0a000000
+
+var hsClientFullKey = GenuineFPKey[:]
+
+/*
+HandshakeClient performs the client side of the handshake. C1 always
+carries a digest; when S1 carries one too C2 is signed with the key
+derived from it, otherwise C2 simply echoes S1.
+*/
+func HandshakeClient(conn *Connection) (err error) {
+	var clientData [1 + 1536*2]byte
+	var serverData [1 + 1536*2]byte
+
+	C0C1 := clientData[:1536+1]
+	C2 := clientData[1536+1:]
+
+	S0 := serverData[:1]
+	S1 := serverData[1 : 1536+1]
+	S0S1S2 := serverData[:]
+
+	hsCreate01(C0C1, 0, hsClientVersion, hsClientPartialKey)
+
+	if _, err = conn.rw.Write(C0C1); err != nil {
+		return
+	}
+
+	if err = conn.rw.Flush(); err != nil {
+		return
+	}
+
+	if _, err = io.ReadFull(conn.rw, S0S1S2); err != nil {
+		return
+	}
+
+	if S0[0] != 3 {
+		err = fmt.Errorf("rtmp: handshake version=%d invalid", S0[0])
+		return
+	}
+
+	if ok, _, digest := hsParse1(S1, hsServerPartialKey, hsClientFullKey); ok {
+		hsCreate2(C2, digest)
+	} else {
+		copy(C2, S1)
+	}
+
+	if _, err = conn.rw.Write(C2); err != nil {
+		return
+	}
+
+	return conn.rw.Flush()
+}
@@ -0,0 +1,130 @@
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- HandshakeServer(NewConn(s, 4096))
+	}()
+
+	if err := HandshakeClient(NewConn(c, 4096)); err != nil {
+		t.Fatalf("HandshakeClient: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("HandshakeServer: %v", err)
+	}
+}
+
+// serverHandshake sends C0C1 to HandshakeServer and returns S0S1S2.
+func serverHandshake(t *testing.T, c0c1 []byte) ([]byte, error) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- HandshakeServer(NewConn(s, 4096))
+	}()
+
+	if _, err := c.Write(c0c1); err != nil {
+		return nil, <-done
+	}
+	s0s1s2 := make([]byte, 1+1536*2)
+	if _, err := io.ReadFull(c, s0s1s2); err != nil {
+		t.Fatalf("read S0S1S2: %v", err)
+	}
+	if _, err := c.Write(make([]byte, 1536)); err != nil {
+		t.Fatalf("write C2: %v", err)
+	}
+	return s0s1s2, <-done
+}
+
+func TestHandshakeServerComplex(t *testing.T) {
+	c0c1 := make([]byte, 1+1536)
+	hsCreate01(c0c1, 0, hsClientVersion, hsClientPartialKey)
+
+	s0s1s2, err := serverHandshake(t, c0c1)
+	if err != nil {
+		t.Fatalf("HandshakeServer: %v", err)
+	}
+	s1 := s0s1s2[1 : 1+1536]
+	s2 := s0s1s2[1+1536:]
+
+	if s0s1s2[0] != 3 {
+		t.Errorf("S0 = %d, want 3", s0s1s2[0])
+	}
+	if ok, _, _ := hsParse1(s1, hsServerPartialKey, hsClientFullKey); !ok {
+		t.Error("S1 digest not signed with the FMS key")
+	}
+
+	// S2 is signed with the key derived from the digest of C1
+	ok, schema, key := hsParse1(c0c1[1:], hsClientPartialKey, hsServerFullKey)
+	if !ok || schema != 1 {
+		t.Fatalf("C1 digest: ok %v, schema %d", ok, schema)
+	}
+	if want := hsMakeDigest(key, s2, len(s2)-32); !bytes.Equal(s2[len(s2)-32:], want) {
+		t.Errorf("S2 digest = % x, want % x", s2[len(s2)-32:], want)
+	}
+}
+
+func TestHandshakeServerSimple(t *testing.T) {
+	tests := []struct {
+		name string
+		c1   func([]byte)
+	}{
+		{"zero version", func(c1 []byte) {
+			for i := range c1 {
+				c1[i] = byte(i)
+			}
+			copy(c1[4:8], []byte{0, 0, 0, 0})
+		}},
+		{"digest mismatch", func(c1 []byte) {
+			for i := range c1 {
+				c1[i] = byte(i)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		c0c1 := make([]byte, 1+1536)
+		c0c1[0] = 3
+		tt.c1(c0c1[1:])
+
+		s0s1s2, err := serverHandshake(t, c0c1)
+		if err != nil {
+			t.Errorf("%s: HandshakeServer: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(s0s1s2[:1+1536], c0c1) || !bytes.Equal(s0s1s2[1+1536:], c0c1[1:]) {
+			t.Errorf("%s: S0S1S2 does not echo C0C1", tt.name)
+		}
+	}
+}
+
+func TestHandshakeServerVersion(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- HandshakeServer(NewConn(s, 4096))
+	}()
+
+	c0c1 := make([]byte, 1+1536)
+	c0c1[0] = 6
+	c.Write(c0c1)
+	if err := <-done; err == nil {
+		t.Error("HandshakeServer accepted version 6")
+	}
+}
@@ -1,3 +1,74 @@
 package rtmp
 
+import (
+	"bytes"
+
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/flv"
+)
+
 type Message struct{}
+
+// isMediaMessage reports whether a message carries audio, video or
+// script data that should be forwarded to players.
+func isMediaMessage(typeID uint32) bool {
+	switch typeID {
+	case av.TAG_AUDIO, av.TAG_VIDEO, av.TAG_SCRIPTDATAAMF0, av.TAG_SCRIPTDATAAMF3:
+		return true
+	}
+	return false
+}
+
+// AMF0 encoded names of the data messages a server sends on its own.
+var (
+	sampleAccessPrefix = []byte("\x02\x00\x11|RtmpSampleAccess")
+	playStatusPrefix   = []byte("\x02\x00\x0conPlayStatus")
+)
+
+// isServerNotice reports whether a data message is the server's
+// |RtmpSampleAccess or onPlayStatus notice rather than stream metadata.
+func isServerNotice(data []byte) bool {
+	return bytes.HasPrefix(data, sampleAccessPrefix) || bytes.HasPrefix(data, playStatusPrefix)
+}
+
+// chunkToPacket converts a complete media message into a packet and
+// parses its audio or video tag header into p.Header. AMF3 data
+// messages carry a leading format byte which is dropped so metadata
+// packets are always plain AMF0.
+func chunkToPacket(c *ChunkStream, p *av.Packet) error {
+	*p = av.Packet{
+		IsAudio:    c.TypeID == av.TAG_AUDIO,
+		IsVideo:    c.TypeID == av.TAG_VIDEO,
+		IsMetadata: c.TypeID == av.TAG_SCRIPTDATAAMF0 || c.TypeID == av.TAG_SCRIPTDATAAMF3,
+		TimeStamp:  c.Timestamp,
+		StreamID:   c.StreamID,
+		Data:       c.Data,
+	}
+
+	if c.TypeID == av.TAG_SCRIPTDATAAMF3 && len(p.Data) > 0 {
+		p.Data = p.Data[1:]
+	}
+	return flv.ParseHeader(p)
+}
+
+// packetToChunk builds the message used to send a packet on streamID.
+func packetToChunk(p *av.Packet, streamID uint32) ChunkStream {
+	var typeID uint32
+	switch {
+	case p.IsAudio:
+		typeID = av.TAG_AUDIO
+	case p.IsVideo:
+		typeID = av.TAG_VIDEO
+	default:
+		typeID = av.TAG_SCRIPTDATAAMF0
+	}
+
+	return ChunkStream{
+		Format:    0,
+		Timestamp: p.TimeStamp,
+		TypeID:    typeID,
+		StreamID:  streamID,
+		Length:    uint32(len(p.Data)),
+		Data:      p.Data,
+	}
+}
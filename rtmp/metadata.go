@@ -0,0 +1,71 @@
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"rtmp-example/internal/amf"
+	"rtmp-example/internal/av"
+)
+
+// serverName is added to the metadata of published streams.
+const serverName = "rtmp-example"
+
+// AMF0 encoded name of the stream metadata, once @setDataFrame is
+// stripped.
+var onMetaDataPrefix = []byte("\x02\x00\x0a" + amf.OnMetaData)
+
+// isOnMetaData reports whether p carries stream metadata rather than
+// another data message such as a cue point.
+func isOnMetaData(p *av.Packet) bool {
+	return p.IsMetadata && bytes.HasPrefix(p.Data, onMetaDataPrefix)
+}
+
+/*
+rewriteMetadata strips the @setDataFrame name publishers put in front
+of their data messages, which players and FLV files do not expect.
+
+For onMetaData, the properties are decoded and the server fields
+added, then the message is encoded again as an ECMA array and the
+properties returned. Other data messages are only stripped.
+*/
+func rewriteMetadata(p *av.Packet) (amf.Object, error) {
+	data, err := amf.MetaDataReform(p.Data, amf.DEL)
+	if err != nil {
+		return nil, err
+	}
+	p.Data = data
+	if !isOnMetaData(p) {
+		return nil, nil
+	}
+
+	vs, _ := amf.NewDecoder().DecodeBatch(bytes.NewReader(data), amf.AMF0)
+	if len(vs) < 2 {
+		return nil, fmt.Errorf("rtmp: onMetaData without properties")
+	}
+	props, ok := vs[1].(amf.Object)
+	if !ok {
+		return nil, fmt.Errorf("rtmp: onMetaData properties are %T, not an object", vs[1])
+	}
+
+	meta := make(amf.Object, len(props)+2)
+	for k, v := range props {
+		meta[k] = v
+	}
+	meta["server"] = serverName
+	if _, ok := meta["creationdate"]; !ok {
+		meta["creationdate"] = time.Now().UTC().Format(time.ANSIC)
+	}
+
+	var b bytes.Buffer
+	var e amf.Encoder
+	if _, err := e.EncodeAmf0String(&b, amf.OnMetaData, true); err != nil {
+		return nil, err
+	}
+	if _, err := e.EncodeAmf0EcmaArray(&b, meta, true); err != nil {
+		return nil, err
+	}
+	p.Data = b.Bytes()
+	return meta, nil
+}
@@ -0,0 +1,194 @@
+package rtmp
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"rtmp-example/internal/av"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const playerQueueSize = 1024
+
+var ErrPlayerClosed = errors.New("player closed")
+
+/*
+player exposes a playing connection as an av.WriteCloser.
+
+Write only queues the packet; a separate goroutine sends the queue to
+the client so one slow viewer never stalls the publisher. When the
+queue is full the queued media is dropped and video resumes at the
+next keyframe, as frames after a gap cannot be decoded. Metadata and
+sequence headers are never dropped.
+*/
+type player struct {
+	handler *Handler
+	info    av.Info
+	packets chan av.Packet
+	done    chan struct{}
+	once    sync.Once
+
+	baseTimestamp uint32
+	lastTimestamp uint32
+	dropped       uint64
+	waitKey       int32
+}
+
+func newPlayer(handler *Handler) *player {
+	app, name, url := handler.GetInfo()
+	return &player{
+		handler: handler,
+		info: av.Info{
+			Key: app + "/" + name,
+			URL: url,
+			UID: av.NewUID(),
+		},
+		packets: make(chan av.Packet, playerQueueSize),
+		done:    make(chan struct{}),
+	}
+}
+
+func (p *player) Write(pkt *av.Packet) error {
+	select {
+	case <-p.done:
+		return ErrPlayerClosed
+	default:
+	}
+
+	header := isHeader(pkt)
+	if atomic.LoadInt32(&p.waitKey) == 1 && pkt.IsVideo && !header {
+		if !isKeyFrame(pkt) {
+			return nil
+		}
+		atomic.StoreInt32(&p.waitKey, 0)
+	}
+
+	select {
+	case p.packets <- *pkt:
+		return nil
+	default:
+	}
+
+	if atomic.AddUint64(&p.dropped, 1)%100 == 1 {
+		log.Warnf("player %s: queue full, dropping packets", p.info.UID)
+	}
+	p.dropMedia()
+
+	// a keyframe starts over right away
+	if header || isKeyFrame(pkt) {
+		select {
+		case p.packets <- *pkt:
+			return nil
+		default:
+		}
+	}
+	atomic.StoreInt32(&p.waitKey, 1)
+	return nil
+}
+
+// dropMedia empties the queue but for metadata and sequence headers.
+func (p *player) dropMedia() {
+	var keep []av.Packet
+drain:
+	for {
+		select {
+		case pkt := <-p.packets:
+			if isHeader(&pkt) {
+				keep = append(keep, pkt)
+			}
+		default:
+			break drain
+		}
+	}
+
+	for _, pkt := range keep {
+		select {
+		case p.packets <- pkt:
+		default:
+		}
+	}
+}
+
+// serve sends queued packets to the client and reads its commands
+// until the client leaves or the player is closed.
+func (p *player) serve() {
+	go p.sendLoop()
+
+	var c ChunkStream
+	for {
+		if err := p.handler.Read(&c); err != nil {
+			p.Close(err)
+			return
+		}
+
+		if c.TypeID == 20 || c.TypeID == 17 {
+			if err := p.handler.handleCmdMsg(&c); err != nil {
+				p.Close(err)
+				return
+			}
+			if p.handler.deleted {
+				p.Close(io.EOF)
+				return
+			}
+		}
+	}
+}
+
+func (p *player) sendLoop() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case pkt := <-p.packets:
+			if err := p.send(&pkt); err != nil {
+				p.Close(err)
+				return
+			}
+		}
+	}
+}
+
+func (p *player) send(pkt *av.Packet) error {
+	ts := pkt.TimeStamp + atomic.LoadUint32(&p.baseTimestamp)
+	atomic.StoreUint32(&p.lastTimestamp, ts)
+
+	c := packetToChunk(pkt, uint32(p.handler.streamID))
+	c.Timestamp = ts
+	if err := p.handler.conn.Write(&c); err != nil {
+		return err
+	}
+
+	if len(p.packets) == 0 {
+		return p.handler.Flush()
+	}
+	return nil
+}
+
+func (p *player) Info() av.Info {
+	return p.info
+}
+
+func (p *player) Alive() bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// CalcBaseTimestamp continues the timeline of the previous publisher
+// so the client sees monotonic timestamps across a republish.
+func (p *player) CalcBaseTimestamp() {
+	atomic.StoreUint32(&p.baseTimestamp, atomic.LoadUint32(&p.lastTimestamp))
+}
+
+func (p *player) Close(err error) {
+	p.once.Do(func() {
+		close(p.done)
+		p.handler.Close(err)
+	})
+}
@@ -0,0 +1,79 @@
+package rtmp
+
+import (
+	"io"
+	"sync/atomic"
+
+	"rtmp-example/internal/av"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// publisher exposes a publishing connection as an av.ReadCloser.
+type publisher struct {
+	handler *Handler
+	info    av.Info
+	closed  int32
+
+	// writers attached along with the publisher, e.g. a recording
+	writers []av.WriteCloser
+}
+
+func newPublisher(handler *Handler) *publisher {
+	app, name, url := handler.GetInfo()
+	return &publisher{
+		handler: handler,
+		info: av.Info{
+			Key: app + "/" + name,
+			URL: url,
+			UID: av.NewUID(),
+		},
+	}
+}
+
+// Read returns the next media message of the publisher. Command
+// messages received meanwhile are handled in place, and deleteStream
+// ends the stream with io.EOF.
+func (p *publisher) Read(pkt *av.Packet) error {
+	var c ChunkStream
+
+	for {
+		if err := p.handler.Read(&c); err != nil {
+			return err
+		}
+
+		switch {
+		case isMediaMessage(c.TypeID):
+			if err := chunkToPacket(&c, pkt); err != nil {
+				log.Debugf("publisher %s: skip packet: %v", p.info.UID, err)
+				continue
+			}
+			return nil
+		case c.TypeID == 20 || c.TypeID == 17:
+			if err := p.handler.handleCmdMsg(&c); err != nil {
+				return err
+			}
+			if p.handler.deleted {
+				return io.EOF
+			}
+		}
+	}
+}
+
+func (p *publisher) Writers() []av.WriteCloser {
+	return p.writers
+}
+
+func (p *publisher) Info() av.Info {
+	return p.info
+}
+
+func (p *publisher) Alive() bool {
+	return atomic.LoadInt32(&p.closed) == 0
+}
+
+func (p *publisher) Close(err error) {
+	if atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		p.handler.Close(err)
+	}
+}
@@ -17,6 +17,17 @@ func NewReadWriter(rw io.ReadWriter, bufSize int) *ReadWriter {
 	}
 }
 
+// Read fills p entirely; a chunk payload may span several reads of
+// the underlying connection.
+func (rw *ReadWriter) Read(p []byte) (int, error) {
+	if rw.readError != nil {
+		return 0, rw.readError
+	}
+	n, err := io.ReadAtLeast(rw.ReadWriter, p, len(p))
+	rw.readError = err
+	return n, err
+}
+
 func (rw *ReadWriter) ReadUintBE(n int) (uint32, error) {
 	if rw.readError != nil {
 		return 0, rw.readError
@@ -0,0 +1,176 @@
+package rtmp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/flv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+recorder writes a published stream to <dir>/<app>/<name>.flv.
+
+In record mode the file is truncated and timestamps start at 0. In
+append mode the file is extended and timestamps continue 1ms after its
+last tag, so the first appended tag does not share its timestamp. The
+file is only opened by the first packet, so a publisher that gets
+rejected never touches it. The publisher is told whether recording
+started through an onStatus event.
+*/
+type recorder struct {
+	handler *Handler
+	info    av.Info
+	path    string
+	append  bool
+
+	file    *os.File
+	w       *bufio.Writer
+	muxer   *flv.Muxer
+	started bool
+	base    uint32
+	first   uint32
+	closed  int32
+}
+
+func newRecorder(handler *Handler, dir string, key string, appendMode bool) (*recorder, error) {
+	path, err := recordPath(dir, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recorder{
+		handler: handler,
+		info: av.Info{
+			Key: key,
+			URL: path,
+			UID: av.NewUID(),
+		},
+		path:   path,
+		append: appendMode,
+	}, nil
+}
+
+// recordPath maps a stream key to its file, refusing keys that would
+// escape dir. Query strings are not part of the file name.
+func recordPath(dir string, key string) (string, error) {
+	if i := strings.IndexByte(key, '?'); i >= 0 {
+		key = key[:i]
+	}
+
+	root := filepath.Clean(dir)
+	path := filepath.Join(root, filepath.FromSlash(key))
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("rtmp: invalid stream name for recording: %q", key)
+	}
+	return path + ".flv", nil
+}
+
+func (rec *recorder) open() error {
+	if err := os.MkdirAll(filepath.Dir(rec.path), 0755); err != nil {
+		return err
+	}
+
+	flags := os.O_RDWR | os.O_CREATE
+	if !rec.append {
+		flags |= os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(rec.path, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if rec.append && info.Size() > 0 {
+		last, err := flv.LastTimestamp(f)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return err
+		}
+		rec.base = last + 1
+		rec.file = f
+		rec.w = bufio.NewWriter(f)
+		rec.muxer = &flv.Muxer{NoHeader: true}
+		return nil
+	}
+
+	rec.file = f
+	rec.w = bufio.NewWriter(f)
+	rec.muxer = flv.NewMuxer()
+	return nil
+}
+
+func (rec *recorder) Write(p *av.Packet) error {
+	if !rec.Alive() {
+		return os.ErrClosed
+	}
+
+	if !rec.started {
+		if err := rec.open(); err != nil {
+			log.Errorf("record %s: open %s: %v", rec.info.Key, rec.path, err)
+			rec.handler.sendStatus("error", "NetStream.Record.Failed", err.Error())
+			return err
+		}
+		rec.started = true
+		rec.first = p.TimeStamp
+		log.Infof("record %s: writing %s", rec.info.Key, rec.path)
+		rec.handler.sendStatus("status", "NetStream.Record.Start", "Recording "+rec.info.Key+".")
+	}
+
+	// Packets older than the first one, such as cached headers, are
+	// stamped with the first timestamp.
+	q := *p
+	q.TimeStamp = rec.base
+	if p.TimeStamp > rec.first {
+		q.TimeStamp += p.TimeStamp - rec.first
+	}
+
+	return rec.muxer.Mux(&q, rec.w)
+}
+
+func (rec *recorder) Info() av.Info {
+	return rec.info
+}
+
+func (rec *recorder) Alive() bool {
+	return atomic.LoadInt32(&rec.closed) == 0
+}
+
+func (rec *recorder) CalcBaseTimestamp() {}
+
+func (rec *recorder) Close(err error) {
+	if !atomic.CompareAndSwapInt32(&rec.closed, 0, 1) {
+		return
+	}
+	if rec.file == nil {
+		return
+	}
+
+	if ferr := rec.w.Flush(); ferr != nil {
+		log.Errorf("record %s: flush %s: %v", rec.info.Key, rec.path, ferr)
+	}
+	rec.file.Close()
+	log.Infof("record %s: closed %s", rec.info.Key, rec.path)
+
+	if err != ErrServerClosed {
+		rec.handler.sendStatus("status", "NetStream.Record.Stop", "Stopped recording "+rec.info.Key+".")
+	}
+}
@@ -0,0 +1,114 @@
+package rtmp
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/flv"
+)
+
+// testHandler returns a handler whose peer discards what it is sent.
+func testHandler(t *testing.T) *Handler {
+	c, peer := net.Pipe()
+	go io.Copy(io.Discard, peer)
+	t.Cleanup(func() {
+		c.Close()
+		peer.Close()
+	})
+	return NewHandler(NewConn(c, 1024))
+}
+
+// record writes a GOP stamped from ts on to the recording of live/test.
+func record(t *testing.T, dir string, appendMode bool, ts uint32) {
+	rec, err := newRecorder(testHandler(t), dir, "live/test", appendMode)
+	if err != nil {
+		t.Fatalf("newRecorder: %v", err)
+	}
+	for _, p := range []*av.Packet{
+		testVideo(t, ts, 0x17, 0x00, 0x00, 0x00, 0x00),
+		testVideo(t, ts, 0x17, 0x01, 0x00, 0x00, 0x00, 0xaa),
+		testVideo(t, ts+40, 0x27, 0x01, 0x00, 0x00, 0x00, 0xbb),
+	} {
+		if err := rec.Write(p); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	rec.Close(nil)
+}
+
+// recorded returns the tag timestamps of the recording of live/test.
+func recorded(t *testing.T, dir string) []uint32 {
+	f, err := os.Open(filepath.Join(dir, "live", "test.flv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := flv.NewReader(f)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	var ts []uint32
+	var p av.Packet
+	for {
+		err := r.ReadTag(&p)
+		if err == io.EOF {
+			return ts
+		}
+		if err != nil {
+			t.Fatalf("ReadTag: %v", err)
+		}
+		ts = append(ts, p.TimeStamp)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	dir := t.TempDir()
+
+	record(t, dir, false, 1000)
+	if got, want := recorded(t, dir), []uint32{0, 0, 40}; !equalUint32s(got, want) {
+		t.Errorf("record: timestamps %v, want %v", got, want)
+	}
+
+	// appended tags continue right after the last one
+	record(t, dir, true, 5000)
+	if got, want := recorded(t, dir), []uint32{0, 0, 40, 41, 41, 81}; !equalUint32s(got, want) {
+		t.Errorf("append: timestamps %v, want %v", got, want)
+	}
+
+	record(t, dir, false, 200)
+	if got, want := recorded(t, dir), []uint32{0, 0, 40}; !equalUint32s(got, want) {
+		t.Errorf("record again: timestamps %v, want %v", got, want)
+	}
+}
+
+func TestRecordPath(t *testing.T) {
+	dir := filepath.FromSlash("/var/rec")
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"live/test", "/var/rec/live/test.flv"},
+		{"live/test?token=1", "/var/rec/live/test.flv"},
+		{"live/a/b", "/var/rec/live/a/b.flv"},
+		{"live/../test", "/var/rec/test.flv"},
+		{"live/../../test", ""},
+		{"..", ""},
+	}
+	for _, tt := range tests {
+		got, err := recordPath(dir, tt.key)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("recordPath(%q) = %q, want an error", tt.key, got)
+			}
+			continue
+		}
+		if err != nil || got != filepath.FromSlash(tt.want) {
+			t.Errorf("recordPath(%q) = %q, %v, want %q", tt.key, got, err, tt.want)
+		}
+	}
+}
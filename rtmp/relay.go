@@ -0,0 +1,381 @@
+package rtmp
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rtmp-example/internal/av"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	relayQueueSize         = 1024
+	defaultRelayMinBackoff = time.Second
+	defaultRelayMaxBackoff = 30 * time.Second
+)
+
+// Push target states reported by RelayStatus.
+const (
+	RelayConnecting = "connecting"
+	RelayStreaming  = "streaming"
+	RelayBackoff    = "backoff"
+	RelayStopped    = "stopped"
+)
+
+// RelayStatus describes one outgoing connection of a push relay.
+type RelayStatus struct {
+	Key       string
+	URL       string
+	State     string
+	Since     time.Time
+	Retries   int
+	LastError string
+	Packets   uint64
+	Bytes     uint64
+}
+
+/*
+PushRelay forwards every stream published to a configured app to a
+list of upstream servers. A stream published as app/name is pushed to
+<target>/name for each target URL of app.
+
+Register it with StreamHub.AddGetWriter. Each target reconnects with
+exponential backoff between MinBackoff and MaxBackoff; after a
+reconnect the cached metadata and sequence headers are sent again and
+media resumes at the next keyframe.
+*/
+type PushRelay struct {
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	mu      sync.Mutex
+	targets map[string][]string
+	active  map[*pushTarget]struct{}
+}
+
+func NewPushRelay() *PushRelay {
+	return &PushRelay{
+		MinBackoff: defaultRelayMinBackoff,
+		MaxBackoff: defaultRelayMaxBackoff,
+		targets:    make(map[string][]string),
+		active:     make(map[*pushTarget]struct{}),
+	}
+}
+
+// AddTarget pushes streams published to app to the rtmp URL target,
+// e.g. AddTarget("live", "rtmp://a.example.com/app").
+func (relay *PushRelay) AddTarget(app, target string) {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+
+	relay.targets[app] = append(relay.targets[app], strings.TrimSuffix(target, "/"))
+}
+
+// GetWriter implements av.GetWriter.
+func (relay *PushRelay) GetWriter(info av.Info) av.WriteCloser {
+	app, name := splitKey(info.Key)
+
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+
+	bases := relay.targets[app]
+	if len(bases) == 0 {
+		return nil
+	}
+
+	w := &pushWriter{
+		relay: relay,
+		info: av.Info{
+			Key: info.Key,
+			URL: info.URL,
+			UID: av.NewUID(),
+		},
+	}
+	for _, base := range bases {
+		t := newPushTarget(relay, info.Key, base+"/"+name)
+		relay.active[t] = struct{}{}
+		w.targets = append(w.targets, t)
+		go t.run()
+	}
+	return w
+}
+
+// Status returns the state of every target of every relayed stream.
+func (relay *PushRelay) Status() []RelayStatus {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+
+	ret := make([]RelayStatus, 0, len(relay.active))
+	for t := range relay.active {
+		ret = append(ret, t.status())
+	}
+	return ret
+}
+
+func (relay *PushRelay) remove(t *pushTarget) {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+
+	delete(relay.active, t)
+}
+
+// splitKey splits a stream key into app and stream name.
+func splitKey(key string) (app, name string) {
+	if i := strings.Index(key, "/"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// pushWriter hands the packets of one published stream to its targets.
+type pushWriter struct {
+	relay   *PushRelay
+	info    av.Info
+	targets []*pushTarget
+	closed  int32
+}
+
+func (w *pushWriter) Write(p *av.Packet) error {
+	for _, t := range w.targets {
+		t.write(p)
+	}
+	return nil
+}
+
+func (w *pushWriter) Info() av.Info {
+	return w.info
+}
+
+func (w *pushWriter) Alive() bool {
+	return atomic.LoadInt32(&w.closed) == 0
+}
+
+func (w *pushWriter) CalcBaseTimestamp() {}
+
+func (w *pushWriter) Close(err error) {
+	if !atomic.CompareAndSwapInt32(&w.closed, 0, 1) {
+		return
+	}
+	for _, t := range w.targets {
+		t.stop()
+	}
+}
+
+// pushTarget keeps one outgoing connection alive.
+type pushTarget struct {
+	relay   *PushRelay
+	key     string
+	url     string
+	packets chan *av.Packet
+	dropped int32
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	// latest headers, replayed after every reconnect
+	hmu       sync.Mutex
+	metadata  *av.Packet
+	videoSeq  *av.Packet
+	audioSeqs audioSeqs
+
+	smu sync.Mutex
+	st  RelayStatus
+}
+
+func newPushTarget(relay *PushRelay, key, url string) *pushTarget {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &pushTarget{
+		relay:   relay,
+		key:     key,
+		url:     url,
+		packets: make(chan *av.Packet, relayQueueSize),
+		ctx:     ctx,
+		cancel:  cancel,
+		st: RelayStatus{
+			Key:   key,
+			URL:   url,
+			State: RelayConnecting,
+			Since: time.Now(),
+		},
+	}
+}
+
+func (t *pushTarget) write(p *av.Packet) {
+	t.hmu.Lock()
+	switch {
+	case isOnMetaData(p):
+		t.metadata = p
+	case isVideoSeq(p):
+		t.videoSeq = p
+	case isAudioSeq(p):
+		t.audioSeqs.set(p)
+	}
+	t.hmu.Unlock()
+
+	select {
+	case t.packets <- p:
+	default:
+		// The target is down or too slow; headers are replayed and
+		// media resumes at a keyframe once it catches up.
+		atomic.StoreInt32(&t.dropped, 1)
+	}
+}
+
+func (t *pushTarget) stop() {
+	t.cancel()
+}
+
+func (t *pushTarget) run() {
+	defer t.relay.remove(t)
+	defer t.setState(RelayStopped, nil)
+
+	backoff := t.relay.MinBackoff
+	for {
+		t.setState(RelayConnecting, nil)
+
+		cc, err := DialContext(t.ctx, t.url, av.PUBLISH)
+		if err == nil {
+			log.Infof("relay %s: pushing to %s", t.key, t.url)
+			t.setState(RelayStreaming, nil)
+			backoff = t.relay.MinBackoff
+			err = t.forward(cc)
+			cc.Close(err)
+		}
+
+		if t.ctx.Err() != nil {
+			return
+		}
+
+		log.Warnf("relay %s: push to %s failed, retry in %s: %v", t.key, t.url, backoff, err)
+		t.setState(RelayBackoff, err)
+
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > t.relay.MaxBackoff {
+			backoff = t.relay.MaxBackoff
+		}
+	}
+}
+
+// forward sends the headers, then the queued media from the next
+// keyframe on, until the connection fails or the target is stopped.
+// Whenever packets were dropped meanwhile, the headers are sent again
+// and media resumes at the next keyframe.
+func (t *pushTarget) forward(cc *Client) error {
+	// what was queued while disconnected is stale
+	t.drain()
+
+	hasVideo, err := t.sendHeaders(cc)
+	if err != nil {
+		return err
+	}
+
+	waitKey := true
+	for {
+		select {
+		case <-t.ctx.Done():
+			return t.ctx.Err()
+		case <-cc.done:
+			return cc.closeErr()
+		case p := <-t.packets:
+			if atomic.SwapInt32(&t.dropped, 0) == 1 {
+				if hasVideo, err = t.sendHeaders(cc); err != nil {
+					return err
+				}
+				waitKey = true
+			}
+
+			if isHeader(p) {
+				if err := t.send(cc, p); err != nil {
+					return err
+				}
+				hasVideo = hasVideo || isVideoSeq(p)
+				continue
+			}
+
+			if waitKey && hasVideo {
+				if !isKeyFrame(p) {
+					continue
+				}
+				waitKey = false
+			}
+
+			if err := t.send(cc, p); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// drain empties the queue.
+func (t *pushTarget) drain() {
+	for {
+		select {
+		case <-t.packets:
+		default:
+			atomic.StoreInt32(&t.dropped, 0)
+			return
+		}
+	}
+}
+
+// sendHeaders sends the latest metadata and sequence headers, and
+// reports whether there is video.
+func (t *pushTarget) sendHeaders(cc *Client) (bool, error) {
+	t.hmu.Lock()
+	headers := append([]*av.Packet{t.metadata, t.videoSeq}, t.audioSeqs.packets()...)
+	t.hmu.Unlock()
+
+	for _, p := range headers {
+		if p == nil {
+			continue
+		}
+		if err := t.send(cc, p); err != nil {
+			return false, err
+		}
+	}
+	return headers[1] != nil, nil
+}
+
+func (t *pushTarget) send(cc *Client, p *av.Packet) error {
+	if err := cc.Write(p); err != nil {
+		return err
+	}
+
+	t.smu.Lock()
+	t.st.Packets++
+	t.st.Bytes += uint64(len(p.Data))
+	t.smu.Unlock()
+	return nil
+}
+
+func (t *pushTarget) setState(state string, err error) {
+	t.smu.Lock()
+	defer t.smu.Unlock()
+
+	if state == RelayConnecting && t.st.State == RelayBackoff {
+		t.st.Retries++
+	}
+	if t.st.State != state {
+		t.st.State = state
+		t.st.Since = time.Now()
+	}
+	if err != nil {
+		t.st.LastError = err.Error()
+	}
+}
+
+func (t *pushTarget) status() RelayStatus {
+	t.smu.Lock()
+	defer t.smu.Unlock()
+
+	return t.st
+}
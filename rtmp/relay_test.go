@@ -0,0 +1,155 @@
+package rtmp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"rtmp-example/internal/av"
+)
+
+// received returns a copy of the packets written to w so far.
+func (w *testWriter) received() []av.Packet {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return append([]av.Packet(nil), w.packets...)
+}
+
+// waitFor polls cond until it holds, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+var testMetadata = []byte("\x02\x00\x0aonMetaData\x08\x00\x00\x00\x00\x00\x00\x09")
+
+func TestServerPush(t *testing.T) {
+	upstream := &Server{Hub: NewStreamHub()}
+	ubase := testServer(t, upstream)
+	local := &Server{Hub: NewStreamHub(), Push: map[string][]string{"live": {ubase + "/live"}}}
+	lbase := testServer(t, local)
+
+	w := newTestWriter("live/test")
+	upstream.Hub.HandleWriter(w)
+
+	pub, err := Dial(lbase+"/live/test", av.PUBLISH)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer pub.Close(nil)
+
+	packets := []*av.Packet{
+		{IsMetadata: true, Data: testMetadata},
+		testVideo(t, 0, 0x17, 0x00, 0x00, 0x00, 0x00),
+		testVideo(t, 0, 0x17, 0x01, 0x00, 0x00, 0x00, 0xaa),
+		testVideo(t, 40, 0x27, 0x01, 0x00, 0x00, 0x00, 0xbb),
+	}
+	for i, p := range packets {
+		if err := pub.Write(p); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		// media queued before the push connected is dropped
+		if i == 1 {
+			waitFor(t, "the pushed headers", func() bool { return len(w.received()) >= 2 })
+		}
+	}
+
+	waitFor(t, "pushed packets", func() bool { return len(w.received()) >= len(packets) })
+	got := w.received()
+	if !isOnMetaData(&got[0]) {
+		t.Errorf("first packet = %q, want onMetaData", got[0].Data)
+	}
+	for i, want := range packets[1:] {
+		if !bytes.Equal(got[i+1].Data, want.Data) || got[i+1].TimeStamp != want.TimeStamp {
+			t.Errorf("packet %d = %d % x, want %d % x", i+1, got[i+1].TimeStamp, got[i+1].Data, want.TimeStamp, want.Data)
+		}
+	}
+
+	st := local.RelayStatus()
+	if len(st) != 1 || st[0].State != RelayStreaming || st[0].URL != ubase+"/live/test" || st[0].Packets < uint64(len(packets)) {
+		t.Errorf("RelayStatus = %+v", st)
+	}
+
+	pub.Close(nil)
+	waitFor(t, "the push to stop", func() bool { return len(local.RelayStatus()) == 0 })
+}
+
+func TestPushRelayReconnect(t *testing.T) {
+	upstream := &Server{Hub: NewStreamHub()}
+	ubase := testServer(t, upstream)
+
+	relay := NewPushRelay()
+	relay.MinBackoff = 10 * time.Millisecond
+	relay.AddTarget("live", ubase+"/live/")
+
+	if w := relay.GetWriter(av.Info{Key: "other/test"}); w != nil {
+		t.Error("GetWriter returned a writer for an app without targets")
+	}
+	w := relay.GetWriter(av.Info{Key: "live/test", UID: av.NewUID()})
+	defer w.Close(nil)
+
+	before := newTestWriter("live/test")
+	upstream.Hub.HandleWriter(before)
+
+	w.Write(&av.Packet{IsMetadata: true, Data: testMetadata})
+	w.Write(testVideo(t, 0, 0x17, 0x00, 0x00, 0x00, 0x00))
+	waitFor(t, "the first connection", func() bool { return len(before.received()) >= 2 })
+	w.Write(testVideo(t, 40, 0x17, 0x01, 0x00, 0x00, 0x00, 0xaa))
+	waitFor(t, "the keyframe", func() bool { return len(before.received()) >= 3 })
+
+	// drop the connection on the upstream side
+	upstream.Hub.CloseStream("live/test", ErrServerClosed)
+	after := newTestWriter("live/test")
+	upstream.Hub.HandleWriter(after)
+
+	// the headers are sent again, then media waits for a keyframe
+	waitFor(t, "the headers after reconnecting", func() bool { return len(after.received()) >= 2 })
+	w.Write(testVideo(t, 80, 0x27, 0x01, 0x00, 0x00, 0x00, 0xbb))
+	w.Write(testVideo(t, 120, 0x17, 0x01, 0x00, 0x00, 0x00, 0xcc))
+	waitFor(t, "the next keyframe", func() bool { return len(after.received()) >= 3 })
+
+	got := after.received()
+	if !isOnMetaData(&got[0]) || !isVideoSeq(&got[1]) {
+		t.Errorf("reconnect starts with % x, % x, want metadata and sequence header", got[0].Data, got[1].Data)
+	}
+	if got[2].TimeStamp != 120 || !isKeyFrame(&got[2]) {
+		t.Errorf("media resumes at %d % x, want the keyframe at 120", got[2].TimeStamp, got[2].Data)
+	}
+
+	st := relay.Status()
+	if len(st) != 1 || st[0].State != RelayStreaming || st[0].Retries != 1 || st[0].LastError == "" {
+		t.Errorf("Status = %+v", st)
+	}
+}
+
+func TestPushRelayBackoff(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listen.Addr().String()
+	listen.Close()
+
+	relay := NewPushRelay()
+	relay.MinBackoff = time.Millisecond
+	relay.MaxBackoff = 4 * time.Millisecond
+	relay.AddTarget("live", "rtmp://"+addr+"/live")
+
+	w := relay.GetWriter(av.Info{Key: "live/test", UID: av.NewUID()})
+	waitFor(t, "retries", func() bool {
+		st := relay.Status()
+		return len(st) == 1 && st[0].Retries >= 3 && st[0].LastError != ""
+	})
+
+	w.Close(nil)
+	waitFor(t, "the push to stop", func() bool { return len(relay.Status()) == 0 })
+}
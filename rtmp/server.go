@@ -1,72 +1,290 @@
 package rtmp
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"net"
+	"os"
 	"strconv"
+	"sync"
+	"time"
+
+	"rtmp-example/internal/av"
 
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	defaultHost            = "localhost"
+	defaultShutdownTimeout = 10 * time.Second
+)
+
+var ErrServerClosed = errors.New("rtmp: server closed")
+
 type Server struct {
+	// Host is the address to listen on, localhost when empty.
 	Host string
 	Port int
 
-	inited     bool
-	serverPort int
-	server     net.Listener
+	// RecordDir is where streams published with the record or append
+	// type are written as FLV files. Recording is off when empty.
+	RecordDir string
+
+	// Push maps apps to the rtmp URLs their published streams are
+	// forwarded to, see PushRelay. RelayStatus reports on the pushes.
+	Push map[string][]string
+
+	// Origins maps apps to the rtmp URL of the origin their streams
+	// are played from when nobody publishes them here, see PullRelay.
+	Origins map[string]string
+
+	// ShutdownTimeout bounds the draining done by ListenAndServe when
+	// its context is cancelled. Zero means 10 seconds.
+	ShutdownTimeout time.Duration
+
+	server net.Listener
 
 	Connections map[int]Connection
 	Handlers    map[string]Handler
+
+	// Hub routes published packets to players. A hub is created when
+	// the server starts and none is set, so several servers may share one.
+	Hub *StreamHub
+
+	mu      sync.Mutex
+	closing bool
+	wg      sync.WaitGroup
+	relay   *PushRelay
+	// active maps every open connection to its publisher or player,
+	// or to nil while the connection is still being set up.
+	active map[*Connection]av.Closer
 }
 
-func (srv *Server) Init() bool {
-	log.Println(fmt.Sprintf("Server is starting at port:%d", srv.Port))
+// ListenAndServe listens on Host:Port and serves connections until ctx
+// is cancelled or Shutdown is called. A cancelled ctx shuts the server
+// down gracefully and ListenAndServe returns once draining is over.
+// It always returns a non-nil error, ErrServerClosed after a shutdown.
+func (srv *Server) ListenAndServe(ctx context.Context) error {
+	host := srv.Host
+	if host == "" {
+		host = defaultHost
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(srv.Port))
+	listen, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return srv.Serve(ctx, listen)
+}
 
-	if srv.inited {
-		log.Error("Server is already initialized")
-		return false
+// Serve accepts connections on listen, see ListenAndServe.
+func (srv *Server) Serve(ctx context.Context, listen net.Listener) error {
+	srv.mu.Lock()
+	if srv.closing {
+		srv.mu.Unlock()
+		listen.Close()
+		return ErrServerClosed
 	}
+	if srv.server != nil {
+		srv.mu.Unlock()
+		listen.Close()
+		return fmt.Errorf("rtmp: server is already serving on %s", srv.server.Addr())
+	}
+	srv.server = listen
+	srv.active = make(map[*Connection]av.Closer)
+	if srv.Hub == nil {
+		srv.Hub = NewStreamHub()
+	}
+	if len(srv.Push) > 0 {
+		srv.relay = NewPushRelay()
+		for app, targets := range srv.Push {
+			for _, target := range targets {
+				srv.relay.AddTarget(app, target)
+			}
+		}
+		srv.Hub.AddGetWriter(srv.relay)
+	}
+	if len(srv.Origins) > 0 {
+		edge := NewPullRelay(srv.Hub)
+		for app, origin := range srv.Origins {
+			edge.AddOrigin(app, origin)
+		}
+		srv.Hub.SetPuller(edge)
+	}
+	srv.mu.Unlock()
 
-	srv.serverPort = srv.Port
-	srv.inited = true
+	log.Println(fmt.Sprintf("Server is listening on %s", listen.Addr()))
 
-	//Init server socket
-	if !srv.bindServer() {
-		return false
+	stop := make(chan struct{})
+	defer close(stop)
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			timeout := srv.ShutdownTimeout
+			if timeout == 0 {
+				timeout = defaultShutdownTimeout
+			}
+			sctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			shutdownErr <- srv.Shutdown(sctx)
+		case <-stop:
+		}
+	}()
+
+	for {
+		netconn, err := listen.Accept()
+		if err != nil {
+			if srv.isClosing() {
+				if ctx.Err() != nil {
+					if err := <-shutdownErr; err != nil {
+						return err
+					}
+				}
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				log.Warn("network accept error: ", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			log.Error("network accept error: ", err)
+			return err
+		}
+
+		conn := NewConn(netconn, 4*1024)
+		if !srv.track(conn) {
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			defer srv.untrack(conn)
+			srv.handleConnection(conn)
+		}()
 	}
+}
 
-	//Create threads
-	srv.createPriorityThread()
-	srv.server.Accept()
+/*
+Shutdown stops the server gracefully:
 
-	//Return ok
-	return true
+ 1. the listener is closed so no new connection is accepted,
+ 2. publishers and players are told that their stream ends, and
+    connections still in the handshake or connect phase are closed,
+ 3. connections are waited for until ctx is done,
+ 4. whatever is still open then is closed forcibly.
+
+It returns ctx.Err() when connections had to be closed forcibly.
+*/
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.closing = true
+	listen := srv.server
+	var closers []av.Closer
+	var pending []*Connection
+	for conn, c := range srv.active {
+		if c != nil {
+			closers = append(closers, c)
+		} else {
+			pending = append(pending, conn)
+		}
+	}
+	srv.mu.Unlock()
+
+	if listen != nil {
+		listen.Close()
+	}
+
+	log.Infof("Server is shutting down, closing %d streams", len(closers))
+	for _, c := range closers {
+		c.Close(ErrServerClosed)
+	}
+	// nothing was published or played yet, there is no one to notify
+	for _, conn := range pending {
+		conn.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
 
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	srv.mu.Lock()
+	log.Warnf("Server shutdown deadline exceeded, closing %d connections", len(srv.active))
+	for conn := range srv.active {
+		conn.Close()
+	}
+	srv.mu.Unlock()
+
+	return ctx.Err()
 }
 
-func (srv *Server) bindServer() bool {
-	port := strconv.Itoa(srv.Port)
-	listen, err := net.Listen("tcp", "localhost:"+port)
+// RelayStatus returns the state of the pushes configured with Push.
+func (srv *Server) RelayStatus() []RelayStatus {
+	srv.mu.Lock()
+	relay := srv.relay
+	srv.mu.Unlock()
 
-	if err != nil {
-		log.Error("network listen error: ", err)
+	if relay == nil {
+		return nil
+	}
+	return relay.Status()
+}
+
+func (srv *Server) isClosing() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.closing
+}
+
+// track registers a new connection, unless the server is shutting down.
+func (srv *Server) track(conn *Connection) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.closing {
 		return false
 	}
+	srv.active[conn] = nil
+	srv.wg.Add(1)
+	return true
+}
 
-	defer listen.Close()
+func (srv *Server) untrack(conn *Connection) {
+	srv.mu.Lock()
+	delete(srv.active, conn)
+	srv.mu.Unlock()
 
-	for {
-		netconn, err := listen.Accept()
-		if err != nil {
-			log.Error("network accept init error: ", err)
-			return false
-		}
+	srv.wg.Done()
+}
 
-		conn := NewConn(netconn, 4*1024)
-		go srv.handleConnection(conn)
+// activate records the publisher or player of conn. It closes c and
+// returns false when the server started shutting down meanwhile.
+func (srv *Server) activate(conn *Connection, c av.Closer) bool {
+	srv.mu.Lock()
+	closing := srv.closing
+	if !closing {
+		srv.active[conn] = c
+	}
+	srv.mu.Unlock()
+
+	if closing {
+		c.Close(ErrServerClosed)
+		return false
 	}
+	return true
 }
 
 func (srv *Server) handleConnection(conn *Connection) (err error) {
@@ -90,20 +308,89 @@ func (srv *Server) handleConnection(conn *Connection) (err error) {
 	log.Println(fmt.Sprintf("connection is initialized successfully %s %s", app, name))
 
 	if connHandler.IsPublisher() {
-		for {
-			var buff [1024]byte
+		pub := newPublisher(connHandler)
+		if err := srv.addRecorder(connHandler, pub); err != nil {
+			log.Warn("handleConn record err: ", err)
+			connHandler.sendStatus("error", "NetStream.Record.NoAccess", err.Error())
+		}
+		if !srv.activate(conn, pub) {
+			return ErrServerClosed
+		}
+		srv.Hub.HandleReader(pub)
+	} else if path, ok := srv.recordedFile(connHandler); ok {
+		v, err := newVodPlayer(connHandler, path)
+		if err != nil {
+			log.Warn("handleConn vod err: ", err)
+			connHandler.sendStatus("error", "NetStream.Play.Failed", err.Error())
+			conn.Close()
+			return err
+		}
+		if !srv.activate(conn, v) {
+			return ErrServerClosed
+		}
+		v.serve()
+	} else if connHandler.PlayInfo.RecordedOnly() && srv.RecordDir != "" {
+		connHandler.sendStatus("error", "NetStream.Play.StreamNotFound", "No recording for "+app+"/"+name+".")
+		conn.Close()
+		return nil
+	} else {
+		p := newPlayer(connHandler)
+		if !srv.activate(conn, p) {
+			return ErrServerClosed
+		}
+		srv.Hub.HandleWriter(p)
+		p.serve()
+		srv.Hub.RemoveWriter(p)
+	}
 
-			if _, err = io.ReadFull(connHandler.conn.rw, buff[0:]); err != nil {
-				return
-			}
+	return nil
+}
 
-			fmt.Printf("%x\n", buff)
+// recordedFile returns the recording a player asks for. A live stream
+// is preferred unless the player asked for recorded content only.
+func (srv *Server) recordedFile(h *Handler) (string, bool) {
+	if srv.RecordDir == "" || h.PlayInfo.LiveOnly() {
+		return "", false
+	}
+
+	app, name, _ := h.GetInfo()
+	key := app + "/" + name
+	if !h.PlayInfo.RecordedOnly() {
+		if s, ok := srv.Hub.Stream(key); ok && s.IsPublishing() {
+			return "", false
 		}
 	}
 
-	return nil
+	path, err := recordPath(srv.RecordDir, key)
+	if err != nil {
+		return "", false
+	}
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		return "", false
+	}
+	return path, true
 }
 
-func (srv Server) createPriorityThread() bool {
-	return true
+// addRecorder records pub when it publishes with the record or append
+// type and recording is enabled.
+func (srv *Server) addRecorder(h *Handler, pub *publisher) error {
+	appendMode := false
+	switch h.PublishInfo.Type {
+	case publishRecord:
+	case publishAppend:
+		appendMode = true
+	default:
+		return nil
+	}
+
+	if srv.RecordDir == "" {
+		return nil
+	}
+
+	rec, err := newRecorder(h, srv.RecordDir, pub.info.Key, appendMode)
+	if err != nil {
+		return err
+	}
+	pub.writers = append(pub.writers, rec)
+	return nil
 }
@@ -1,3 +1,513 @@
 package rtmp
 
-type Stream struct{}
+import (
+	"errors"
+	"sync"
+
+	"rtmp-example/internal/aac"
+	"rtmp-example/internal/amf"
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/flv"
+	"rtmp-example/internal/h264"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrPublisherExists = errors.New("stream already has a publisher")
+	ErrUnpublished     = errors.New("publisher went away")
+)
+
+/*
+StreamHub is the registry of live streams, keyed by "app/name".
+
+A publisher is attached with HandleReader and players subscribe with
+HandleWriter. Every packet read from the publisher is handed to all
+writers of the same stream. A stream is dropped from the hub once it
+has neither a publisher nor any writer left.
+
+When a writer subscribes to a stream that nobody publishes, the Puller
+set with SetPuller is asked to fetch it from elsewhere.
+
+Writers may also be attached automatically: every av.GetWriter added
+with AddGetWriter is asked for a writer whenever a publisher starts,
+which is how relays and other outputs follow all published streams.
+
+CacheGops and CacheMaxBytes size the per stream GOP cache replayed to
+every new writer. CacheGops = 0 only keeps metadata and sequence
+headers. Changes apply to streams created afterwards.
+*/
+type StreamHub struct {
+	CacheGops     int
+	CacheMaxBytes int
+
+	mu      sync.Mutex
+	streams map[string]*Stream
+	getters []av.GetWriter
+	puller  Puller
+}
+
+// writerSource is implemented by readers that bring writers of their
+// own, such as a publisher recording its stream. The writers are
+// attached when the reader is and closed if it is rejected.
+type writerSource interface {
+	Writers() []av.WriteCloser
+}
+
+// Puller fetches streams on demand, typically from an origin server.
+// Pull must not block; the fetched stream is fed to the hub with
+// HandleReader.
+type Puller interface {
+	Pull(key string)
+}
+
+func NewStreamHub() *StreamHub {
+	return &StreamHub{
+		CacheGops:     defaultCacheGops,
+		CacheMaxBytes: defaultCacheMaxBytes,
+		streams:       make(map[string]*Stream),
+	}
+}
+
+// HandleReader publishes r under r.Info().Key and blocks until the
+// publisher goes away, at which point every writer of the stream is
+// closed.
+func (hub *StreamHub) HandleReader(r av.ReadCloser) {
+	info := r.Info()
+	s := hub.getOrCreate(info.Key)
+
+	var own []av.WriteCloser
+	if ws, ok := r.(writerSource); ok {
+		own = ws.Writers()
+	}
+
+	if err := s.setReader(r); err != nil {
+		log.Warnf("stream %s: reject publisher %s: %v", info.Key, info.UID, err)
+		r.Close(err)
+		for _, w := range own {
+			w.Close(err)
+		}
+		hub.release(s)
+		return
+	}
+
+	log.Infof("stream %s: publisher %s attached", info.Key, info.UID)
+
+	for _, w := range own {
+		s.addWriter(w, true)
+	}
+
+	for _, g := range hub.getWriters() {
+		if w := g.GetWriter(info); w != nil {
+			s.addWriter(w, true)
+			log.Infof("stream %s: writer %s attached", info.Key, w.Info().UID)
+		}
+	}
+
+	s.run()
+	log.Infof("stream %s: publisher %s detached", info.Key, info.UID)
+
+	hub.release(s)
+}
+
+// AddGetWriter registers g to be asked for a writer for every stream
+// published from now on. g may return nil to skip a stream.
+func (hub *StreamHub) AddGetWriter(g av.GetWriter) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	hub.getters = append(hub.getters, g)
+}
+
+func (hub *StreamHub) getWriters() []av.GetWriter {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	return append([]av.GetWriter(nil), hub.getters...)
+}
+
+// HandleWriter subscribes w to the stream w.Info().Key. The stream is
+// created if nobody publishes it yet, so players may connect first.
+func (hub *StreamHub) HandleWriter(w av.WriteCloser) {
+	info := w.Info()
+	s := hub.getOrCreate(info.Key)
+	s.addWriter(w, false)
+	log.Infof("stream %s: writer %s attached", info.Key, info.UID)
+
+	hub.mu.Lock()
+	puller := hub.puller
+	hub.mu.Unlock()
+
+	if puller != nil && !s.IsPublishing() {
+		puller.Pull(info.Key)
+	}
+}
+
+// SetPuller sets the Puller asked for streams that are not published.
+func (hub *StreamHub) SetPuller(p Puller) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	hub.puller = p
+}
+
+// CloseStream closes the publisher and all writers of the stream key.
+func (hub *StreamHub) CloseStream(key string, err error) {
+	s, ok := hub.Stream(key)
+	if !ok {
+		return
+	}
+
+	s.closeAll(err)
+	hub.release(s)
+}
+
+// RemoveWriter unsubscribes w, typically after its connection closed.
+func (hub *StreamHub) RemoveWriter(w av.WriteCloser) {
+	info := w.Info()
+
+	hub.mu.Lock()
+	s, ok := hub.streams[info.Key]
+	hub.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if s.removeWriter(info.UID) {
+		log.Infof("stream %s: writer %s detached", info.Key, info.UID)
+	}
+	hub.release(s)
+}
+
+// Stream returns the stream published or watched under key.
+func (hub *StreamHub) Stream(key string) (*Stream, bool) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	s, ok := hub.streams[key]
+	return s, ok
+}
+
+// Streams returns a snapshot of all streams known to the hub.
+func (hub *StreamHub) Streams() []*Stream {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	ret := make([]*Stream, 0, len(hub.streams))
+	for _, s := range hub.streams {
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+func (hub *StreamHub) getOrCreate(key string) *Stream {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	s, ok := hub.streams[key]
+	if !ok {
+		s = newStream(key, NewCache(hub.CacheGops, hub.CacheMaxBytes))
+		hub.streams[key] = s
+	}
+	return s
+}
+
+func (hub *StreamHub) release(s *Stream) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if cur, ok := hub.streams[s.key]; ok && cur == s && s.idle() {
+		delete(hub.streams, s.key)
+	}
+}
+
+// Stream is a single live stream: at most one publisher and any number
+// of writers receiving its packets.
+type Stream struct {
+	key      string
+	mu       sync.RWMutex
+	reader   av.ReadCloser
+	writers  map[string]av.WriteCloser
+	sinks    map[string]struct{}
+	cache    *Cache
+	video    *h264.SPS
+	audio    *aac.Config
+	metadata amf.Object
+}
+
+func newStream(key string, cache *Cache) *Stream {
+	return &Stream{
+		key:     key,
+		writers: make(map[string]av.WriteCloser),
+		sinks:   make(map[string]struct{}),
+		cache:   cache,
+	}
+}
+
+func (s *Stream) Key() string {
+	return s.key
+}
+
+// IsPublishing reports whether the stream currently has a publisher.
+func (s *Stream) IsPublishing() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.reader != nil
+}
+
+// VideoInfo returns the parameters of the last H.264 sequence header
+// of the current publisher, if any.
+func (s *Stream) VideoInfo() (h264.SPS, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.video == nil {
+		return h264.SPS{}, false
+	}
+	return *s.video, true
+}
+
+// AudioInfo returns the parameters of the last AAC sequence header of
+// the current publisher, if any.
+func (s *Stream) AudioInfo() (aac.Config, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.audio == nil {
+		return aac.Config{}, false
+	}
+	return *s.audio, true
+}
+
+// Metadata returns the onMetaData properties of the current publisher,
+// with the server fields. The object must not be modified.
+func (s *Stream) Metadata() (amf.Object, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.metadata, s.metadata != nil
+}
+
+// NumWriters returns the number of subscribed writers.
+func (s *Stream) NumWriters() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.writers)
+}
+
+// NumViewers returns the number of subscribed players, leaving out the
+// recorders, segmenters and relays the server attaches on its own.
+func (s *Stream) NumViewers() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.writers) - len(s.sinks)
+}
+
+func (s *Stream) setReader(r av.ReadCloser) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reader != nil {
+		return ErrPublisherExists
+	}
+	s.reader = r
+	s.video = nil
+	s.audio = nil
+	s.metadata = nil
+
+	for _, w := range s.writers {
+		w.CalcBaseTimestamp()
+	}
+	return nil
+}
+
+// addWriter subscribes w after replaying the cache to it. Holding the
+// write lock keeps dispatch out, so w sees no gap and no duplicates.
+// A sink is a writer of the server itself rather than a viewer.
+func (s *Stream) addWriter(w av.WriteCloser, sink bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.cache.Send(w); err != nil {
+		log.Warnf("stream %s: send cache to %s: %v", s.key, w.Info().UID, err)
+		w.Close(err)
+		return
+	}
+	s.writers[w.Info().UID] = w
+	if sink {
+		s.sinks[w.Info().UID] = struct{}{}
+	}
+}
+
+func (s *Stream) removeWriter(uid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.writers[uid]; !ok {
+		return false
+	}
+	delete(s.writers, uid)
+	delete(s.sinks, uid)
+	return true
+}
+
+func (s *Stream) idle() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.reader == nil && len(s.writers) == 0
+}
+
+// run pumps packets from the publisher to the writers until the
+// publisher fails, then closes everything attached to the stream.
+func (s *Stream) run() {
+	s.mu.RLock()
+	r := s.reader
+	s.mu.RUnlock()
+
+	for {
+		p := new(av.Packet)
+		if err := r.Read(p); err != nil {
+			log.Infof("stream %s: read from publisher: %v", s.key, err)
+			s.closeAll(err)
+			return
+		}
+		switch {
+		case p.IsMetadata:
+			s.setMetadata(p)
+		case isVideoSeq(p):
+			s.setVideoInfo(p)
+		case isAudioSeq(p):
+			s.setAudioInfo(p)
+		}
+		s.dispatch(p)
+	}
+}
+
+// setMetadata rewrites the data message p for players and records the
+// stream metadata it carries.
+func (s *Stream) setMetadata(p *av.Packet) {
+	meta, err := rewriteMetadata(p)
+	if err != nil {
+		log.Warnf("stream %s: invalid metadata: %v", s.key, err)
+		return
+	}
+	if meta == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.metadata = meta
+	s.mu.Unlock()
+}
+
+// setVideoInfo records the parameters of the sequence header p and
+// logs resolution changes.
+func (s *Stream) setVideoInfo(p *av.Packet) {
+	if vh, ok := p.Header.(*flv.VideoTagHeader); ok && vh.IsExHeader() {
+		log.Infof("stream %s: video %s", s.key, vh.FourCC())
+		return
+	}
+
+	vh := p.Header.(av.VideoPacketHeader)
+	if vh.CodecID() != av.VIDEO_H264 || len(p.Data) < 5 {
+		return
+	}
+	c, err := h264.ParseDecoderConfig(p.Data[5:])
+	if err != nil {
+		log.Warnf("stream %s: invalid avc sequence header: %v", s.key, err)
+		return
+	}
+	sps, err := c.SPSInfo()
+	if err != nil {
+		log.Warnf("stream %s: invalid sps: %v", s.key, err)
+		return
+	}
+
+	s.mu.Lock()
+	prev := s.video
+	s.video = sps
+	s.mu.Unlock()
+
+	switch {
+	case prev == nil:
+		log.Infof("stream %s: video %s %dx%d", s.key, c.Codec(), sps.Width, sps.Height)
+	case prev.Width != sps.Width || prev.Height != sps.Height:
+		log.Infof("stream %s: video resolution changed from %dx%d to %dx%d",
+			s.key, prev.Width, prev.Height, sps.Width, sps.Height)
+	}
+}
+
+// setAudioInfo records the parameters of the sequence header p.
+func (s *Stream) setAudioInfo(p *av.Packet) {
+	if ah, ok := p.Header.(*flv.AudioTagHeader); ok && ah.IsExHeader() {
+		for _, t := range ah.Tracks() {
+			log.Infof("stream %s: audio track %d %s", s.key, t.ID, t.FourCC)
+		}
+		return
+	}
+
+	c, err := aac.ParseConfig(p.Data[2:])
+	if err != nil {
+		log.Warnf("stream %s: invalid aac sequence header: %v", s.key, err)
+		return
+	}
+
+	s.mu.Lock()
+	prev := s.audio
+	s.audio = c
+	s.mu.Unlock()
+
+	if prev == nil || *prev != *c {
+		rate, _ := c.SampleRate()
+		log.Infof("stream %s: audio %s %d Hz, %d channels", s.key, c.Codec(), rate, c.Channels())
+	}
+}
+
+// dispatch hands p to every writer. Writers must not modify p, which
+// is also kept by the cache.
+func (s *Stream) dispatch(p *av.Packet) {
+	var failed []av.WriteCloser
+
+	// Only the publishing goroutine writes to the cache, and readers of
+	// the cache hold the write lock, so the read lock is enough here.
+	s.mu.RLock()
+	s.cache.Write(p)
+	for _, w := range s.writers {
+		if !w.Alive() {
+			failed = append(failed, w)
+			continue
+		}
+		if err := w.Write(p); err != nil {
+			log.Warnf("stream %s: write to %s: %v", s.key, w.Info().UID, err)
+			w.Close(err)
+			failed = append(failed, w)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, w := range failed {
+		s.removeWriter(w.Info().UID)
+	}
+}
+
+func (s *Stream) closeAll(err error) {
+	s.mu.Lock()
+	r := s.reader
+	writers := s.writers
+	s.reader = nil
+	s.writers = make(map[string]av.WriteCloser)
+	s.sinks = make(map[string]struct{})
+	s.cache.Reset()
+	s.mu.Unlock()
+
+	if r != nil {
+		r.Close(err)
+	}
+	for _, w := range writers {
+		w.Close(ErrUnpublished)
+	}
+}
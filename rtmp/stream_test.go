@@ -0,0 +1,167 @@
+package rtmp
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/flv"
+)
+
+// testReader publishes a fixed list of packets, then io.EOF.
+type testReader struct {
+	info    av.Info
+	packets []*av.Packet
+	closed  error
+}
+
+func (r *testReader) Read(p *av.Packet) error {
+	if len(r.packets) == 0 {
+		return io.EOF
+	}
+	*p = *r.packets[0]
+	r.packets = r.packets[1:]
+	return nil
+}
+
+func (r *testReader) Info() av.Info      { return r.info }
+func (r *testReader) Alive() bool        { return r.closed == nil }
+func (r *testReader) Close(err error)    { r.closed = err }
+func (r *testReader) CalcBaseTimestamp() {}
+
+// testWriter records the packets written to it.
+type testWriter struct {
+	info av.Info
+
+	mu      sync.Mutex
+	packets []av.Packet
+	closed  error
+}
+
+func newTestWriter(key string) *testWriter {
+	return &testWriter{info: av.Info{Key: key, UID: av.NewUID()}}
+}
+
+func (w *testWriter) Write(p *av.Packet) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.packets = append(w.packets, *p)
+	return nil
+}
+
+func (w *testWriter) Info() av.Info { return w.info }
+
+func (w *testWriter) Alive() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.closed == nil
+}
+
+func (w *testWriter) Close(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = err
+}
+
+func (w *testWriter) CalcBaseTimestamp() {}
+
+// testVideo returns a parsed FLV video packet with the tag data.
+func testVideo(t *testing.T, ts uint32, data ...byte) *av.Packet {
+	p := &av.Packet{IsVideo: true, TimeStamp: ts, Data: data}
+	if err := flv.ParseHeader(p); err != nil {
+		t.Fatalf("ParseHeader(% x): %v", data, err)
+	}
+	return p
+}
+
+// testGops returns an AVC sequence header followed by n GOPs of size
+// frames each, one frame per millisecond.
+func testGops(t *testing.T, n, size int) []*av.Packet {
+	packets := []*av.Packet{testVideo(t, 0, 0x17, 0x00, 0x00, 0x00, 0x00)}
+	for i := 0; i < n*size; i++ {
+		if i%size == 0 {
+			packets = append(packets, testVideo(t, uint32(i), 0x17, 0x01, 0x00, 0x00, 0x00, 0xaa))
+		} else {
+			packets = append(packets, testVideo(t, uint32(i), 0x27, 0x01, 0x00, 0x00, 0x00, 0xbb))
+		}
+	}
+	return packets
+}
+
+func TestStreamHubFanOut(t *testing.T) {
+	const key = "live/test"
+	packets := testGops(t, 5, 300)
+
+	hub := NewStreamHub()
+
+	w1 := newTestWriter(key)
+	w2 := newTestWriter(key)
+	other := newTestWriter("live/other")
+	hub.HandleWriter(w1)
+	hub.HandleWriter(w2)
+	hub.HandleWriter(other)
+
+	// a player nothing reads from, whose queue fills up
+	c, peer := net.Pipe()
+	defer peer.Close()
+	h := NewHandler(NewConn(c, 1024))
+	h.ConnInfo.App = "live"
+	h.PublishInfo.Name = "test"
+	slow := newPlayer(h)
+	hub.HandleWriter(slow)
+
+	r := &testReader{info: av.Info{Key: key, UID: av.NewUID()}, packets: packets}
+	hub.HandleReader(r)
+
+	if r.closed != io.EOF {
+		t.Errorf("publisher closed with %v, want %v", r.closed, io.EOF)
+	}
+	for i, w := range []*testWriter{w1, w2} {
+		if len(w.packets) != len(packets) {
+			t.Fatalf("writer %d got %d packets, want %d", i, len(w.packets), len(packets))
+		}
+		for j, p := range w.packets {
+			if p.TimeStamp != packets[j].TimeStamp || p.Data[0] != packets[j].Data[0] {
+				t.Fatalf("writer %d packet %d = %d % x, want %d % x", i, j,
+					p.TimeStamp, p.Data, packets[j].TimeStamp, packets[j].Data)
+			}
+		}
+		if w.closed != ErrUnpublished {
+			t.Errorf("writer %d closed with %v, want %v", i, w.closed, ErrUnpublished)
+		}
+	}
+	if len(other.packets) != 0 || other.closed != nil {
+		t.Errorf("writer of another stream got %d packets, closed with %v", len(other.packets), other.closed)
+	}
+
+	// The queue overflowed in the fourth GOP: the sequence header was
+	// kept and video resumed at the fifth keyframe.
+	if slow.Alive() {
+		t.Error("player still alive after unpublish")
+	}
+	queued := make([]av.Packet, 0, len(slow.packets))
+	for len(slow.packets) > 0 {
+		queued = append(queued, <-slow.packets)
+	}
+	if len(queued) != 1+300 {
+		t.Fatalf("player queued %d packets, want %d", len(queued), 1+300)
+	}
+	if !isVideoSeq(&queued[0]) {
+		t.Errorf("player queue starts with % x, want the sequence header", queued[0].Data)
+	}
+	if !isKeyFrame(&queued[1]) || queued[1].TimeStamp != 4*300 {
+		t.Errorf("player queue resumes at %d % x, want the keyframe at %d", queued[1].TimeStamp, queued[1].Data, 4*300)
+	}
+
+	if _, ok := hub.Stream(key); ok {
+		t.Error("stream still in the hub after unpublish")
+	}
+	if _, ok := hub.Stream("live/other"); !ok {
+		t.Error("stream of a waiting writer dropped from the hub")
+	}
+}
@@ -0,0 +1,353 @@
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/flv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// vodLead is how far ahead of real time tags are sent, so the client
+// buffer fills up quickly.
+const vodLead = time.Second
+
+/*
+vodPlayer plays a recorded FLV file to a client, paced at real time.
+
+The connection's goroutine keeps reading commands and hands seek and
+pause requests to the streaming goroutine, which answers them once it
+has acted on them. Reaching the end of the file is reported with
+onPlayStatus NetStream.Play.Complete, StreamEOF and NetStream.Play.Stop;
+the client may still seek back afterwards. After a seek, the metadata
+and sequence headers in effect at the keyframe are sent again before it.
+*/
+type vodPlayer struct {
+	handler   *Handler
+	info      av.Info
+	file      *os.File
+	reader    *flv.Reader
+	keyframes []flv.Keyframe
+	headers   []flv.HeaderTag
+	resend    []*av.Packet
+	ctl       chan streamCtl
+	done      chan struct{}
+	once      sync.Once
+
+	paused    bool
+	complete  bool
+	wallStart time.Time
+	tsStart   uint32
+	tsEnd     uint32
+	clockSet  bool
+}
+
+func newVodPlayer(handler *Handler, path string) (*vodPlayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := flv.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	keyframes, err := r.Keyframes()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	headers, err := r.Headers()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	app, name, url := handler.GetInfo()
+	return &vodPlayer{
+		handler: handler,
+		info: av.Info{
+			Key: app + "/" + name,
+			URL: url,
+			UID: av.NewUID(),
+		},
+		file:      f,
+		reader:    r,
+		keyframes: keyframes,
+		headers:   headers,
+		ctl:       make(chan streamCtl, 1),
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// serve streams the file and reads client commands until the client
+// leaves or the player is closed.
+func (v *vodPlayer) serve() {
+	go v.stream()
+
+	var c ChunkStream
+	for {
+		if err := v.handler.Read(&c); err != nil {
+			v.Close(err)
+			return
+		}
+
+		if c.TypeID != 20 && c.TypeID != 17 {
+			continue
+		}
+		if err := v.handler.handleCmdMsg(&c); err != nil {
+			v.Close(err)
+			return
+		}
+		if v.handler.deleted {
+			v.Close(io.EOF)
+			return
+		}
+
+		if ctl := v.handler.ctl; ctl != nil {
+			v.handler.ctl = nil
+			select {
+			case v.ctl <- *ctl:
+			case <-v.done:
+				return
+			}
+		}
+	}
+}
+
+func (v *vodPlayer) stream() {
+	defer v.file.Close()
+
+	v.handler.conn.SetRecorded()
+	if info := v.handler.PlayInfo; info.Start > 0 {
+		if err := v.seekTo(info.Start); err != nil {
+			v.Close(err)
+			return
+		}
+	}
+
+	var p av.Packet
+	pending := false
+	for {
+		if v.paused || v.complete {
+			select {
+			case <-v.done:
+				return
+			case c := <-v.ctl:
+				if err := v.control(c, &pending, &p); err != nil {
+					v.Close(err)
+					return
+				}
+			}
+			continue
+		}
+
+		for len(v.resend) > 0 {
+			if err := v.send(v.resend[0]); err != nil {
+				v.Close(err)
+				return
+			}
+			v.resend = v.resend[1:]
+		}
+
+		if !pending {
+			err := v.reader.ReadTag(&p)
+			if err == io.EOF {
+				v.finish()
+				continue
+			}
+			if err != nil {
+				v.Close(err)
+				return
+			}
+			pending = true
+		}
+
+		if !v.clockSet {
+			v.resetClock(p.TimeStamp)
+			if d := v.handler.PlayInfo.Duration; d > 0 {
+				v.tsEnd = p.TimeStamp + uint32(d)
+			}
+		}
+
+		if v.tsEnd > 0 && p.TimeStamp > v.tsEnd {
+			pending = false
+			v.finish()
+			continue
+		}
+
+		if wait := time.Until(v.due(p.TimeStamp)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-v.done:
+				timer.Stop()
+				return
+			case c := <-v.ctl:
+				timer.Stop()
+				if err := v.control(c, &pending, &p); err != nil {
+					v.Close(err)
+					return
+				}
+				continue
+			case <-timer.C:
+			}
+		}
+
+		if err := v.send(&p); err != nil {
+			v.Close(err)
+			return
+		}
+		pending = false
+	}
+}
+
+func (v *vodPlayer) resetClock(ts uint32) {
+	v.wallStart = time.Now()
+	v.tsStart = ts
+	v.clockSet = true
+}
+
+// due returns when the tag stamped ts should be sent.
+func (v *vodPlayer) due(ts uint32) time.Time {
+	if ts <= v.tsStart {
+		return v.wallStart
+	}
+	return v.wallStart.Add(time.Duration(ts-v.tsStart)*time.Millisecond - vodLead)
+}
+
+func (v *vodPlayer) send(p *av.Packet) error {
+	c := packetToChunk(p, uint32(v.handler.streamID))
+	if err := v.handler.conn.Write(&c); err != nil {
+		return err
+	}
+	return v.handler.Flush()
+}
+
+// control acts on a seek or pause request and answers it.
+func (v *vodPlayer) control(c streamCtl, pending *bool, p *av.Packet) error {
+	switch {
+	case c.seek:
+		if err := v.seekTo(c.ms); err != nil {
+			return err
+		}
+		*pending = false
+		v.complete = false
+		v.handler.conn.SetBegin()
+		desc := fmt.Sprintf("Seeking %d (stream ID: %d).", int64(c.ms), v.handler.streamID)
+		if err := v.handler.sendStatus("status", "NetStream.Seek.Notify", desc); err != nil {
+			return err
+		}
+		return v.handler.sendStatus("status", "NetStream.Play.Start", "Started playing "+v.info.Key+".")
+
+	case c.pause:
+		if v.paused {
+			return nil
+		}
+		v.paused = true
+		desc := fmt.Sprintf("Pausing %s.", v.info.Key)
+		if err := v.handler.sendStatus("status", "NetStream.Pause.Notify", desc); err != nil {
+			return err
+		}
+		v.handler.conn.SetEOF()
+		return v.handler.Flush()
+
+	default:
+		if !v.paused {
+			return nil
+		}
+		v.paused = false
+		if *pending {
+			v.resetClock(p.TimeStamp)
+		} else {
+			v.clockSet = false
+		}
+		v.handler.conn.SetBegin()
+		desc := fmt.Sprintf("Unpausing %s.", v.info.Key)
+		return v.handler.sendStatus("status", "NetStream.Unpause.Notify", desc)
+	}
+}
+
+// seekTo positions the reader on the last keyframe at or before ms and
+// queues the headers preceding it. The clock restarts at the next tag
+// read.
+func (v *vodPlayer) seekTo(ms float64) error {
+	v.clockSet = false
+	v.tsEnd = 0
+	v.resend = nil
+
+	i := sort.Search(len(v.keyframes), func(i int) bool {
+		return float64(v.keyframes[i].Timestamp) > ms
+	})
+	if i == 0 {
+		return v.reader.Rewind()
+	}
+
+	kf := v.keyframes[i-1]
+	v.resend = v.headersBefore(kf.Offset, kf.Timestamp)
+	return v.reader.SeekTo(kf.Offset)
+}
+
+// headersBefore returns the latest metadata and sequence headers found
+// before offset, stamped ts.
+func (v *vodPlayer) headersBefore(offset int64, ts uint32) []*av.Packet {
+	var metadata, videoSeq *av.Packet
+	var audio audioSeqs
+	for _, h := range v.headers {
+		if h.Offset >= offset {
+			break
+		}
+		switch p := h.Packet; {
+		case p.IsMetadata:
+			metadata = p
+		case isVideoSeq(p):
+			videoSeq = p
+		case isAudioSeq(p):
+			audio.set(p)
+		}
+	}
+
+	var ret []*av.Packet
+	for _, p := range append([]*av.Packet{metadata, videoSeq}, audio.packets()...) {
+		if p == nil {
+			continue
+		}
+		cp := *p
+		cp.TimeStamp = ts
+		ret = append(ret, &cp)
+	}
+	return ret
+}
+
+func (v *vodPlayer) finish() {
+	v.complete = true
+	log.Infof("vod %s: playback complete", v.info.Key)
+
+	status := StatusEvent{
+		Level: "status",
+		Code:  "NetStream.Play.Complete",
+	}
+	v.handler.writeDataMsg(5, uint32(v.handler.streamID), "onPlayStatus", status)
+
+	v.handler.conn.SetEOF()
+	v.handler.sendStatus("status", "NetStream.Play.Stop", "Stopped playing "+v.info.Key+".")
+}
+
+func (v *vodPlayer) Info() av.Info {
+	return v.info
+}
+
+func (v *vodPlayer) Close(err error) {
+	v.once.Do(func() {
+		close(v.done)
+		v.handler.Close(err)
+	})
+}
@@ -0,0 +1,89 @@
+package rtmp
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"rtmp-example/internal/av"
+	"rtmp-example/internal/flv"
+)
+
+// readAll reads packets from a playing client until the stream ends.
+func readAll(t *testing.T, cc *Client) []av.Packet {
+	var ret []av.Packet
+	for {
+		var p av.Packet
+		err := cc.Read(&p)
+		if err == io.EOF {
+			return ret
+		}
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		ret = append(ret, p)
+	}
+}
+
+func TestVodPlaySeek(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "live"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "live", "test.flv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a sequence header and 3 GOPs of 5 frames, 40ms apart
+	w := bufio.NewWriter(f)
+	m := flv.NewMuxer()
+	m.Mux(testVideo(t, 0, 0x17, 0x00, 0x00, 0x00, 0x00), w)
+	for i := 0; i < 15; i++ {
+		if i%5 == 0 {
+			m.Mux(testVideo(t, uint32(i*40), 0x17, 0x01, 0x00, 0x00, 0x00, byte(i)), w)
+		} else {
+			m.Mux(testVideo(t, uint32(i*40), 0x27, 0x01, 0x00, 0x00, 0x00, byte(i)), w)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	base := testServer(t, &Server{Hub: NewStreamHub(), RecordDir: dir})
+	player, err := Dial(base+"/live/test", av.PLAY)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer player.Close(nil)
+	player.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	got := readAll(t, player)
+	if len(got) != 16 || !isVideoSeq(&got[0]) || got[15].TimeStamp != 560 {
+		t.Fatalf("played %d packets, want the sequence header and 15 frames up to 560", len(got))
+	}
+
+	// seeking back after the end resumes at the keyframe before 300,
+	// after the sequence header
+	if err := player.writeMsg(8, player.streamID, cmdSeek, 0, nil, 300.0); err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	got = readAll(t, player)
+	if len(got) != 11 {
+		t.Fatalf("played %d packets after seeking, want 11", len(got))
+	}
+	if !isVideoSeq(&got[0]) || got[0].TimeStamp != 200 {
+		t.Errorf("seek starts with %d % x, want the sequence header at 200", got[0].TimeStamp, got[0].Data)
+	}
+	for i, p := range got[1:] {
+		if want := uint32(200 + 40*i); p.TimeStamp != want {
+			t.Errorf("packet %d at %d, want %d", i+1, p.TimeStamp, want)
+		}
+	}
+	if !isKeyFrame(&got[1]) {
+		t.Errorf("seek resumes with % x, want a keyframe", got[1].Data)
+	}
+}